@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BootOptions are the settings that select how defgrid-init boots the
+// system, which are passed to NewBooter.
+//
+// When the kernel runs us as init it's awkward to pass command line
+// arguments, so the options are read primarily from the kernel command
+// line, using these parameters:
+//
+//	defgrid.flavor=<name>     the flavor to boot
+//	defgrid.interface=<name>  the network interface to configure, or the
+//	                          primary one if the flavor has several
+//	defgrid.console=<path>    the console device
+//	defgrid.log=<path>        the log device
+//	defgrid.debug             log extra information during boot
+//	defgrid.crash=<action>    "hang" or "reboot" after a crash
+//	defgrid.crash_max=<n>     how many crashes in a row to reboot after
+//	defgrid.crash_delay=<s>   seconds to wait before rebooting after a
+//	                          crash
+//	defgrid.watchdog=<path>   the watchdog device, or "off"
+//	defgrid.rw                remount the root filesystem read-write
+//	defgrid.flavors=<path>    the flavor definitions file
+//
+// If there's no flavor on the kernel command line, it's taken from our
+// first argument instead, as is convenient in the dev environments. If
+// there's no flavor there either, or if the flavor is "auto", we try to
+// detect the right one for the platform.
+type BootOptions struct {
+	Flavor string
+
+	// FlavorReasons explains how the flavor was chosen, for logging.
+	FlavorReasons []string
+
+	// The remaining options override the flavor's defaults if set.
+	Interface     string
+	ConsoleDevice string
+	LogDevice     string
+
+	Debug bool
+
+	// RootReadWrite requests that the root filesystem be remounted
+	// read-write, in flavors that mount filesystems.
+	RootReadWrite bool
+
+	CrashAction         CrashAction
+	CrashMaxConsecutive int
+	CrashRebootDelay    time.Duration
+
+	// Watchdog is the watchdog device path, or "off" to not use one.
+	Watchdog string
+
+	// FlavorsPath is the location of the flavor definitions file. It
+	// defaults to the DGI_FLAVORS environment variable, so that flavors
+	// can be tweaked in the dev environments, or otherwise flavorsPath.
+	FlavorsPath string
+}
+
+// ReadBootOptions builds BootOptions from the kernel command line at the
+// given path, usually kernelCmdlinePath, falling back on the given
+// program arguments (excluding the program name) and then the given
+// platform detector for the flavor.
+//
+// A kernel command line that can't be read is treated as empty, since in
+// some dev environments there isn't one to speak of.
+func ReadBootOptions(cmdlinePath string, args []string, detector *PlatformDetector) (*BootOptions, error) {
+	cmdline, err := ReadKernelCmdline(cmdlinePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARNING] Can't read kernel command line: %s\n", err)
+		cmdline = KernelCmdline{}
+	}
+
+	opts := &BootOptions{
+		Flavor:        cmdline["defgrid.flavor"],
+		Interface:     cmdline["defgrid.interface"],
+		ConsoleDevice: cmdline["defgrid.console"],
+		LogDevice:     cmdline["defgrid.log"],
+		FlavorsPath:   cmdline["defgrid.flavors"],
+		Watchdog:      cmdline["defgrid.watchdog"],
+	}
+
+	if opts.FlavorsPath == "" {
+		opts.FlavorsPath = os.Getenv("DGI_FLAVORS")
+	}
+	if opts.FlavorsPath == "" {
+		opts.FlavorsPath = flavorsPath
+	}
+
+	if cmdline.Has("defgrid.crash") {
+		opts.CrashAction, err = ParseCrashAction(cmdline["defgrid.crash"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmdline.Has("defgrid.crash_max") {
+		opts.CrashMaxConsecutive, err = strconv.Atoi(cmdline["defgrid.crash_max"])
+		if err != nil || opts.CrashMaxConsecutive < 1 {
+			return nil, fmt.Errorf("invalid defgrid.crash_max %q", cmdline["defgrid.crash_max"])
+		}
+	}
+	if cmdline.Has("defgrid.crash_delay") {
+		secs, err := strconv.Atoi(cmdline["defgrid.crash_delay"])
+		if err != nil || secs < 1 {
+			return nil, fmt.Errorf("invalid defgrid.crash_delay %q", cmdline["defgrid.crash_delay"])
+		}
+		opts.CrashRebootDelay = time.Duration(secs) * time.Second
+	}
+
+	opts.RootReadWrite = cmdlineFlag(cmdline, "defgrid.rw")
+	opts.Debug = cmdlineFlag(cmdline, "defgrid.debug")
+
+	switch {
+	case opts.Flavor != "" && opts.Flavor != "auto":
+		opts.FlavorReasons = []string{"defgrid.flavor is set on the kernel command line"}
+	case opts.Flavor == "" && len(args) > 0 && args[0] != "auto":
+		opts.Flavor = args[0]
+		opts.FlavorReasons = []string{"flavor given as an argument"}
+	default:
+		platform := detector.Detect()
+		opts.Flavor = platform.Flavor
+		opts.FlavorReasons = platform.Reasons
+	}
+
+	if opts.Flavor == "" {
+		return nil, fmt.Errorf(
+			"can't detect flavor (%s); set defgrid.flavor on the kernel command line",
+			strings.Join(opts.FlavorReasons, "; "),
+		)
+	}
+
+	return opts, nil
+}
+
+// cmdlineFlag returns true if the given boolean parameter is set on the
+// kernel command line, either alone or with a value other than one of
+// the usual ways of saying "no".
+func cmdlineFlag(cmdline KernelCmdline, name string) bool {
+	if !cmdline.Has(name) {
+		return false
+	}
+	switch cmdline[name] {
+	case "0", "false", "no", "off":
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadBootOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		cmdline    string
+		args       []string
+		wantFlavor string
+		wantErr    bool
+		check      func(t *testing.T, opts *BootOptions)
+	}{
+		{
+			name:       "kernel parameter wins over argument",
+			cmdline:    "quiet defgrid.flavor=baremetal",
+			args:       []string{"dev"},
+			wantFlavor: "baremetal",
+		},
+		{
+			name:       "argument wins over detection",
+			cmdline:    "quiet",
+			args:       []string{"testhost"},
+			wantFlavor: "testhost",
+		},
+		{
+			name:       "init argument after dashes",
+			cmdline:    "quiet -- defgrid.flavor=baremetal",
+			args:       []string{"testhost"},
+			wantFlavor: "testhost",
+		},
+		{
+			name:       "detection",
+			cmdline:    "quiet",
+			wantFlavor: "dev",
+		},
+		{
+			name:       "auto kernel parameter asks for detection",
+			cmdline:    "defgrid.flavor=auto",
+			args:       []string{"testhost"},
+			wantFlavor: "dev",
+		},
+		{
+			name:       "auto argument",
+			args:       []string{"auto"},
+			wantFlavor: "dev",
+		},
+		{
+			name:       "last repeated parameter wins",
+			cmdline:    "defgrid.flavor=dev defgrid.flavor=baremetal",
+			wantFlavor: "baremetal",
+		},
+		{
+			name:       "overrides",
+			cmdline:    `defgrid.flavor=baremetal defgrid.interface=eth1 defgrid.console="/dev/tty2" defgrid.debug defgrid.rw=no defgrid.crash=reboot defgrid.crash_max=5 defgrid.crash_delay=10 defgrid.watchdog=off`,
+			wantFlavor: "baremetal",
+			check: func(t *testing.T, opts *BootOptions) {
+				if opts.Interface != "eth1" || opts.ConsoleDevice != "/dev/tty2" || opts.Watchdog != "off" {
+					t.Errorf("wrong overrides %+v", opts)
+				}
+				if !opts.Debug || opts.RootReadWrite {
+					t.Errorf("wrong flags: debug %t, rw %t", opts.Debug, opts.RootReadWrite)
+				}
+				if opts.CrashAction != CrashReboot || opts.CrashMaxConsecutive != 5 || opts.CrashRebootDelay != 10*time.Second {
+					t.Errorf("wrong crash options %q %d %s", opts.CrashAction, opts.CrashMaxConsecutive, opts.CrashRebootDelay)
+				}
+			},
+		},
+		{
+			name:    "invalid crash action",
+			cmdline: "defgrid.flavor=dev defgrid.crash=explode",
+			wantErr: true,
+		},
+		{
+			name:    "invalid crash limit",
+			cmdline: "defgrid.flavor=dev defgrid.crash_max=0",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "cmdline")
+			err := os.WriteFile(path, []byte(test.cmdline+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// An empty tree, and not init, so detection picks "dev".
+			detector := &PlatformDetector{Root: dir, PID: 42}
+			opts, err := ReadBootOptions(path, test.args, detector)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if opts.Flavor != test.wantFlavor {
+				t.Errorf("wrong flavor %q; want %q", opts.Flavor, test.wantFlavor)
+			}
+			if len(opts.FlavorReasons) == 0 {
+				t.Errorf("no reasons given for the flavor")
+			}
+			if test.check != nil {
+				test.check(t, opts)
+			}
+		})
+	}
+}
+
+func TestReadBootOptionsNoCmdline(t *testing.T) {
+	// Some dev environments have no kernel command line to read.
+	detector := &PlatformDetector{Root: t.TempDir(), PID: 42}
+	opts, err := ReadBootOptions(filepath.Join(t.TempDir(), "missing"), []string{"devcontainer"}, detector)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if opts.Flavor != "devcontainer" {
+		t.Errorf("wrong flavor %q; want %q", opts.Flavor, "devcontainer")
+	}
+}
+
+func TestReadBootOptionsFlavorsPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cmdline")
+	err := os.WriteFile(path, []byte("defgrid.flavor=dev"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DGI_FLAVORS", "")
+	opts, err := ReadBootOptions(path, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if opts.FlavorsPath != flavorsPath {
+		t.Errorf("wrong flavors path %q; want %q", opts.FlavorsPath, flavorsPath)
+	}
+
+	t.Setenv("DGI_FLAVORS", "/tmp/flavors.json")
+	opts, err = ReadBootOptions(path, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if opts.FlavorsPath != "/tmp/flavors.json" {
+		t.Errorf("wrong flavors path %q; want %q", opts.FlavorsPath, "/tmp/flavors.json")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BootReport records the timing and outcome of each phase of the boot
+// process, so that we can see which platforms boot slowly and why.
+//
+// The report is logged as a summary and written as JSON to
+// bootReportPath once boot is complete, or as soon as boot fails.
+type BootReport struct {
+	Flavor   string       `json:"flavor"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished,omitempty"`
+	Phases   []*BootPhase `json:"phases"`
+
+	// Must be held while accessing the fields above, once boot is under
+	// way.
+	mutex sync.Mutex
+}
+
+// BootPhase is the record of a single phase of the boot process.
+type BootPhase struct {
+	Name     string        `json:"name"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+
+	// Outcome is one of the BootOutcome values, or empty if the phase
+	// is still running.
+	Outcome BootOutcome `json:"outcome,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type BootOutcome string
+
+const (
+	BootOutcomeOK       BootOutcome = "ok"
+	BootOutcomeDegraded BootOutcome = "degraded"
+	BootOutcomeFailed   BootOutcome = "failed"
+)
+
+const bootReportPath = "/run/defgrid-init/boot-report.json"
+
+// NewBootReport starts a report for booting the given flavor.
+func NewBootReport(flavor string) *BootReport {
+	return &BootReport{
+		Flavor:  flavor,
+		Started: time.Now(),
+	}
+}
+
+// degradedError marks an error from a boot phase as one that the boot
+// process can continue despite.
+type degradedError struct {
+	err error
+}
+
+func (e degradedError) Error() string {
+	return e.err.Error()
+}
+
+// Degraded wraps an error returned from a boot phase function to show
+// that the phase had a problem but that boot should carry on anyway.
+func Degraded(err error) error {
+	return degradedError{err}
+}
+
+// Run runs the given function as the named boot phase, recording how long
+// it took and its outcome.
+//
+// The function's error is returned, except that errors wrapped by
+// Degraded are recorded but not returned.
+func (r *BootReport) Run(name string, fn func() error) error {
+	phase := &BootPhase{
+		Name:    name,
+		Started: time.Now(),
+	}
+	r.mutex.Lock()
+	r.Phases = append(r.Phases, phase)
+	r.mutex.Unlock()
+
+	err := fn()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	phase.Finished = time.Now()
+	phase.Duration = phase.Finished.Sub(phase.Started)
+	switch err.(type) {
+	case nil:
+		phase.Outcome = BootOutcomeOK
+	case degradedError:
+		phase.Outcome = BootOutcomeDegraded
+		phase.Error = err.Error()
+		err = nil
+	default:
+		phase.Outcome = BootOutcomeFailed
+		phase.Error = err.Error()
+	}
+
+	return err
+}
+
+// Finish marks the boot as complete.
+func (r *BootReport) Finish() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Finished = time.Now()
+}
+
+// Snapshot returns a copy of the report as it currently stands, for
+// inspecting while boot may still be in progress.
+func (r *BootReport) Snapshot() *BootReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ret := &BootReport{
+		Flavor:   r.Flavor,
+		Started:  r.Started,
+		Finished: r.Finished,
+		Phases:   make([]*BootPhase, len(r.Phases)),
+	}
+	for i, phase := range r.Phases {
+		phaseCopy := *phase
+		ret.Phases[i] = &phaseCopy
+	}
+	return ret
+}
+
+// LogSummary logs the duration and outcome of each phase, along with
+// when each started relative to the start of boot, since phases may
+// run concurrently.
+func (r *BootReport) LogSummary() {
+	snapshot := r.Snapshot()
+
+	log.Printf("Boot report for flavor %q:", snapshot.Flavor)
+	for _, phase := range snapshot.Phases {
+		offset := roundDuration(phase.Started.Sub(snapshot.Started))
+		switch phase.Outcome {
+		case "":
+			log.Printf("  %-16s +%-8s %8s  still running", phase.Name, offset, "")
+		case BootOutcomeOK:
+			log.Printf("  %-16s +%-8s %8s  %s", phase.Name, offset, roundDuration(phase.Duration), phase.Outcome)
+		default:
+			log.Printf("  %-16s +%-8s %8s  %s: %s", phase.Name, offset, roundDuration(phase.Duration), phase.Outcome, phase.Error)
+		}
+	}
+	if !snapshot.Finished.IsZero() {
+		log.Printf("  %-16s  %-8s %8s", "total", "", roundDuration(snapshot.Finished.Sub(snapshot.Started)))
+	}
+}
+
+// WriteFile writes the report as JSON to the given path, which is
+// usually bootReportPath.
+func (r *BootReport) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that nobody can see a partial
+	// report.
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d - d%time.Millisecond
+}
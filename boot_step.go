@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BootStep is one step of the boot process, run by RunBootSteps.
+type BootStep struct {
+	// Name identifies the step in the boot report and in log messages.
+	Name string
+
+	// Status is shown on the console while the step is running.
+	Status string
+
+	// After names the steps that must finish before this one starts.
+	After []string
+
+	// Retry decides whether and how to retry the step when it fails.
+	Retry RetryPolicy
+
+	// If Optional is set then a step that is still failing once its retry
+	// policy is exhausted leaves the system running in a degraded state,
+	// rather than failing the boot.
+	Optional bool
+
+	Run func() error
+
+	mutex sync.Mutex
+	// Set by RunBootSteps to have the console updated when the status
+	// changes.
+	statusChanged func()
+}
+
+// SetStatus replaces the status shown for the step, for steps that have
+// something more specific to say while they're running, such as why
+// they're taking so long.
+func (s *BootStep) SetStatus(status string) {
+	s.mutex.Lock()
+	s.Status = status
+	changed := s.statusChanged
+	s.mutex.Unlock()
+
+	if changed != nil {
+		changed()
+	}
+}
+
+func (s *BootStep) status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Status
+}
+
+// RetryPolicy describes how to retry a boot step that fails, which is
+// the right thing to do for anything that may be failing only
+// transiently, such as requests to a metadata service or DNS server.
+//
+// The delay between attempts doubles after each attempt, starting at
+// InitialBackoff and capped at MaxBackoff.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, or zero to keep trying
+	// until the deadline. If both are zero, there's only one attempt.
+	Attempts int
+
+	// Deadline is how long after the first attempt we stop trying, or
+	// zero for no deadline. We won't wait for a retry that would begin
+	// after the deadline.
+	Deadline time.Duration
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// The retry policies for the steps in the boot process.
+var (
+	// retryNever is for steps whose failures can't be transient, such as
+	// problems with the system image or our own configuration.
+	retryNever = RetryPolicy{Attempts: 1}
+
+	// retryLocal is for steps that depend only on the local system,
+	// but which may fail due to e.g. a device not being ready yet.
+	retryLocal = RetryPolicy{
+		Attempts:       3,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     5 * time.Second,
+	}
+
+	// retryNetwork is for steps that depend on other systems on the
+	// network, which may take a while to become available.
+	retryNetwork = RetryPolicy{
+		Deadline:       5 * time.Minute,
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+)
+
+// Do calls the given function until it succeeds or the policy is
+// exhausted, returning the last error in the latter case. The given
+// name is used in log messages.
+func (p RetryPolicy) Do(name string, fn func() error) error {
+	started := time.Now()
+	backoff := p.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("%s succeeded after %d attempts", name, attempt)
+			}
+			return nil
+		}
+
+		if p.Attempts > 0 && attempt >= p.Attempts {
+			return err
+		}
+		if p.Attempts == 0 && p.Deadline == 0 {
+			return err
+		}
+		if p.Deadline > 0 && time.Since(started)+backoff > p.Deadline {
+			return fmt.Errorf("%s (gave up after %d attempts)", err, attempt)
+		}
+
+		log.Printf("[WARNING] %s failed (attempt %d): %s; retrying in %s", name, attempt, err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// RunBootSteps runs the given steps, each according to its retry policy,
+// recording them in the given report and showing their progress on the
+// given console.
+//
+// Each step starts as soon as all of the steps named in its After list
+// have finished, so steps that don't depend on one another run
+// concurrently. The console shows the status of every step in flight.
+//
+// The error from a critical step is returned once its retry policy is
+// exhausted, and the caller should treat it as fatal. No further steps
+// are started after that, though any already running are not stopped. An
+// optional step that fails instead puts the console into the degraded
+// state, with a warning about the failed step, and its dependents run
+// as normal.
+func RunBootSteps(report *BootReport, console *Console, steps []*BootStep) error {
+	names := make(map[string]bool, len(steps))
+	for _, step := range steps {
+		// Steps are tracked by name, so a duplicate would never be
+		// started and we'd wait for it forever.
+		if names[step.Name] {
+			return fmt.Errorf("boot step %q is listed more than once", step.Name)
+		}
+		names[step.Name] = true
+	}
+	for _, step := range steps {
+		for _, dep := range step.After {
+			if !names[dep] {
+				return fmt.Errorf("boot step %q depends on unknown step %q", step.Name, dep)
+			}
+		}
+	}
+
+	type result struct {
+		step        *BootStep
+		err         error
+		degradedErr error
+	}
+	// Buffered so that steps still running when we return early can
+	// finish without anyone waiting for their results.
+	results := make(chan result, len(steps))
+
+	// Signalled when a running step changes its status.
+	statusChanged := make(chan struct{}, 1)
+	for _, step := range steps {
+		step.mutex.Lock()
+		step.statusChanged = func() {
+			select {
+			case statusChanged <- struct{}{}:
+			default:
+			}
+		}
+		step.mutex.Unlock()
+	}
+
+	started := make(map[string]bool, len(steps))
+	finished := make(map[string]bool, len(steps))
+	var running []*BootStep
+
+	for len(finished) < len(steps) {
+		for _, step := range steps {
+			if started[step.Name] || !bootStepReady(step, finished) {
+				continue
+			}
+			started[step.Name] = true
+			running = append(running, step)
+
+			go func(step *BootStep) {
+				// The steps used to run on main's goroutine, where the
+				// panic handler would catch a panic. Here a panic would
+				// kill PID 1 outright, so it becomes the step's error
+				// instead.
+				defer func() {
+					if p := recover(); p != nil {
+						results <- result{step, fmt.Errorf("panic in %s: %v\n%s", step.Name, p, debug.Stack()), nil}
+					}
+				}()
+				degradedErr, err := runBootStep(report, step)
+				results <- result{step, err, degradedErr}
+			}(step)
+		}
+
+		if len(running) == 0 {
+			return fmt.Errorf("boot steps have circular dependencies")
+		}
+
+		statuses := make([]string, len(running))
+		for i, step := range running {
+			statuses[i] = step.status()
+		}
+		console.SetBootStatus(strings.Join(statuses, "\n"))
+
+		var r result
+		select {
+		case r = <-results:
+		case <-statusChanged:
+			continue
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if r.degradedErr != nil {
+			log.Printf("[WARNING] Continuing boot despite %s failing: %s", r.step.Name, r.degradedErr)
+			console.SetDegraded(true)
+			console.SetWarning("boot-"+r.step.Name, fmt.Sprintf("%s failed: %s", r.step.Name, r.degradedErr))
+		}
+
+		finished[r.step.Name] = true
+		for i, step := range running {
+			if step == r.step {
+				running = append(running[:i], running[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func bootStepReady(step *BootStep, finished map[string]bool) bool {
+	for _, dep := range step.After {
+		if !finished[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// runBootStep runs a single step, returning the error from an optional
+// step separately since it isn't fatal.
+func runBootStep(report *BootReport, step *BootStep) (degradedErr error, err error) {
+	log.Println(step.status())
+
+	err = report.Run(step.Name, func() error {
+		err := step.Retry.Do(step.Name, step.Run)
+		if err != nil && step.Optional {
+			degradedErr = err
+			return Degraded(err)
+		}
+		return err
+	})
+	return degradedErr, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunBootStepsInvalid(t *testing.T) {
+	run := func() error {
+		t.Error("step ran despite invalid steps")
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		steps   []*BootStep
+		wantErr string
+	}{
+		{
+			name: "duplicate name",
+			steps: []*BootStep{
+				{Name: "a", Run: run},
+				{Name: "b", After: []string{"a"}, Run: run},
+				{Name: "a", Run: run},
+			},
+			wantErr: `boot step "a" is listed more than once`,
+		},
+		{
+			name: "unknown dependency",
+			steps: []*BootStep{
+				{Name: "a", Run: run},
+				{Name: "b", After: []string{"c"}, Run: run},
+			},
+			wantErr: `boot step "b" depends on unknown step "c"`,
+		},
+		{
+			name: "circular dependency",
+			steps: []*BootStep{
+				{Name: "a", After: []string{"b"}, Run: run},
+				{Name: "b", After: []string{"a"}, Run: run},
+			},
+			wantErr: "circular dependencies",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Invalid steps are rejected before anything is reported or
+			// shown, so we needn't provide a report or console.
+			err := RunBootSteps(nil, nil, test.steps)
+			if err == nil {
+				t.Fatalf("succeeded; want error")
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wrong error %q; want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunBootStepsPanic(t *testing.T) {
+	var ran bool
+	steps := []*BootStep{
+		{Name: "a", Run: func() error { return nil }},
+		{Name: "b", After: []string{"a"}, Optional: true, Run: func() error {
+			var m map[string]int
+			m["x"] = 1
+			return nil
+		}},
+		{Name: "c", After: []string{"b"}, Run: func() error {
+			ran = true
+			return nil
+		}},
+	}
+
+	err := RunBootSteps(NewBootReport("test"), &Console{}, steps)
+	if err == nil {
+		t.Fatalf("succeeded; want error")
+	}
+	if !strings.HasPrefix(err.Error(), "panic in b: assignment to entry in nil map") {
+		t.Errorf("wrong error %q", err)
+	}
+	if ran {
+		t.Errorf("step after the panic ran")
+	}
+}
@@ -5,99 +5,76 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"time"
 )
 
-func NewBooter(flavor string) *Booter {
-	switch flavor {
-
-	case "dev":
-		// "dev" means just launching the program directly within a
-		// standalone dev environment; this mode may not do anything
-		// that requires root access or make any permanent changes
-		// to the system, since the primary motivation is to get
-		// through the boot process with little fanfare so we can
-		// test the service-supervision part.
-
-		// Environment variables can be used to customize how we
-		// fake various aspects of the system.
-		consoleDev := os.Getenv("DGI_DEV_CONSOLE")
-		if consoleDev == "" {
-			consoleDev = "/dev/null"
-		}
-
-		logDev := os.Getenv("DGI_DEV_LOG")
-		if logDev == "" {
-			logDev = "/dev/tty"
-		}
-
-		return &Booter{
-			consoleDevPath:      consoleDev,
-			logDevPath:          logDev,
-			randomConfig:        &RandomConfigurerNoOp{},
-			networkConfig:       &NetworkConfigurerLocalDev{},
-			earlyResolverConfig: &ResolverConfigurerNoOp{},
-			nodeConfigGetter:    &NodeConfigGetterLocalDev{},
-			resolverConfig:      &ResolverConfigurerNoOp{},
-		}
+// NewBooter returns a Booter for the flavor selected in the given options,
+// which must be one of the given flavor definitions.
+func NewBooter(opts *BootOptions, flavors map[string]*FlavorDefinition) (*Booter, error) {
+	def, ok := flavors[opts.Flavor]
+	if !ok {
+		return nil, fmt.Errorf("unknown flavor %q", opts.Flavor)
+	}
 
-	case "devcontainer":
-		// "devcontainer" is similar to "dev" except that we expect to be
-		// launching in some sort of container, such as a Docker container.
-		// This means it is somewhat isolated from the host system but still
-		// isn't controlling a full machine and so ends up being a mixture
-		// of "dev" and "testhost" config.
-
-		// Environment variables can be used to customize how we
-		// fake various aspects of the system.
-		consoleDev := os.Getenv("DGI_DEV_CONSOLE")
-		if consoleDev == "" {
-			consoleDev = "/dev/null"
-		}
+	b, err := def.newBooter()
+	if err != nil {
+		return nil, fmt.Errorf("invalid flavor %q: %s", opts.Flavor, err)
+	}
 
-		logDev := os.Getenv("DGI_DEV_LOG")
-		if logDev == "" {
-			logDev = "/dev/tty"
+	if opts.Interface != "" {
+		err := setNetworkInterface(b.networkConfig, opts.Interface)
+		if err != nil {
+			return nil, err
 		}
+	}
+	if opts.ConsoleDevice != "" {
+		b.consoleDevPath = opts.ConsoleDevice
+	}
+	if opts.LogDevice != "" {
+		b.logDevPath = opts.LogDevice
+	}
+	b.debug = opts.Debug
+	if opts.RootReadWrite {
+		b.remountRootRW = true
+	}
+	switch opts.Watchdog {
+	case "":
+	case "off":
+		b.watchdogPath = ""
+	default:
+		b.watchdogPath = opts.Watchdog
+	}
+	if opts.CrashAction != "" {
+		b.crashPolicy.Action = opts.CrashAction
+	}
+	if opts.CrashMaxConsecutive != 0 {
+		b.crashPolicy.MaxConsecutive = opts.CrashMaxConsecutive
+	}
+	if opts.CrashRebootDelay != 0 {
+		b.crashPolicy.RebootDelay = opts.CrashRebootDelay
+	}
 
-		return &Booter{
-			consoleDevPath: consoleDev,
-			logDevPath:     logDev,
-			randomConfig:   &RandomConfigurerNoOp{},
-			networkConfig: &NetworkConfigurerLocalDev{
-				ForceInterface: "eth0", // assume docker container with preconfigured eth0
-			},
-			earlyResolverConfig: &ResolverConfigurerNoOp{},
-			nodeConfigGetter:    &NodeConfigGetterLocalDev{},
-			resolverConfig:      &ResolverConfigurerNoOp{},
-		}
+	return b, nil
+}
 
-	case "testhost":
-		// "testhost" is another kind of dev environment, but used
-		// when we're running in a local qemu instance launched from
-		// within the defgrid-images repository. In this case we
-		// *are* booting a virtual machine, and so we do need to go
-		// through all the usual network configuration steps, but
-		// there's no "metadata service" with which to discover our
-		// node id and region, and so we'll just use synthetic
-		// values for these which are designed to be "unique enough"
-		// for our test network.
-		return &Booter{
-			consoleDevPath:      "/dev/tty1",
-			logDevPath:          "/dev/hvc0", // virtio console
-			randomConfig:        &RandomConfigurerHaveged{},
-			networkConfig:       &NetworkConfigurerDHCP{Interface: "eth0"},
-			earlyResolverConfig: &ResolverConfigurerResolvDirect{},
-			nodeConfigGetter:    &NodeConfigGetterTestNet{},
-
-			// TODO: Once we've got consul running, write implementation
-			// that configures dnsmasq to forward .consul requests over
-			// to the DNS interface on the local consul agent.
-			resolverConfig: &ResolverConfigurerResolvDirect{},
-			///resolverConfig:      &ResolverConfigurerResolvWithConsul{},
-		}
+// setNetworkInterface overrides the interface that the given network
+// configurer will configure. For a configurer of several interfaces,
+// it's the primary interface that is overridden.
+func setNetworkInterface(cer NetworkConfigurer, ifaceName string) error {
+	switch cer := cer.(type) {
+	case *NetworkConfigurerLocalDev:
+		cer.ForceInterface = ifaceName
+	case *NetworkConfigurerDHCP:
+		cer.Interface = ifaceName
+	case *NetworkConfigurerStatic:
+		cer.Interface = ifaceName
+	case *NetworkConfigurerMulti:
+		return cer.setPrimaryInterface(ifaceName)
+	default:
+		return fmt.Errorf("can't override the interface for %T", cer)
 	}
-
 	return nil
 }
 
@@ -110,11 +87,145 @@ type Booter struct {
 	nodeConfigGetter    NodeConfigGetter
 	resolverConfig      ResolverConfigurer
 
+	// managesLinks is set for flavors where we own the network
+	// configuration, and so should restore it if something else
+	// disturbs it. In the dev flavors the network belongs to the host.
+	managesLinks bool
+
+	// earlyMounts is set for flavors where we must mount the standard
+	// filesystems ourselves, and remountRootRW if we must also make the
+	// root filesystem writable.
+	earlyMounts   bool
+	remountRootRW bool
+
+	// metadataEndpoint is the host:port of the service that
+	// nodeConfigGetter consults, if any, which we check is reachable
+	// before trying to get the node config.
+	metadataEndpoint string
+
+	debug bool
+
+	crashPolicy CrashPolicy
+
+	// watchdogPath is the watchdog device, or empty if we don't use one.
+	watchdogPath    string
+	watchdogTimeout time.Duration
+
 	earlyResolverActive bool
+
+	// cgroupsReady is set once SetupCgroups has succeeded.
+	cgroupsReady bool
+
+	services    []*ServiceDefinition
+	supervisors []*ServiceSupervisor
+}
+
+// warningReporter is implemented by boot components that can report
+// non-fatal problems which should be shown on the console.
+type warningReporter interface {
+	SetWarningFunc(func(msg string))
+}
+
+// bootStatusReporter is implemented by boot components that can say more
+// specifically what they're waiting for, which is then shown on the
+// console in place of their boot step's status.
+type bootStatusReporter interface {
+	SetBootStatusFunc(func(msg string))
+}
+
+// interfaceRenewer is implemented by NetworkConfigurers that can be asked
+// to refresh the configuration of one of their interfaces immediately,
+// rather than waiting for it to be refreshed on their own schedule.
+type interfaceRenewer interface {
+	RenewInterface(ifaceName string) error
+}
+
+// MountFilesystems mounts the standard filesystems, if the flavor is one
+// where we're responsible for that. This must happen before the console
+// and log devices are opened, since they live in /dev.
+func (b *Booter) MountFilesystems() error {
+	if !b.earlyMounts {
+		return nil
+	}
+	return MountEarlyFilesystems(b.remountRootRW)
+}
+
+// PowersOff reports whether shutting down should power off the system,
+// which is so for the flavors where we're the system's init. In the dev
+// flavors we may still be PID 1, in a container, but we just exit and
+// leave the rest to the host.
+func (b *Booter) PowersOff() bool {
+	return b.earlyMounts
+}
+
+// SetupCgroups prepares the cgroup slice that services run in, if the
+// flavor is one where we manage the system. In the dev flavors the
+// cgroups belong to the host.
+func (b *Booter) SetupCgroups() error {
+	if !b.earlyMounts {
+		return nil
+	}
+	err := setupCgroupSlice()
+	if err != nil {
+		return err
+	}
+	b.cgroupsReady = true
+	return nil
+}
+
+// StartServices starts supervising the flavor's services. They're placed
+// in cgroups only in the flavors where we manage the system, and only if
+// SetupCgroups succeeded; otherwise they run without resource limits.
+func (b *Booter) StartServices(console *Console) error {
+	if len(b.services) != 0 && b.earlyMounts && !b.cgroupsReady {
+		log.Printf("[WARNING] Running services without cgroups, since they couldn't be set up")
+	}
+
+	for _, def := range b.services {
+		supervisor, err := NewServiceSupervisor(def, console, b.cgroupsReady)
+		if err != nil {
+			return fmt.Errorf("can't start service %s: %s", def.Name, err)
+		}
+		b.supervisors = append(b.supervisors, supervisor)
+		go supervisor.Run()
+	}
+	return nil
+}
+
+// Supervisors returns the supervisors of the services started by
+// StartServices.
+func (b *Booter) Supervisors() []*ServiceSupervisor {
+	return b.supervisors
+}
+
+// StopServices stops all of the services started by StartServices.
+func (b *Booter) StopServices() {
+	for _, supervisor := range b.supervisors {
+		supervisor.Stop()
+	}
 }
 
 func (b *Booter) Console() (*Console, error) {
-	return OpenConsole(b.consoleDevPath)
+	console, err := OpenConsole(b.consoleDevPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if reporter, ok := b.networkConfig.(warningReporter); ok {
+		reporter.SetWarningFunc(func(msg string) {
+			console.SetWarning("network", msg)
+		})
+	}
+
+	return console, nil
+}
+
+// SetNetworkStatusFunc arranges for the network configurer to report
+// what it's waiting for via the given function, if it's able to.
+func (b *Booter) SetNetworkStatusFunc(fn func(msg string)) {
+	if reporter, ok := b.networkConfig.(bootStatusReporter); ok {
+		reporter.SetBootStatusFunc(fn)
+	}
 }
 
 func (b *Booter) LogWriter() (io.WriteCloser, error) {
@@ -150,10 +261,64 @@ func (b *Booter) ConfigureResolver(net *NetworkConfig, node *NodeConfig) error {
 	if b.earlyResolverActive {
 		err := b.earlyResolverConfig.UnconfigureResolver()
 		if err != nil {
-			return fmt.Errorf("failed to disable early resolver config: ", err)
+			return fmt.Errorf("failed to disable early resolver config: %s", err)
 		}
 		b.earlyResolverActive = false
 	}
 
 	return b.resolverConfig.ConfigureResolver(net, node)
 }
+
+// ReconfigureResolver re-runs whichever resolver configurer is currently
+// active, so that it can take account of a change in network config.
+//
+// If the early resolver is still active then the node config is ignored,
+// since the early resolver is never given one.
+func (b *Booter) ReconfigureResolver(net *NetworkConfig, node *NodeConfig) error {
+	if b.earlyResolverActive {
+		return b.earlyResolverConfig.ConfigureResolver(net, nil)
+	}
+
+	return b.resolverConfig.ConfigureResolver(net, node)
+}
+
+// ManagesLinks returns true if the network configuration belongs to us,
+// in which case a LinkMonitor should restore it if it is disturbed.
+func (b *Booter) ManagesLinks() bool {
+	return b.managesLinks
+}
+
+// Debug returns true if extra information should be logged during boot.
+func (b *Booter) Debug() bool {
+	return b.debug
+}
+
+// OpenWatchdog opens the watchdog device, if the flavor uses one. If not,
+// the result is nil.
+func (b *Booter) OpenWatchdog() (*Watchdog, error) {
+	if b.watchdogPath == "" {
+		return nil, nil
+	}
+	return OpenWatchdog(b.watchdogPath, b.watchdogTimeout)
+}
+
+// CrashPolicy returns the policy for handling crashes.
+func (b *Booter) CrashPolicy() CrashPolicy {
+	return b.crashPolicy
+}
+
+// MetadataEndpoint returns the host:port of the metadata service used to
+// get the node config, or the empty string if there is none.
+func (b *Booter) MetadataEndpoint() string {
+	return b.metadataEndpoint
+}
+
+// RenewNetworkInterface asks the network configurer to refresh the
+// configuration of the named interface immediately, if it supports that.
+// Configurers that don't support it are left alone.
+func (b *Booter) RenewNetworkInterface(ifaceName string) error {
+	if renewer, ok := b.networkConfig.(interfaceRenewer); ok {
+		return renewer.RenewInterface(ifaceName)
+	}
+	return nil
+}
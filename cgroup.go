@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Cgroup is a cgroup v2 subtree for one supervised service, under the
+// defgrid slice, which lets us limit the service's resources and reliably
+// kill all of its processes.
+type Cgroup struct {
+	Name string
+	Path string
+}
+
+// CgroupLimits are the resource limits for a service's cgroup. Zero
+// values leave the corresponding limit at the kernel's default, which is
+// generally unlimited.
+type CgroupLimits struct {
+	// MemoryMax is the hard memory limit in bytes, past which the
+	// service's processes are OOM-killed.
+	MemoryMax int64 `json:"memory_max"`
+
+	// CPUWeight is the service's share of CPU time relative to other
+	// services, from 1 to 10000 with a default of 100.
+	CPUWeight int `json:"cpu_weight"`
+
+	// CPUMax caps the service's CPU time, in the kernel's "$MAX $PERIOD"
+	// form; e.g. "50000 100000" allows half of one CPU.
+	CPUMax string `json:"cpu_max"`
+
+	// PIDsMax limits the number of processes and threads.
+	PIDsMax int `json:"pids_max"`
+
+	// IOWeight is the service's share of IO bandwidth relative to other
+	// services, from 1 to 10000 with a default of 100.
+	IOWeight int `json:"io_weight"`
+}
+
+const (
+	cgroupRoot  = "/sys/fs/cgroup"
+	cgroupSlice = "defgrid.slice"
+)
+
+// The controllers we enable for services, if the kernel has them.
+var cgroupControllers = []string{"cpu", "io", "memory", "pids"}
+
+var cgroupNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+var cgroupCPUMaxRegexp = regexp.MustCompile(`^(max|[0-9]+)( [0-9]+)?$`)
+
+// How long Kill waits for the processes in a cgroup to die.
+const cgroupKillTimeout = 10 * time.Second
+
+// How often WatchOOMKills checks for new OOM kills.
+const cgroupOOMPollInterval = 5 * time.Second
+
+// NewServiceCgroup creates the cgroup for the named service, with the
+// given limits, creating the defgrid slice first if necessary. If the
+// cgroup already exists, perhaps left over from an earlier run of the
+// service, it's reused and its limits are updated.
+func NewServiceCgroup(name string, limits *CgroupLimits) (*Cgroup, error) {
+	if !cgroupNameRegexp.MatchString(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid service cgroup name %q", name)
+	}
+
+	err := setupCgroupSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up %s: %s", cgroupSlice, err)
+	}
+
+	c := &Cgroup{
+		Name: name,
+		Path: filepath.Join(cgroupRoot, cgroupSlice, name+".service"),
+	}
+	err = os.Mkdir(c.Path, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	if limits != nil {
+		err = c.SetLimits(limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// setupCgroupSlice creates the defgrid slice and delegates the controllers
+// we use down to it, so that they're available to the services in it.
+func setupCgroupSlice() error {
+	available, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		// MountEarlyFilesystems carries on without cgroup2, leaving us
+		// to report it.
+		return fmt.Errorf("cgroup2 is not mounted on %s: %s", cgroupRoot, err)
+	}
+
+	var enable []string
+	for _, controller := range cgroupControllers {
+		if stringListContains(strings.Fields(string(available)), controller) {
+			enable = append(enable, "+"+controller)
+		} else {
+			log.Printf("[WARNING] cgroup controller %q is not available", controller)
+		}
+	}
+
+	slicePath := filepath.Join(cgroupRoot, cgroupSlice)
+	err = os.Mkdir(slicePath, 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	if len(enable) == 0 {
+		return nil
+	}
+	control := strings.Join(enable, " ")
+	for _, dir := range []string{cgroupRoot, slicePath} {
+		err := writeCgroupFile(dir, "cgroup.subtree_control", control)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLimits applies the given limits to the cgroup. Limits left at zero
+// are reset to the kernel's defaults.
+func (c *Cgroup) SetLimits(limits *CgroupLimits) error {
+	if limits.CPUMax != "" && !cgroupCPUMaxRegexp.MatchString(limits.CPUMax) {
+		return fmt.Errorf("invalid cpu_max %q", limits.CPUMax)
+	}
+	if limits.CPUWeight < 0 || limits.CPUWeight > 10000 {
+		return fmt.Errorf("cpu_weight must be between 1 and 10000")
+	}
+	if limits.IOWeight < 0 || limits.IOWeight > 10000 {
+		return fmt.Errorf("io_weight must be between 1 and 10000")
+	}
+
+	cpuMax := limits.CPUMax
+	if cpuMax == "" {
+		cpuMax = "max"
+	}
+
+	settings := []struct {
+		file  string
+		value string
+	}{
+		{"memory.max", cgroupLimitValue(limits.MemoryMax, "max")},
+		{"cpu.weight", cgroupLimitValue(int64(limits.CPUWeight), "100")},
+		{"cpu.max", cpuMax},
+		{"pids.max", cgroupLimitValue(int64(limits.PIDsMax), "max")},
+		{"io.weight", cgroupLimitValue(int64(limits.IOWeight), "default 100")},
+	}
+	for _, setting := range settings {
+		err := writeCgroupFile(c.Path, setting.file, setting.value)
+		if os.IsNotExist(err) {
+			// The controller isn't available, which we've already
+			// warned about in setupCgroupSlice.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cgroupLimitValue(value int64, unset string) string {
+	if value == 0 {
+		return unset
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// AddProcess moves the given process into the cgroup. Its future children
+// will then be in the cgroup too.
+func (c *Cgroup) AddProcess(pid int) error {
+	return writeCgroupFile(c.Path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// Kill kills every process in the cgroup and waits for them all to exit,
+// so that a stopped service can't leave stray processes behind.
+//
+// Kernels before 5.14 lack cgroup.kill, in which case we kill each process
+// listed in cgroup.procs instead, repeatedly, since processes may be
+// forking while we do it.
+func (c *Cgroup) Kill() error {
+	err := writeCgroupFile(c.Path, "cgroup.kill", "1")
+	useKillFile := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	deadline := time.Now().Add(cgroupKillTimeout)
+	for {
+		populated, err := c.populated()
+		if err != nil {
+			return err
+		}
+		if !populated {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("processes in %s still running after %s", c.Path, cgroupKillTimeout)
+		}
+
+		if !useKillFile {
+			pids, err := c.processes()
+			if err != nil {
+				return err
+			}
+			for _, pid := range pids {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Remove removes the cgroup, which must be empty.
+func (c *Cgroup) Remove() error {
+	err := os.Remove(c.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// OOMKills returns the number of processes in the cgroup that have been
+// killed for exceeding the memory limit.
+func (c *Cgroup) OOMKills() (int, error) {
+	events, err := readCgroupKeyedFile(c.Path, "memory.events")
+	if err != nil {
+		return 0, err
+	}
+	return int(events["oom_kill"]), nil
+}
+
+// WatchOOMKills checks the cgroup for new OOM kills until the given
+// channel is closed, and when there are some it logs them and shows the
+// service with the given icon as critical on the console.
+func (c *Cgroup) WatchOOMKills(console *Console, icon ConsoleIcon, stop <-chan struct{}) {
+	seen, err := c.OOMKills()
+	if err != nil {
+		log.Printf("[ERROR] Can't watch %s for OOM kills: %s", c.Name, err)
+		return
+	}
+
+	ticker := time.NewTicker(cgroupOOMPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		kills, err := c.OOMKills()
+		if err != nil {
+			log.Printf("[ERROR] Can't read OOM kills for %s: %s", c.Name, err)
+			continue
+		}
+		if kills > seen {
+			log.Printf("[ALERT] Service %s had %d process(es) killed for running out of memory", c.Name, kills-seen)
+			console.SetServiceStatus(icon, ServiceCritical)
+			seen = kills
+		}
+	}
+}
+
+func (c *Cgroup) populated() (bool, error) {
+	events, err := readCgroupKeyedFile(c.Path, "cgroup.events")
+	if err != nil {
+		return false, err
+	}
+	return events["populated"] != 0, nil
+}
+
+func (c *Cgroup) processes() ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.Path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+func writeCgroupFile(dir string, name string, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(value)
+	if err != nil {
+		return fmt.Errorf("failed to write %q to %s: %s", value, f.Name(), err)
+	}
+	return nil
+}
+
+// readCgroupKeyedFile reads one of the cgroup files that has a key and a
+// number on each line, like memory.events.
+func readCgroupKeyedFile(dir string, name string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := map[string]int64{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		ret[fields[0]] = value
+	}
+	return ret, lines.Err()
+}
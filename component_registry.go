@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ComponentDefinition selects an implementation of one of the Booter's
+// component interfaces by its registered type name, along with the
+// parameters for that implementation.
+//
+// The parameters are a JSON object whose properties are decoded into the
+// exported fields of the implementation struct, so e.g. the "dhcp"
+// network configurer accepts {"Interface": "eth0"}. For convenience,
+// durations may be given as strings like "30s", and byte slices may be
+// given as arrays of numbers.
+type ComponentDefinition struct {
+	Type   string          `json:"type"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// The registries of named implementations for each of the component
+// interfaces. Each function returns a new instance of the implementation
+// with its default settings, ready for parameters to be decoded into it.
+
+var randomConfigurerTypes = map[string]func() RandomConfigurer{
+	"noop":    func() RandomConfigurer { return &RandomConfigurerNoOp{} },
+	"haveged": func() RandomConfigurer { return &RandomConfigurerHaveged{} },
+}
+
+var networkConfigurerTypes = map[string]func() NetworkConfigurer{
+	"local-dev": func() NetworkConfigurer { return &NetworkConfigurerLocalDev{} },
+	"dhcp":      func() NetworkConfigurer { return &NetworkConfigurerDHCP{} },
+	"static":    func() NetworkConfigurer { return &NetworkConfigurerStatic{} },
+	"multi":     func() NetworkConfigurer { return &NetworkConfigurerMulti{} },
+}
+
+var resolverConfigurerTypes = map[string]func() ResolverConfigurer{
+	"noop":          func() ResolverConfigurer { return &ResolverConfigurerNoOp{} },
+	"resolv-direct": func() ResolverConfigurer { return &ResolverConfigurerResolvDirect{} },
+}
+
+var nodeConfigGetterTypes = map[string]func() NodeConfigGetter{
+	"local-dev": func() NodeConfigGetter { return &NodeConfigGetterLocalDev{} },
+	"testnet":   func() NodeConfigGetter { return &NodeConfigGetterTestNet{} },
+	"static":    func() NodeConfigGetter { return &NodeConfigGetterStatic{} },
+}
+
+func newRandomConfigurer(def *ComponentDefinition) (RandomConfigurer, error) {
+	factory, ok := randomConfigurerTypes[def.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown random configurer type %q", def.Type)
+	}
+	impl := factory()
+	return impl, decodeComponentParams(def, impl)
+}
+
+func newNetworkConfigurer(def *ComponentDefinition) (NetworkConfigurer, error) {
+	factory, ok := networkConfigurerTypes[def.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown network configurer type %q", def.Type)
+	}
+	impl := factory()
+	return impl, decodeComponentParams(def, impl)
+}
+
+func newResolverConfigurer(def *ComponentDefinition) (ResolverConfigurer, error) {
+	factory, ok := resolverConfigurerTypes[def.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown resolver configurer type %q", def.Type)
+	}
+	impl := factory()
+	return impl, decodeComponentParams(def, impl)
+}
+
+func newNodeConfigGetter(def *ComponentDefinition) (NodeConfigGetter, error) {
+	factory, ok := nodeConfigGetterTypes[def.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown node config getter type %q", def.Type)
+	}
+	impl := factory()
+	return impl, decodeComponentParams(def, impl)
+}
+
+// decodeComponentParams decodes the parameters from the given definition
+// into the given implementation struct pointer.
+//
+// Unknown parameters are an error, so that typos in flavor definitions
+// don't go unnoticed.
+func decodeComponentParams(def *ComponentDefinition, impl interface{}) error {
+	if len(def.Params) == 0 {
+		return nil
+	}
+
+	params, err := normalizeComponentParams(def.Params, reflect.TypeOf(impl).Elem())
+	if err != nil {
+		return fmt.Errorf("invalid params for %q: %s", def.Type, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(impl)
+	if err != nil {
+		return fmt.Errorf("invalid params for %q: %s", def.Type, err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var byteSliceType = reflect.TypeOf([]byte(nil))
+
+// normalizeComponentParams rewrites the friendlier forms of durations and
+// byte slices in the given JSON params into the forms that encoding/json
+// expects for the corresponding fields of the given struct type.
+func normalizeComponentParams(params json.RawMessage, structType reflect.Type) (json.RawMessage, error) {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(params, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			// Unexported, so encoding/json will ignore it anyway.
+			continue
+		}
+
+		for key, value := range raw {
+			// encoding/json matches field names case-insensitively,
+			// so we must too.
+			if !strings.EqualFold(key, field.Name) {
+				continue
+			}
+
+			switch field.Type {
+			case durationType:
+				var s string
+				if json.Unmarshal(value, &s) != nil {
+					continue
+				}
+				d, err := time.ParseDuration(s)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", key, err)
+				}
+				raw[key], _ = json.Marshal(int64(d))
+
+			case byteSliceType:
+				var nums []byte
+				if len(value) == 0 || value[0] != '[' {
+					continue
+				}
+				// Decoding into []int rather than []byte, since
+				// encoding/json would otherwise expect base64 here too.
+				var ints []int
+				err := json.Unmarshal(value, &ints)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", key, err)
+				}
+				for _, n := range ints {
+					if n < 0 || n > 255 {
+						return nil, fmt.Errorf("%s: %d is not a byte", key, n)
+					}
+					nums = append(nums, byte(n))
+				}
+				raw[key], _ = json.Marshal(base64.StdEncoding.EncodeToString(nums))
+			}
+		}
+	}
+
+	return json.Marshal(raw)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewNetworkConfigurerParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  string
+		want    *NetworkConfigurerDHCP
+		wantErr bool
+	}{
+		{
+			name: "no params",
+			want: &NetworkConfigurerDHCP{},
+		},
+		{
+			name:   "plain",
+			params: `{"Interface": "eth1", "ClientID": "node-1", "NoDefaultRoute": true}`,
+			want:   &NetworkConfigurerDHCP{Interface: "eth1", ClientID: "node-1", NoDefaultRoute: true},
+		},
+		{
+			name:   "case-insensitive names",
+			params: `{"interface": "eth1", "linklocalfallback": "1m", "requestoptions": [1, 3]}`,
+			want: &NetworkConfigurerDHCP{
+				Interface:         "eth1",
+				LinkLocalFallback: time.Minute,
+				RequestOptions:    []byte{1, 3},
+			},
+		},
+		{
+			name:   "duration string",
+			params: `{"LinkLocalFallback": "30s", "IPv4Wait": "1m30s"}`,
+			want:   &NetworkConfigurerDHCP{LinkLocalFallback: 30 * time.Second, IPv4Wait: 90 * time.Second},
+		},
+		{
+			name:   "duration nanoseconds",
+			params: `{"LinkLocalFallback": 5000000000}`,
+			want:   &NetworkConfigurerDHCP{LinkLocalFallback: 5 * time.Second},
+		},
+		{
+			name:    "bad duration",
+			params:  `{"LinkLocalFallback": "30 seconds"}`,
+			wantErr: true,
+		},
+		{
+			name:   "byte array",
+			params: `{"RequestOptions": [1, 3, 6, 255]}`,
+			want:   &NetworkConfigurerDHCP{RequestOptions: []byte{1, 3, 6, 255}},
+		},
+		{
+			name:   "byte base64",
+			params: `{"RequestOptions": "AQMG"}`,
+			want:   &NetworkConfigurerDHCP{RequestOptions: []byte{1, 3, 6}},
+		},
+		{
+			name:    "byte out of range",
+			params:  `{"RequestOptions": [1, 256]}`,
+			wantErr: true,
+		},
+		{
+			name:    "negative byte",
+			params:  `{"RequestOptions": [-1]}`,
+			wantErr: true,
+		},
+		{
+			name:    "byte array of strings",
+			params:  `{"RequestOptions": ["1"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			params:  `{"Interfac": "eth1"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unexported field",
+			params:  `{"lastLease": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			params:  `["eth1"]`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def := &ComponentDefinition{Type: "dhcp", Params: json.RawMessage(test.params)}
+			impl, err := newNetworkConfigurer(def)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := impl.(*NetworkConfigurerDHCP)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrong configurer %+v; want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewComponentUnknownType(t *testing.T) {
+	_, err := newNetworkConfigurer(&ComponentDefinition{Type: "carrier-pigeon"})
+	if err == nil {
+		t.Errorf("succeeded; want error")
+	}
+}
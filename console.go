@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -28,7 +29,8 @@ type Console struct {
 	// If BootStatusMessage is non-empty, the console will show a
 	// a full-screen boot logo with the status message beneath it.
 	// This is used during early boot when basic system information
-	// is not yet known.
+	// is not yet known. The message may have several lines, when
+	// several things are happening at once.
 	//
 	// Transitioning from the normal status screen back to the boot
 	// logo will lose any log information and is not suggested.
@@ -41,14 +43,31 @@ type Console struct {
 	SystemRoleIcon ConsoleIcon
 	Services       []ConsoleService
 	IPAddress      net.IP
+	IPv6Address    net.IP
 	Hostname       string
 	RegionName     string
 
+	// LinkState summarizes the state of the managed network links,
+	// such as "eth0 up".
+	LinkState string
+
+	// Degraded is set if some optional part of the boot process failed,
+	// so the system is running but perhaps not fully working. The
+	// reasons are given as warnings.
+	Degraded bool
+
 	logPreserved bool
 
 	// Set if someone calls FatalError, in which case we'll render a big
 	// ugly red error on the console instead of the usual status output.
 	fatalError error
+
+	// Shown beneath a fatal error, to say what will happen next.
+	fatalNote string
+
+	// Non-fatal problems reported via SetWarning, keyed by the subsystem
+	// that reported them so that each can be cleared independently.
+	warnings map[string]string
 }
 
 type ConsoleService struct {
@@ -156,10 +175,153 @@ func (c *Console) Logf(format string, args ...interface{}) {
 }
 
 func (c *Console) FatalError(err error) {
+	c.writeMutex.Lock()
 	c.fatalError = err
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// FatalErrorState returns the error passed to FatalError, or nil if the
+// console isn't showing a fatal error.
+func (c *Console) FatalErrorState() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.fatalError
+}
+
+// SetFatalErrorNote sets a short note to show in the fatal error box,
+// such as a countdown to rebooting.
+func (c *Console) SetFatalErrorNote(note string) {
+	c.writeMutex.Lock()
+	c.fatalNote = note
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// SetServiceStatus updates the status shown for the service with the
+// given icon, adding it to Services if it isn't already there.
+func (c *Console) SetServiceStatus(icon ConsoleIcon, status ServiceStatus) {
+	c.writeMutex.Lock()
+	found := false
+	for i := range c.Services {
+		if c.Services[i].Icon == icon {
+			c.Services[i].Status = status
+			found = true
+		}
+	}
+	if !found {
+		c.Services = append(c.Services, ConsoleService{Icon: icon, Status: status})
+	}
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// SetWarning shows a non-fatal problem on the console on behalf of the
+// given subsystem, replacing any earlier warning from that subsystem.
+// Passing an empty message clears the subsystem's warning.
+//
+// Warnings are intended for problems that an operator at the console
+// ought to know about, but which the system is working around.
+func (c *Console) SetWarning(source string, msg string) {
+	c.writeMutex.Lock()
+	if msg == "" {
+		delete(c.warnings, source)
+	} else {
+		if c.warnings == nil {
+			c.warnings = make(map[string]string)
+		}
+		c.warnings[source] = msg
+	}
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// SetBootStatus replaces BootStatusMessage and refreshes the display,
+// and is safe to call while other goroutines are logging to the console.
+func (c *Console) SetBootStatus(msg string) {
+	c.writeMutex.Lock()
+	c.BootStatusMessage = msg
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// SetDegraded replaces Degraded and refreshes the display, and is safe to
+// call while other goroutines are logging to the console.
+func (c *Console) SetDegraded(degraded bool) {
+	c.writeMutex.Lock()
+	c.Degraded = degraded
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// SetRuntimeInfo leaves the boot logo for the normal status screen,
+// showing the given information about the system. It's safe to call while
+// other goroutines are using the console, such as the services started
+// during boot.
+func (c *Console) SetRuntimeInfo(roleName string, ipAddress, ipv6Address net.IP, hostname, regionName string) {
+	c.writeMutex.Lock()
+	c.BootStatusMessage = ""
+	c.SystemRoleName = roleName
+	c.IPAddress = ipAddress
+	c.IPv6Address = ipv6Address
+	c.Hostname = hostname
+	c.RegionName = regionName
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// SetIPv6Address replaces IPv6Address and refreshes the display, and is
+// safe to call while other goroutines are logging to the console.
+func (c *Console) SetIPv6Address(addr net.IP) {
+	c.writeMutex.Lock()
+	c.IPv6Address = addr
+	c.writeMutex.Unlock()
+
+	c.Refresh()
+}
+
+// SetLinkState replaces LinkState and refreshes the display, and is safe
+// to call while other goroutines are logging to the console.
+func (c *Console) SetLinkState(state string) {
+	c.writeMutex.Lock()
+	c.LinkState = state
+	c.writeMutex.Unlock()
+
 	c.Refresh()
 }
 
+// warningText returns all of the current warnings as a single line no
+// longer than the given width.
+func (c *Console) warningText(width int) string {
+	if len(c.warnings) == 0 {
+		return ""
+	}
+
+	sources := make([]string, 0, len(c.warnings))
+	for source := range c.warnings {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	msgs := make([]string, len(sources))
+	for i, source := range sources {
+		msgs[i] = c.warnings[source]
+	}
+
+	text := strings.Join(msgs, "; ")
+	if len(text) > width {
+		text = text[0:width-3] + "..."
+	}
+	return text
+}
+
 func (c *Console) displayBootStatus() {
 	c.logPreserved = false
 	c.clearAndReset()
@@ -174,14 +336,22 @@ func (c *Console) displayBootStatus() {
 		c.tty.Write([]byte("\n"))
 	}
 
-	statusLen := len(c.BootStatusMessage)
-	col := 40 - (statusLen / 2)
-	c.tty.Write(
-		[]byte(fmt.Sprintf(
-			"\033[18;%dH\033[1;37m%s\n",
-			col, c.BootStatusMessage,
-		)),
-	)
+	row := 18
+	for _, status := range strings.Split(c.BootStatusMessage, "\n") {
+		col := 40 - (len(status) / 2)
+		c.tty.Write(
+			[]byte(fmt.Sprintf(
+				"\033[%d;%dH\033[1;37m%s\n",
+				row, col, status,
+			)),
+		)
+		row++
+	}
+
+	if warning := c.warningText(76); warning != "" {
+		col := 40 - (len(warning) / 2)
+		fmt.Fprintf(c.tty, "\033[%d;%dH\033[1;33m%s\n", row+1, col, warning)
+	}
 }
 
 func (c *Console) displayRuntimeStatus() {
@@ -220,6 +390,9 @@ func (c *Console) displayRuntimeStatus() {
 		}
 		c.tty.Write([]byte(c.SystemRoleName))
 		c.tty.Write([]byte{32})
+		if c.Degraded {
+			c.tty.Write([]byte("\033[1;33m(degraded) "))
+		}
 
 		// Small Defgrid logo
 		c.tty.Write(
@@ -237,8 +410,15 @@ func (c *Console) displayRuntimeStatus() {
 	// service icons, so we don't need to worry about re-erasing that
 	// below.)
 	fmt.Fprintf(c.tty, "\033[3;5H\033[0;37m\033[KIP Address: %s", c.IPAddress)
+	if c.IPv6Address != nil && !c.IPv6Address.Equal(c.IPAddress) {
+		fmt.Fprintf(c.tty, "  IPv6: %s", c.IPv6Address)
+	}
 	fmt.Fprintf(c.tty, "\033[4;5H\033[0;37m\033[KHostname:   %s", c.Hostname)
 	fmt.Fprintf(c.tty, "\033[5;5H\033[0;37m\033[KRegion:     %s", c.RegionName)
+	if c.LinkState != "" {
+		fmt.Fprintf(c.tty, "\033[5;45H\033[0;37mLink: %s", c.LinkState)
+	}
+	fmt.Fprintf(c.tty, "\033[6;3H\033[1;33m\033[K%s", c.warningText(76))
 
 	// Service icons
 	// Each icon takes up two character cells and we include a space
@@ -311,6 +491,10 @@ func (c *Console) displayFatalError() {
 
 	fmt.Fprintf(c.tty, "\033[2;3HCritical System Error. See system log for more details.")
 	fmt.Fprintf(c.tty, "\033[4;3H%s", errMsg)
+	if c.fatalNote != "" {
+		fmt.Fprintf(c.tty, "\033[3;3H\033[K%s\033[3;80H", c.fatalNote)
+		c.tty.Write(bigBlock)
+	}
 }
 
 func (c *Console) clearAndReset() {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// CrashAction is what to do once we've recorded a crash.
+type CrashAction string
+
+const (
+	// CrashHang leaves the fatal error on the console forever, so that
+	// someone can come and debug the problem.
+	CrashHang CrashAction = "hang"
+
+	// CrashReboot reboots the system after a countdown, in the hope that
+	// the problem was transient.
+	CrashReboot CrashAction = "reboot"
+)
+
+// CrashPolicy configures how CrashRecovery handles a crash.
+type CrashPolicy struct {
+	Action CrashAction
+
+	// RebootDelay is how long we show the countdown on the console
+	// before rebooting.
+	RebootDelay time.Duration
+
+	// MaxConsecutive is how many crashes in a row we'll reboot after.
+	// After that many we hang instead, since rebooting evidently isn't
+	// helping. Crashes count as consecutive unless the system stays up
+	// for crashStableUptime after boot completes in between.
+	MaxConsecutive int
+
+	// Dir is where crash files and the consecutive crash count are kept,
+	// which should be on persistent storage.
+	Dir string
+}
+
+const (
+	crashDefaultRebootDelay    = 30 * time.Second
+	crashDefaultMaxConsecutive = 3
+	crashDefaultDir            = "/var/lib/defgrid-init/crash"
+
+	// How long the system must stay up after boot before we consider it
+	// stable and stop counting earlier crashes, so that a crash loop
+	// with a period of a few minutes still trips MaxConsecutive.
+	crashStableUptime = 15 * time.Minute
+
+	// How many crash files to keep in the crash directory.
+	crashFilesKept = 10
+)
+
+// ParseCrashAction parses the name of a crash action, as given in flavor
+// definitions and on the kernel command line.
+func ParseCrashAction(s string) (CrashAction, error) {
+	switch action := CrashAction(s); action {
+	case CrashHang, CrashReboot:
+		return action, nil
+	default:
+		return "", fmt.Errorf("invalid crash action %q; must be %q or %q", s, CrashHang, CrashReboot)
+	}
+}
+
+// CrashRecovery records crashes and then hangs or reboots according to its
+// policy. It's used by PanicHandler once the panic actions are done.
+type CrashRecovery struct {
+	Policy  CrashPolicy
+	Flavor  string
+	Console *Console
+
+	// Log holds the recent log lines to include in the crash file.
+	Log *LogRing
+}
+
+// crashRecord is the structured summary of a crash that we log, so that
+// whatever collects the serial log can pick crashes out of it.
+type crashRecord struct {
+	Time        time.Time   `json:"time"`
+	Flavor      string      `json:"flavor"`
+	Error       string      `json:"error"`
+	CrashFile   string      `json:"crash_file,omitempty"`
+	Consecutive int         `json:"consecutive"`
+	Action      CrashAction `json:"action"`
+}
+
+// Recover records the given crash and then either reboots, in which case
+// it doesn't return, or returns so that the caller can hang.
+func (r *CrashRecovery) Recover(err error, stack string) {
+	now := time.Now().UTC()
+	record := crashRecord{
+		Time:   now,
+		Flavor: r.Flavor,
+		Error:  err.Error(),
+		Action: r.Policy.Action,
+	}
+
+	consecutive, countErr := r.incrementCount()
+	if countErr != nil {
+		log.Printf("[ERROR] Failed to update crash count: %s", countErr)
+	}
+	record.Consecutive = consecutive
+
+	crashFile, writeErr := r.writeCrashFile(now, err, stack)
+	if writeErr != nil {
+		log.Printf("[ERROR] Failed to write crash file: %s", writeErr)
+	}
+	record.CrashFile = crashFile
+
+	if record.Action == CrashReboot && countErr != nil {
+		// Without a count we can't tell if we're in a crash loop, so
+		// it's not safe to reboot.
+		log.Printf("[ALERT] Not rebooting, since crash loops can't be detected")
+		record.Action = CrashHang
+	}
+	if record.Action == CrashReboot && consecutive > r.Policy.MaxConsecutive {
+		log.Printf("[ALERT] %d consecutive crashes; not rebooting again", consecutive)
+		record.Action = CrashHang
+	}
+
+	recordJSON, _ := json.Marshal(record)
+	log.Printf("[CRASH] %s", recordJSON)
+
+	if record.Action != CrashReboot {
+		if r.Console != nil {
+			r.Console.SetFatalErrorNote("System halted.")
+		}
+		return
+	}
+
+	for remain := r.Policy.RebootDelay; remain > 0; remain -= time.Second {
+		if r.Console != nil {
+			r.Console.SetFatalErrorNote(fmt.Sprintf("Rebooting in %d seconds...", remain/time.Second))
+		}
+		time.Sleep(time.Second)
+	}
+
+	log.Printf("Rebooting after crash")
+	if r.Console != nil {
+		r.Console.SetFatalErrorNote("Rebooting...")
+	}
+	syscall.Sync()
+	rebootErr := syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
+
+	// If we get here then the reboot failed, so all we can do is hang.
+	log.Printf("[ALERT] Failed to reboot: %s", rebootErr)
+	if r.Console != nil {
+		r.Console.SetFatalErrorNote("Reboot failed; system halted.")
+	}
+}
+
+// ResetCount records that the system has been stable since boot, so that
+// any earlier crashes no longer count as consecutive with future ones.
+func (r *CrashRecovery) ResetCount() error {
+	err := os.Remove(r.countPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *CrashRecovery) countPath() string {
+	return filepath.Join(r.Policy.Dir, "consecutive")
+}
+
+// incrementCount adds one to the consecutive crash count and returns the
+// new count. If the count can't be read it's assumed to have been zero,
+// but the count must be written successfully.
+func (r *CrashRecovery) incrementCount() (int, error) {
+	count := 0
+	data, err := ioutil.ReadFile(r.countPath())
+	if err == nil {
+		count, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	count++
+
+	err = os.MkdirAll(r.Policy.Dir, 0755)
+	if err != nil {
+		return count, err
+	}
+	err = ioutil.WriteFile(r.countPath(), []byte(fmt.Sprintf("%d\n", count)), 0644)
+	if err != nil {
+		return count, err
+	}
+	syscall.Sync()
+	return count, nil
+}
+
+// writeCrashFile writes the details of a crash to a new file in the
+// crash directory, returning its path, and prunes old crash files.
+func (r *CrashRecovery) writeCrashFile(now time.Time, crashErr error, stack string) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "defgrid-init crashed at %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "Flavor: %s\n", r.Flavor)
+	fmt.Fprintf(&buf, "Error: %s\n", crashErr)
+	fmt.Fprintf(&buf, "\nStack:\n%s\n", stack)
+	if r.Log != nil {
+		fmt.Fprintf(&buf, "\nRecent log:\n")
+		for _, line := range r.Log.Lines() {
+			fmt.Fprintf(&buf, "%s\n", line)
+		}
+	}
+
+	err := os.MkdirAll(r.Policy.Dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(r.Policy.Dir, fmt.Sprintf("crash-%s.txt", now.Format("20060102T150405.000Z")))
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	r.pruneCrashFiles()
+	return path, nil
+}
+
+// pruneCrashFiles removes all but the newest crashFilesKept crash files.
+// The timestamps in the names mean they sort oldest first.
+func (r *CrashRecovery) pruneCrashFiles() {
+	paths, err := filepath.Glob(filepath.Join(r.Policy.Dir, "crash-*.txt"))
+	if err != nil || len(paths) <= crashFilesKept {
+		return
+	}
+	sort.Strings(paths)
+	for _, path := range paths[:len(paths)-crashFilesKept] {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog returns the log output written while running fn.
+func captureLog(t *testing.T, fn func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	fn()
+	return buf.String()
+}
+
+func TestCrashRecoveryHangsAfterMaxConsecutive(t *testing.T) {
+	dir := t.TempDir()
+	r := &CrashRecovery{
+		Policy: CrashPolicy{
+			Action:         CrashReboot,
+			RebootDelay:    time.Hour,
+			MaxConsecutive: 2,
+			Dir:            dir,
+		},
+		Flavor: "test",
+		Log:    NewLogRing(10),
+	}
+
+	// Two crashes already, so this one is one too many and Recover must
+	// return rather than reboot.
+	err := ioutil.WriteFile(filepath.Join(dir, "consecutive"), []byte("2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := captureLog(t, func() {
+		r.Recover(errors.New("boom"), "stack")
+	})
+
+	for _, want := range []string{
+		"3 consecutive crashes; not rebooting again",
+		`"consecutive":3`,
+		`"action":"hang"`,
+		`"error":"boom"`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("log lacks %q\n%s", want, output)
+		}
+	}
+
+	count, err := ioutil.ReadFile(filepath.Join(dir, "consecutive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(count), "3\n"; got != want {
+		t.Errorf("wrong count %q; want %q", got, want)
+	}
+
+	crashFiles, _ := filepath.Glob(filepath.Join(dir, "crash-*.txt"))
+	if len(crashFiles) != 1 {
+		t.Fatalf("wrote %d crash files; want 1", len(crashFiles))
+	}
+	data, err := ioutil.ReadFile(crashFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Error: boom") {
+		t.Errorf("crash file lacks the error\n%s", data)
+	}
+}
+
+func TestCrashRecoveryHangPolicy(t *testing.T) {
+	r := &CrashRecovery{
+		Policy: CrashPolicy{
+			Action:         CrashHang,
+			MaxConsecutive: 3,
+			Dir:            t.TempDir(),
+		},
+	}
+	output := captureLog(t, func() {
+		r.Recover(errors.New("boom"), "stack")
+	})
+	if !strings.Contains(output, `"consecutive":1`) || !strings.Contains(output, `"action":"hang"`) {
+		t.Errorf("wrong crash record\n%s", output)
+	}
+}
+
+func TestCrashRecoveryResetCount(t *testing.T) {
+	r := &CrashRecovery{Policy: CrashPolicy{Dir: t.TempDir()}}
+
+	// Nothing to reset yet.
+	if err := r.ResetCount(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for want := 1; want <= 2; want++ {
+		got, err := r.incrementCount()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != want {
+			t.Errorf("wrong count %d; want %d", got, want)
+		}
+	}
+
+	if err := r.ResetCount(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got, err := r.incrementCount()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != 1 {
+		t.Errorf("wrong count %d after reset; want 1", got)
+	}
+}
+
+func TestFlavorCrashPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		def     FlavorDefinition
+		want    CrashPolicy
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: CrashPolicy{
+				Action:         CrashHang,
+				RebootDelay:    crashDefaultRebootDelay,
+				MaxConsecutive: crashDefaultMaxConsecutive,
+				Dir:            crashDefaultDir,
+			},
+		},
+		{
+			name: "configured",
+			def: FlavorDefinition{
+				CrashAction:         CrashReboot,
+				CrashDir:            "/data/crash",
+				CrashMaxConsecutive: 5,
+				CrashRebootDelay:    10,
+			},
+			want: CrashPolicy{
+				Action:         CrashReboot,
+				RebootDelay:    10 * time.Second,
+				MaxConsecutive: 5,
+				Dir:            "/data/crash",
+			},
+		},
+		{
+			name:    "bad action",
+			def:     FlavorDefinition{CrashAction: "explode"},
+			wantErr: true,
+		},
+		{
+			name:    "negative",
+			def:     FlavorDefinition{CrashMaxConsecutive: -1},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.def.crashPolicy()
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("wrong policy %+v; want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLogRing(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{
+			name: "empty",
+			want: []string{},
+		},
+		{
+			name:   "not full",
+			writes: []string{"a\nb\n"},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "exactly full",
+			writes: []string{"a\nb\nc\n"},
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "wrapped",
+			writes: []string{"a\nb\nc\n", "d\ne\n"},
+			want:   []string{"c", "d", "e"},
+		},
+		{
+			name:   "wrapped many times",
+			writes: []string{"1\n2\n3\n4\n5\n6\n7\n8\n"},
+			want:   []string{"6", "7", "8"},
+		},
+		{
+			name:   "split lines",
+			writes: []string{"hel", "lo\nwor", "ld\nunfinished"},
+			want:   []string{"hello", "world"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewLogRing(3)
+			for _, w := range test.writes {
+				n, err := r.Write([]byte(w))
+				if err != nil || n != len(w) {
+					t.Fatalf("Write returned %d, %v", n, err)
+				}
+			}
+			got := r.Lines()
+			if got == nil {
+				got = []string{}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"syscall"
 
 	"github.com/d2g/dhcp4"
 	"github.com/d2g/dhcp4client"
+	"github.com/defgrid/defgrid-init/dhcpmsg"
+	"github.com/docker/libcontainer/netlink"
 	"github.com/milosgajdos83/tenus"
 )
 
@@ -13,6 +17,57 @@ type Client struct {
 	iface     *net.Interface
 	ctrl      tenus.Linker
 	rawClient *dhcp4client.Client
+	options   []dhcp4.Option
+
+	requestedIP    net.IP
+	noDefaultRoute bool
+}
+
+// ClientOptions describes the identifying information that a Client
+// includes in each of its requests, in addition to the interface's
+// hardware address.
+type ClientOptions struct {
+	// ClientID, if set, is sent verbatim as the client identifier option
+	// (61), and so must already include the leading type octet.
+	ClientID []byte
+
+	// Hostname, if set, is sent as the host name option (12).
+	Hostname string
+
+	// VendorClass, if set, is sent as the vendor class identifier
+	// option (60).
+	VendorClass string
+
+	// ParameterRequestList is the list of option codes we ask the server
+	// to include in its responses, sent as option 55. If this is empty,
+	// DefaultParameterRequestList is used.
+	ParameterRequestList []byte
+
+	// RequestedIP, if set, is sent as the requested IP address option (50)
+	// when discovering a new lease, asking the server to give us back an
+	// address we held previously.
+	RequestedIP net.IP
+
+	// NoDefaultRoute, if set, stops ConfigureInterface from installing a
+	// default route via the lease's router, for interfaces other than
+	// the one that should carry the node's default route.
+	NoDefaultRoute bool
+}
+
+// DefaultParameterRequestList is the set of options that newLease knows
+// how to interpret.
+var DefaultParameterRequestList = []byte{
+	1,   // subnet mask
+	3,   // router
+	6,   // domain name servers
+	12,  // host name
+	15,  // domain name
+	26,  // interface MTU
+	28,  // broadcast address
+	42,  // NTP servers
+	51,  // lease time
+	119, // domain search list
+	121, // classless static routes
 }
 
 // NewClient returns a new client ready to control the named interface.
@@ -22,7 +77,7 @@ type Client struct {
 // to get a lease, these errors are likely to be fatal and so this operation
 // is not worth retrying without e.g. a change to system configuration or
 // user permissions.
-func NewClient(interfaceName string) (*Client, error) {
+func NewClient(interfaceName string, opts *ClientOptions) (*Client, error) {
 	iface, err := net.InterfaceByName(interfaceName)
 	if err != nil {
 		return nil, err
@@ -36,14 +91,15 @@ func NewClient(interfaceName string) (*Client, error) {
 	// We need to bring the interface up if it isn't already, so we can
 	// create a raw packet socket for it.
 	//
-	// In the unlikely event that it's already up we'll bring it down
-	// first. We don't care about any errors here because we expect this
-	// to fail in the normal case.
-	ctrl.SetLinkDown()
-
-	err = ctrl.SetLinkUp()
-	if err != nil {
-		return nil, err
+	// If it's already up then we're probably a restarted instance of the
+	// client, and so we'll leave it alone to avoid disturbing the address
+	// and routes that our predecessor configured; bringing the link down
+	// would cause the kernel to discard the routes.
+	if iface.Flags&net.FlagUp == 0 {
+		err = ctrl.SetLinkUp()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	conn, err := dhcp4client.NewPacketSock(iface.Index)
@@ -65,9 +121,49 @@ func NewClient(interfaceName string) (*Client, error) {
 		iface:     iface,
 		ctrl:      ctrl,
 		rawClient: rawClient,
+		options:   opts.dhcpOptions(),
+
+		requestedIP:    opts.RequestedIP,
+		noDefaultRoute: opts.NoDefaultRoute,
 	}, nil
 }
 
+func (o *ClientOptions) dhcpOptions() []dhcp4.Option {
+	var options []dhcp4.Option
+
+	if len(o.ClientID) != 0 {
+		options = append(options, dhcp4.Option{
+			Code:  dhcp4.OptionClientIdentifier,
+			Value: o.ClientID,
+		})
+	}
+
+	if o.Hostname != "" {
+		options = append(options, dhcp4.Option{
+			Code:  dhcp4.OptionHostName,
+			Value: []byte(o.Hostname),
+		})
+	}
+
+	if o.VendorClass != "" {
+		options = append(options, dhcp4.Option{
+			Code:  dhcp4.OptionVendorClassIdentifier,
+			Value: []byte(o.VendorClass),
+		})
+	}
+
+	paramList := o.ParameterRequestList
+	if len(paramList) == 0 {
+		paramList = DefaultParameterRequestList
+	}
+	options = append(options, dhcp4.Option{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: paramList,
+	})
+
+	return options
+}
+
 // Request sends a request to the DHCP server for a lease. If oldLease is
 // not nil, it is treated as an earlier lease that the caller wishes to
 // renew. Otherwise, an entirely new lease is requested.
@@ -80,9 +176,9 @@ func (c *Client) Request(oldLease *Lease) (*Lease, error) {
 	var err error
 
 	if oldLease == nil {
-		success, ackPacket, err = c.rawClient.Request()
+		success, ackPacket, err = c.request()
 	} else {
-		success, ackPacket, err = c.rawClient.Renew(oldLease.rawPacket)
+		success, ackPacket, err = c.renew(oldLease.rawPacket)
 	}
 
 	if err != nil {
@@ -96,24 +192,234 @@ func (c *Client) Request(oldLease *Lease) (*Lease, error) {
 	return newLease(ackPacket)
 }
 
-func (c *Client) ConfigureInterface(lease *Lease) error {
+// request is equivalent to dhcp4client's Client.Request, except that it
+// includes our additional options in the discover and request packets.
+func (c *Client) request() (bool, dhcp4.Packet, error) {
+	discoverPacket := c.rawClient.DiscoverPacket()
+	if c.requestedIP != nil {
+		discoverPacket.AddOption(dhcp4.OptionRequestedIPAddress, c.requestedIP.To4())
+	}
+	c.addOptions(&discoverPacket)
+	err := c.rawClient.SendPacket(discoverPacket)
+	if err != nil {
+		return false, discoverPacket, err
+	}
+
+	offerPacket, err := c.rawClient.GetOffer(&discoverPacket)
+	if err != nil {
+		return false, offerPacket, err
+	}
+
+	requestPacket := c.rawClient.RequestPacket(&offerPacket)
+	c.addOptions(&requestPacket)
+	err = c.rawClient.SendPacket(requestPacket)
+	if err != nil {
+		return false, requestPacket, err
+	}
+
+	ackPacket, err := c.rawClient.GetAcknowledgement(&requestPacket)
+	if err != nil {
+		return false, ackPacket, err
+	}
+
+	return isACK(ackPacket), ackPacket, nil
+}
+
+// renew is equivalent to dhcp4client's Client.Renew, except that it
+// includes our additional options in the request packet.
+func (c *Client) renew(oldAckPacket dhcp4.Packet) (bool, dhcp4.Packet, error) {
+	requestPacket := c.rawClient.RenewalRequestPacket(&oldAckPacket)
+	c.addOptions(&requestPacket)
+	err := c.rawClient.SendPacket(requestPacket)
+	if err != nil {
+		return false, requestPacket, err
+	}
+
+	ackPacket, err := c.rawClient.GetAcknowledgement(&requestPacket)
+	if err != nil {
+		return false, ackPacket, err
+	}
+
+	return isACK(ackPacket), ackPacket, nil
+}
+
+func (c *Client) addOptions(packet *dhcp4.Packet) {
+	for _, option := range c.options {
+		packet.AddOption(option.Code, option.Value)
+	}
+	packet.PadToMinSize()
+}
+
+func isACK(packet dhcp4.Packet) bool {
+	msgType := packet.ParseOptions()[dhcp4.OptionDHCPMessageType]
+	return len(msgType) == 1 && dhcp4.MessageType(msgType[0]) == dhcp4.ACK
+}
+
+// ConfigureInterface applies the given lease to the interface, setting its
+// MTU, IP address, subnet and broadcast address, default gateway and any
+// static routes. If
+// oldLease is not nil, it is the lease that was applied before, and any of
+// its routes that newLease no longer includes are removed. The default
+// gateway is left alone if the client was created with NoDefaultRoute.
+func (c *Client) ConfigureInterface(lease *Lease, oldLease *Lease) error {
+	if lease.MTU != 0 {
+		err := c.ctrl.SetLinkMTU(lease.MTU)
+		if err != nil {
+			return fmt.Errorf("failed to set MTU %d: %s", lease.MTU, err)
+		}
+	}
+
 	network := &net.IPNet{
 		IP:   lease.IPAddress,
 		Mask: lease.SubnetMask,
 	}
-	err := c.ctrl.SetLinkIp(lease.IPAddress, network)
+	err := replaceAddress(c.iface, network, lease.BroadcastAddress)
 	if err != nil {
 		return err
 	}
 
+	// Static routes go in before the default gateway, since with classless
+	// static routes the gateway itself may only be reachable via one of
+	// them.
+	for _, route := range lease.StaticRoutes {
+		err := c.addRoute(&route)
+		if err != nil {
+			prefixLen, _ := route.Mask.Size()
+			return fmt.Errorf(
+				"set IP address but failed to add route to %s/%d: %s",
+				route.Destination, prefixLen, err,
+			)
+		}
+	}
+
+	if !c.noDefaultRoute {
+		err := c.configureDefaultGateway(lease, oldLease)
+		if err != nil {
+			return err
+		}
+	}
+
+	if oldLease != nil {
+		for _, route := range staleRoutes(oldLease.StaticRoutes, lease.StaticRoutes) {
+			dest := &net.IPNet{IP: route.Destination, Mask: route.Mask}
+			err := deleteRoute(c.iface, dest, route.Gateway)
+			if err != nil {
+				return fmt.Errorf("failed to remove old route to %s: %s", dest, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configureDefaultGateway installs the default route via the lease's
+// first router, replacing any via the old lease's router.
+func (c *Client) configureDefaultGateway(lease *Lease, oldLease *Lease) error {
+	// The kernel won't replace an existing default route, so one via a
+	// gateway that the new lease no longer gives us must go first.
+	if oldLease != nil && len(oldLease.Routers) > 0 {
+		oldGateway := oldLease.Routers[0]
+		if len(lease.Routers) == 0 || !lease.Routers[0].Equal(oldGateway) {
+			err := deleteRoute(c.iface, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, oldGateway)
+			if err != nil {
+				return fmt.Errorf("failed to remove old default gateway %s: %s", oldGateway, err)
+			}
+		}
+	}
+
 	if len(lease.Routers) > 0 {
 		err := c.ctrl.SetLinkDefaultGw(&lease.Routers[0])
-		if err != nil {
+		if err != nil && err != syscall.EEXIST {
 			return fmt.Errorf(
 				"set IP address but failed to configure default gateway: %s", err,
 			)
 		}
 	}
+	return nil
+}
+
+// staleRoutes returns the routes in old that aren't in new.
+func staleRoutes(old, new []dhcpmsg.Route) []dhcpmsg.Route {
+	var stale []dhcpmsg.Route
+	for _, oldRoute := range old {
+		found := false
+		for _, newRoute := range new {
+			if routesEqual(oldRoute, newRoute) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, oldRoute)
+		}
+	}
+	return stale
+}
+
+func routesEqual(a, b dhcpmsg.Route) bool {
+	return a.Destination.Equal(b.Destination) &&
+		bytes.Equal(a.Mask, b.Mask) &&
+		a.Gateway.Equal(b.Gateway)
+}
+
+func (c *Client) addRoute(route *dhcpmsg.Route) error {
+	prefixLen, _ := route.Mask.Size()
+	dest := fmt.Sprintf("%s/%d", route.Destination, prefixLen)
+
+	gateway := ""
+	if route.Gateway != nil && !route.Gateway.IsUnspecified() {
+		gateway = route.Gateway.String()
+	}
+
+	err := netlink.AddRoute(dest, "", gateway, c.iface.Name)
+	if err == syscall.EEXIST {
+		// Route is already present from an earlier lease, which is fine.
+		return nil
+	}
+	return err
+}
+
+// Release tells the DHCP server that we no longer need the given lease and
+// then removes it from the interface.
+func (c *Client) Release(lease *Lease) error {
+	releasePacket := c.rawClient.ReleasePacket(&lease.rawPacket)
+	c.addOptions(&releasePacket)
+	err := c.rawClient.SendPacket(releasePacket)
+	if err != nil {
+		return err
+	}
+
+	return c.DeconfigureInterface(lease)
+}
+
+// DeconfigureInterface removes the given lease's address from the
+// interface, along with the routes that ConfigureInterface added for it,
+// once we may no longer use it.
+func (c *Client) DeconfigureInterface(lease *Lease) error {
+	if !c.noDefaultRoute && len(lease.Routers) > 0 {
+		gateway := lease.Routers[0]
+		err := deleteRoute(c.iface, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, gateway)
+		if err != nil {
+			return fmt.Errorf("failed to remove default gateway %s: %s", gateway, err)
+		}
+	}
+
+	for _, route := range lease.StaticRoutes {
+		dest := &net.IPNet{IP: route.Destination, Mask: route.Mask}
+		err := deleteRoute(c.iface, dest, route.Gateway)
+		if err != nil {
+			return fmt.Errorf("failed to remove route to %s: %s", dest, err)
+		}
+	}
 
+	network := &net.IPNet{
+		IP:   lease.IPAddress,
+		Mask: lease.SubnetMask,
+	}
+	err := c.ctrl.UnsetLinkIp(lease.IPAddress, network)
+	if err != nil && err != syscall.EADDRNOTAVAIL {
+		// EADDRNOTAVAIL means that the address is already gone.
+		return fmt.Errorf("failed to remove address %s: %s", network, err)
+	}
 	return nil
 }
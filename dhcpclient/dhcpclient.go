@@ -3,82 +3,311 @@
 // It is launched as a child process of defgrid-init because the main
 // init process is not permitted to interact directly with the network.
 //
-// It is not designed to be run as a standalone tool. It produces on
-// its stdout a msgpack-encoded datastructure describing the network
-// settings, and then stays running to renew the lease. If configuration
-// changes when the lease is renewed, further data structures are produced
-// on its stdout, so the caller should repeatedly execute blocking reads
-// to efficiently watch for changes.
+// It is not designed to be run as a standalone tool. It speaks the protocol
+// defined in the dhcpmsg package: it produces on its stdout a stream of
+// msgpack-encoded messages, starting with a version announcement and then
+// reporting leases, state changes and errors, and it accepts commands on
+// its stdin. It stays running to renew the lease, producing a further lease
+// message each time it does so, so the caller should repeatedly execute
+// blocking reads to efficiently watch for changes.
 //
-// It is guaranteed that by the time a configuration message is produced
+// It is guaranteed that by the time a lease message is produced
 // on stdout the configuration has already been applied to the local
-// network interfaces. This client *only* handles the interface IP address,
-// subnet mask and default gateway. It is the caller's responsibility
-// to arrange for the system resolver to be configured for the returned
-// DNS server settings. The hostname and domain name provided by the DHCP
-// server are also returned, though in most cases defgrid-init will ignore
-// these and instead use a platform-specific instance id as the hostname
-// and the "node.<region>.consul" domain as the domain.
+// network interfaces. This client *only* handles the interface MTU, IP
+// address, subnet mask, default gateway and any classless static routes.
+// It is the caller's responsibility to arrange for the system resolver to
+// be configured for the returned DNS server and search domain settings,
+// and for any time synchronization to use the returned NTP servers. The
+// hostname and domain name provided by the DHCP server are also returned,
+// though in most cases defgrid-init will ignore these and instead use a
+// platform-specific instance id as the hostname and the
+// "node.<region>.consul" domain as the domain.
 package main
 
 import (
+	"encoding/hex"
+	"flag"
 	"fmt"
-	"gopkg.in/vmihailenco/msgpack.v2"
+	"io"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/defgrid/defgrid-init/dhcpmsg"
 )
 
 func main() {
 
-	if len(os.Args) != 2 {
-		log.Println("usage: dhcpclient <interface-name>")
+	clientIDArg := flag.String("client-id", "", "client identifier to send, as a string or as hex:<octets>")
+	hostnameArg := flag.String("hostname", "", "host name to send")
+	vendorClassArg := flag.String("vendor-class", "defgrid", "vendor class identifier to send")
+	requestListArg := flag.String("request-options", "", "comma-separated option codes to request")
+	requestIPArg := flag.String("request-ip", "", "address to request, e.g. from an earlier lease")
+	ipv6Arg := flag.String("ipv6", "off", "IPv6 configuration mode: off, slaac or dhcpv6")
+	ipv4Arg := flag.Bool("ipv4", true, "obtain an IPv4 lease; set to false for IPv6-only links")
+	noDefaultRouteArg := flag.Bool("no-default-route", false, "don't install a default route, for secondary interfaces")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Println("usage: dhcpclient [options] <interface-name>")
 		os.Exit(1)
 	}
 
+	msgs := dhcpmsg.NewEncoder(os.Stdout)
+
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("[ERROR] %s", r)
+			msgs.WriteMessage(dhcpmsg.NewErrorMessage(fmt.Errorf("%s", r), true))
 			os.Exit(2)
 		} else {
 			os.Exit(0)
 		}
 	}()
 
-	ifaceName := os.Args[1]
+	ifaceName := flag.Arg(0)
+
+	err := msgs.WriteMessage(dhcpmsg.NewHelloMessage(ifaceName))
+	if err != nil {
+		panic(fmt.Errorf("failed to write hello message: %s", err))
+	}
+
+	clientID, err := parseClientID(*clientIDArg)
+	if err != nil {
+		panic(fmt.Errorf("invalid -client-id: %s", err))
+	}
 
-	client, err := NewClient(ifaceName)
+	requestList, err := parseParameterRequestList(*requestListArg)
+	if err != nil {
+		panic(fmt.Errorf("invalid -request-options: %s", err))
+	}
+
+	var requestIP net.IP
+	if *requestIPArg != "" {
+		requestIP = net.ParseIP(*requestIPArg).To4()
+		if requestIP == nil {
+			panic(fmt.Errorf("invalid -request-ip: %q is not an IPv4 address", *requestIPArg))
+		}
+	}
+
+	ipv6, err := parseIPv6Mode(*ipv6Arg)
+	if err != nil {
+		panic(fmt.Errorf("invalid -ipv6: %s", err))
+	}
+	if !*ipv4Arg && ipv6 == ipv6Off {
+		panic(fmt.Errorf("-ipv4=false requires an -ipv6 mode"))
+	}
+
+	client, err := NewClient(ifaceName, &ClientOptions{
+		ClientID:             clientID,
+		Hostname:             *hostnameArg,
+		VendorClass:          *vendorClassArg,
+		ParameterRequestList: requestList,
+		RequestedIP:          requestIP,
+		NoDefaultRoute:       *noDefaultRouteArg,
+	})
 	if err != nil {
 		panic(fmt.Errorf("can't open interface %s: %s", ifaceName, err))
 	}
 
+	send := func(msg *dhcpmsg.Message) {
+		err := msgs.WriteMessage(msg)
+		if err != nil {
+			// should never happen
+			log.Printf("[WARN] Failed to encode %s message: %s", msg.Type, err)
+		}
+	}
+
+	commands := make(chan dhcpmsg.CommandType)
+	go readCommands(os.Stdin, commands)
+
+	go runIPv6(ipv6, ifaceName, !*noDefaultRouteArg, send)
+
+	if !*ipv4Arg {
+		runIPv6Only(send, commands)
+		return
+	}
+	run(client, ifaceName, send, commands)
+}
+
+// runIPv6Only is the main loop of the client when it isn't obtaining an
+// IPv4 lease, leaving runIPv6 to do the work while it waits to be told
+// to stop.
+func runIPv6Only(send func(*dhcpmsg.Message), commands <-chan dhcpmsg.CommandType) {
+	for cmd := range commands {
+		switch cmd {
+		case dhcpmsg.CommandStop:
+			send(dhcpmsg.NewStateMessage(dhcpmsg.StateStopped))
+			return
+		default:
+			log.Printf("[WARN] Ignoring %q command since there is no IPv4 lease", cmd)
+		}
+	}
+}
+
+// run is the main loop of the client, which obtains and renews leases and
+// responds to commands from the parent until told to stop.
+func run(client *Client, ifaceName string, send func(*dhcpmsg.Message), commands <-chan dhcpmsg.CommandType) {
 	var lease *Lease
-	leaseEncoder := msgpack.NewEncoder(os.Stdout)
+	var leaseExpiry time.Time
+	released := false
+	wait := time.Duration(0)
 
 	for {
-		lease, err := client.Request(lease)
+		// If we've released our lease then we'll wait indefinitely for
+		// the parent to ask us to renew.
+		var timeout <-chan time.Time
+		if !released {
+			timeout = time.After(wait)
+		}
+
+		select {
+		case cmd := <-commands:
+			switch cmd {
+			case dhcpmsg.CommandRenew:
+				released = false
+			case dhcpmsg.CommandRelease:
+				if lease != nil {
+					err := client.Release(lease)
+					if err != nil {
+						log.Printf("[ERROR] Failed to release lease: %s", err)
+						send(dhcpmsg.NewErrorMessage(err, false))
+					}
+					lease = nil
+				}
+				released = true
+				send(dhcpmsg.NewStateMessage(dhcpmsg.StateReleased))
+				continue
+			case dhcpmsg.CommandStop:
+				send(dhcpmsg.NewStateMessage(dhcpmsg.StateStopped))
+				return
+			default:
+				log.Printf("[WARN] Ignoring unsupported command %q", cmd)
+				continue
+			}
+		case <-timeout:
+		}
+
+		if lease != nil && !time.Now().Before(leaseExpiry) {
+			log.Printf("[ERROR] Lease for %s has expired", lease.IPAddress)
+			err := client.DeconfigureInterface(lease)
+			if err != nil {
+				log.Printf("[ERROR] Failed to remove expired lease: %s", err)
+				send(dhcpmsg.NewErrorMessage(err, false))
+			}
+			send(dhcpmsg.NewStateMessage(dhcpmsg.StateExpired))
+			lease = nil
+		}
+
+		if lease == nil {
+			send(dhcpmsg.NewStateMessage(dhcpmsg.StateRequesting))
+		} else {
+			send(dhcpmsg.NewStateMessage(dhcpmsg.StateRenewing))
+		}
+
+		newLease, err := client.Request(lease)
 		if err != nil {
 			log.Printf("[ERROR] DHCP request failed: %s", err)
+			send(dhcpmsg.NewErrorMessage(fmt.Errorf("DHCP request failed: %s", err), false))
+
+			// Once we're past 7/8 of the lease time (the usual rebinding
+			// point) we'll start warning the parent that the address is
+			// about to go away.
+			if lease != nil {
+				remaining := leaseExpiry.Sub(time.Now())
+				if remaining < lease.Duration/8 {
+					send(dhcpmsg.NewExpiryWarningMessage(remaining))
+				}
+			}
+
 			// Don't make the DHCP server sweat
-			time.Sleep(10)
+			wait = 10 * time.Second
 			continue
 		}
 
-		err = client.ConfigureInterface(lease)
+		err = client.ConfigureInterface(newLease, lease)
 		if err != nil {
 			log.Printf("[ERROR] %s configuration failed: %s", ifaceName, err)
+			send(dhcpmsg.NewErrorMessage(
+				fmt.Errorf("%s configuration failed: %s", ifaceName, err), false,
+			))
 			// This one's our problem, so retrying probably isn't going to
 			// help. But rather than crash we will just retry occasionally.
-			time.Sleep(60)
+			wait = 60 * time.Second
 			continue
 		}
 
-		err = leaseEncoder.Encode(lease)
+		lease = newLease
+		leaseExpiry = time.Now().Add(lease.Duration)
+		send(dhcpmsg.NewLeaseMessage(&lease.Lease))
+		send(dhcpmsg.NewStateMessage(dhcpmsg.StateBound))
+
+		// We'll try to renew once half of the lease time has elapsed,
+		// as recommended by RFC 2131.
+		wait = lease.Duration / 2
+	}
+}
+
+// readCommands decodes commands from the given reader and delivers them
+// to the given channel. When the reader is exhausted, which normally means
+// that the parent process has gone away, it delivers a stop command.
+func readCommands(r io.Reader, commands chan<- dhcpmsg.CommandType) {
+	dec := dhcpmsg.NewDecoder(r)
+	for {
+		cmd, err := dec.ReadCommand()
 		if err != nil {
-			// should never happen
-			log.Printf("[WARN] Failed to encode lease for announcement: %s", err)
+			if err != io.EOF {
+				log.Printf("[ERROR] Failed to read command: %s", err)
+			}
+			commands <- dhcpmsg.CommandStop
+			return
 		}
+		commands <- cmd.Type
+	}
+}
+
+// parseClientID interprets the -client-id argument.
+//
+// A value with the prefix "hex:" is decoded and used verbatim, which allows
+// the caller to send e.g. an RFC 4361 DUID-based identifier complete with
+// its type octet. Any other non-empty value is sent as an opaque string
+// with the type octet zero, as recommended for identifiers that are not
+// hardware addresses.
+func parseClientID(arg string) ([]byte, error) {
+	if arg == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(arg, "hex:") {
+		id, err := hex.DecodeString(arg[4:])
+		if err != nil {
+			return nil, err
+		}
+		if len(id) < 2 {
+			return nil, fmt.Errorf("must have at least two octets")
+		}
+		return id, nil
+	}
+
+	return append([]byte{0}, arg...), nil
+}
 
-		time.Sleep(lease.Duration)
+// parseParameterRequestList interprets the -request-options argument.
+func parseParameterRequestList(arg string) ([]byte, error) {
+	if arg == "" {
+		return nil, nil
+	}
+
+	var codes []byte
+	for _, codeStr := range strings.Split(arg, ",") {
+		code, err := strconv.ParseUint(strings.TrimSpace(codeStr), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid option code %q", codeStr)
+		}
+		codes = append(codes, byte(code))
 	}
+	return codes, nil
 }
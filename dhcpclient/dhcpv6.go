@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/defgrid/defgrid-init/dhcpmsg"
+	"github.com/docker/libcontainer/netlink"
+)
+
+// This is a minimal DHCPv6 client as described in RFC 3315, supporting
+// only what we need: obtaining and renewing non-temporary addresses and
+// the DNS configuration options from RFC 3646.
+
+const (
+	dhcp6MsgSolicit   = 1
+	dhcp6MsgAdvertise = 2
+	dhcp6MsgRequest   = 3
+	dhcp6MsgRenew     = 5
+	dhcp6MsgReply     = 7
+)
+
+const (
+	dhcp6OptClientID    = 1
+	dhcp6OptServerID    = 2
+	dhcp6OptIANA        = 3
+	dhcp6OptIAAddr      = 5
+	dhcp6OptORO         = 6
+	dhcp6OptElapsedTime = 8
+	dhcp6OptStatusCode  = 13
+	dhcp6OptDNSServers  = 23
+	dhcp6OptDomainList  = 24
+)
+
+var dhcp6ServersAddr = &net.UDPAddr{
+	IP:   net.ParseIP("ff02::1:2"),
+	Port: 547,
+}
+
+type dhcp6Client struct {
+	iface *net.Interface
+	conn  *net.UDPConn
+	duid  []byte
+	iaid  uint32
+}
+
+type dhcp6Lease struct {
+	serverID      []byte
+	t1            time.Duration
+	addresses     []dhcpmsg.Address6
+	nameServers   []net.IP
+	searchDomains []string
+}
+
+type dhcp6Option struct {
+	code uint16
+	data []byte
+}
+
+func newDHCP6Client(ifaceName string) (*dhcp6Client, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// We must send from our link-local address, which won't be usable
+	// until the kernel has finished duplicate address detection.
+	var localIP net.IP
+	for i := 0; i < 10 && localIP == nil; i++ {
+		localIP, err = linkLocalIPv6Address(ifaceName)
+		if err != nil {
+			return nil, err
+		}
+		if localIP == nil {
+			time.Sleep(time.Second)
+		}
+	}
+	if localIP == nil {
+		return nil, fmt.Errorf("%s has no IPv6 link-local address", ifaceName)
+	}
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{
+		IP:   localIP,
+		Port: 546,
+		Zone: ifaceName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// DUID-LL (type 3), based on the ethernet (type 1) hardware address.
+	duid := append([]byte{0, 3, 0, 1}, iface.HardwareAddr...)
+
+	// The identity association only needs to be unique for this client,
+	// and we only ever have one.
+	iaid := uint32(iface.Index)
+
+	return &dhcp6Client{
+		iface: iface,
+		conn:  conn,
+		duid:  duid,
+		iaid:  iaid,
+	}, nil
+}
+
+// request obtains a new lease, or renews oldLease if it is not nil.
+func (c *dhcp6Client) request(oldLease *dhcp6Lease) (*dhcp6Lease, error) {
+	if oldLease != nil {
+		reply, err := c.exchange(dhcp6MsgRenew, c.requestOptions(oldLease), dhcp6MsgReply)
+		if err != nil {
+			return nil, err
+		}
+		return parseDHCP6Lease(reply)
+	}
+
+	advertise, err := c.exchange(dhcp6MsgSolicit, c.requestOptions(nil), dhcp6MsgAdvertise)
+	if err != nil {
+		return nil, err
+	}
+	offered, err := parseDHCP6Lease(advertise)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.exchange(dhcp6MsgRequest, c.requestOptions(offered), dhcp6MsgReply)
+	if err != nil {
+		return nil, err
+	}
+	return parseDHCP6Lease(reply)
+}
+
+// requestOptions returns the options to send in a message. If lease is
+// not nil then the message refers to the server and addresses from it.
+func (c *dhcp6Client) requestOptions(lease *dhcp6Lease) []dhcp6Option {
+	options := []dhcp6Option{
+		{dhcp6OptClientID, c.duid},
+		{dhcp6OptElapsedTime, []byte{0, 0}},
+		{dhcp6OptORO, []byte{0, dhcp6OptDNSServers, 0, dhcp6OptDomainList}},
+	}
+
+	// The IA_NA option is the IAID followed by T1 and T2, which we leave
+	// as zero to let the server choose, and then any addresses.
+	iana := make([]byte, 12)
+	binary.BigEndian.PutUint32(iana, c.iaid)
+
+	if lease != nil {
+		options = append(options, dhcp6Option{dhcp6OptServerID, lease.serverID})
+		for _, addr := range lease.addresses {
+			// Lifetimes are also left as zero, as hints to the server.
+			iaaddr := make([]byte, 24)
+			copy(iaaddr, addr.IP.To16())
+			iana = appendDHCP6Option(iana, dhcp6Option{dhcp6OptIAAddr, iaaddr})
+		}
+	}
+
+	return append(options, dhcp6Option{dhcp6OptIANA, iana})
+}
+
+// exchange sends a message to all DHCPv6 servers on the link and returns
+// the options from the first response of the wanted type, retrying a few
+// times if no response arrives.
+func (c *dhcp6Client) exchange(msgType byte, options []dhcp6Option, wantType byte) ([]dhcp6Option, error) {
+	xid := make([]byte, 3)
+	if _, err := rand.Read(xid); err != nil {
+		return nil, err
+	}
+
+	msg := append([]byte{msgType}, xid...)
+	for _, option := range options {
+		msg = appendDHCP6Option(msg, option)
+	}
+
+	dest := *dhcp6ServersAddr
+	dest.Zone = c.iface.Name
+
+	buf := make([]byte, 1500)
+	timeout := time.Second
+	for attempt := 0; attempt < 4; attempt++ {
+		_, err := c.conn.WriteToUDP(msg, &dest)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		c.conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := c.conn.ReadFromUDP(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n < 4 || buf[0] != wantType || !bytes.Equal(buf[1:4], xid) {
+				continue
+			}
+
+			// The options will outlive our read buffer.
+			resp := make([]byte, n-4)
+			copy(resp, buf[4:n])
+
+			respOptions, err := parseDHCP6Options(resp)
+			if err != nil {
+				return nil, err
+			}
+
+			// Responses for other clients can't share our transaction
+			// id in practice, but the RFC asks us to check anyway.
+			clientID := findDHCP6Option(respOptions, dhcp6OptClientID)
+			if clientID != nil && !bytes.Equal(clientID, c.duid) {
+				continue
+			}
+			return respOptions, nil
+		}
+
+		timeout = timeout * 2
+	}
+
+	return nil, fmt.Errorf("no response from DHCPv6 server")
+}
+
+// configure applies newLease to the interface, removing any addresses
+// from oldLease that are no longer present.
+func (c *dhcp6Client) configure(newLease *dhcp6Lease, oldLease *dhcp6Lease) error {
+	for _, addr := range newLease.addresses {
+		// DHCPv6 doesn't tell us about prefixes, so the address is
+		// assigned alone and we rely on router advertisements to tell
+		// the kernel what's on-link.
+		err := netlink.NetworkLinkAddIp(c.iface, addr.IP, dhcp6AddressNet(addr))
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add %s: %s", addr.IP, err)
+		}
+	}
+
+	if oldLease != nil {
+		for _, oldAddr := range oldLease.addresses {
+			if !newLease.hasAddress(oldAddr.IP) {
+				c.removeAddress(oldAddr)
+			}
+		}
+	}
+
+	return nil
+}
+
+// unconfigure removes all of the addresses from the given lease.
+func (c *dhcp6Client) unconfigure(lease *dhcp6Lease) {
+	for _, addr := range lease.addresses {
+		c.removeAddress(addr)
+	}
+}
+
+func (c *dhcp6Client) removeAddress(addr dhcpmsg.Address6) {
+	// The address may already have gone, so we don't care about errors.
+	netlink.NetworkLinkDelIp(c.iface, addr.IP, dhcp6AddressNet(addr))
+}
+
+func dhcp6AddressNet(addr dhcpmsg.Address6) *net.IPNet {
+	return &net.IPNet{
+		IP:   addr.IP,
+		Mask: net.CIDRMask(addr.PrefixLen, 128),
+	}
+}
+
+func (l *dhcp6Lease) hasAddress(ip net.IP) bool {
+	for _, addr := range l.addresses {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validLifetime returns the time until the first of the lease's addresses
+// becomes invalid.
+func (l *dhcp6Lease) validLifetime() time.Duration {
+	var min time.Duration
+	for _, addr := range l.addresses {
+		if min == 0 || addr.ValidLifetime < min {
+			min = addr.ValidLifetime
+		}
+	}
+	return min
+}
+
+// renewAfter returns how long to wait before trying to renew the lease.
+func (l *dhcp6Lease) renewAfter() time.Duration {
+	if l.t1 != 0 {
+		return l.t1
+	}
+	// The server left it to us, so we'll use the same default as RFC 3315
+	// recommends for servers.
+	return l.validLifetime() / 2
+}
+
+func (l *dhcp6Lease) message() *dhcpmsg.Lease6 {
+	return &dhcpmsg.Lease6{
+		Addresses:     l.addresses,
+		NameServers:   l.nameServers,
+		SearchDomains: l.searchDomains,
+	}
+}
+
+func parseDHCP6Lease(options []dhcp6Option) (*dhcp6Lease, error) {
+	if err := dhcp6StatusError(options); err != nil {
+		return nil, err
+	}
+
+	lease := &dhcp6Lease{
+		serverID: findDHCP6Option(options, dhcp6OptServerID),
+	}
+	if lease.serverID == nil {
+		return nil, fmt.Errorf("response has no server identifier")
+	}
+
+	iana := findDHCP6Option(options, dhcp6OptIANA)
+	if len(iana) < 12 {
+		return nil, fmt.Errorf("response has missing or malformed IA_NA")
+	}
+	lease.t1 = time.Duration(binary.BigEndian.Uint32(iana[4:8])) * time.Second
+
+	ianaOptions, err := parseDHCP6Options(iana[12:])
+	if err != nil {
+		return nil, fmt.Errorf("response has malformed IA_NA: %s", err)
+	}
+	if err := dhcp6StatusError(ianaOptions); err != nil {
+		return nil, err
+	}
+
+	for _, option := range ianaOptions {
+		if option.code != dhcp6OptIAAddr {
+			continue
+		}
+		if len(option.data) < 24 {
+			return nil, fmt.Errorf("response has malformed IA address")
+		}
+		valid := binary.BigEndian.Uint32(option.data[20:24])
+		if valid == 0 {
+			// Server is telling us to stop using this address.
+			continue
+		}
+		lease.addresses = append(lease.addresses, dhcpmsg.Address6{
+			IP:            net.IP(option.data[0:16]),
+			PrefixLen:     128,
+			ValidLifetime: time.Duration(valid) * time.Second,
+		})
+	}
+	if len(lease.addresses) == 0 {
+		return nil, fmt.Errorf("response has no addresses")
+	}
+
+	if dnsBytes := findDHCP6Option(options, dhcp6OptDNSServers); dnsBytes != nil {
+		if len(dnsBytes)%16 != 0 {
+			return nil, fmt.Errorf("response has malformed nameserver list")
+		}
+		for i := 0; i < len(dnsBytes); i = i + 16 {
+			lease.nameServers = append(lease.nameServers, net.IP(dnsBytes[i:i+16]))
+		}
+	}
+
+	if domainBytes := findDHCP6Option(options, dhcp6OptDomainList); domainBytes != nil {
+		// This uses the same encoding as the DHCPv4 search option,
+		// except that compression isn't permitted.
+		domains, err := parseDomainSearchList(domainBytes)
+		if err != nil {
+			return nil, fmt.Errorf("response has malformed domain search list: %s", err)
+		}
+		lease.searchDomains = domains
+	}
+
+	return lease, nil
+}
+
+// dhcp6StatusError returns an error if the given options include a status
+// code option indicating failure.
+func dhcp6StatusError(options []dhcp6Option) error {
+	status := findDHCP6Option(options, dhcp6OptStatusCode)
+	if len(status) < 2 {
+		return nil
+	}
+	code := binary.BigEndian.Uint16(status[0:2])
+	if code == 0 {
+		return nil
+	}
+	return fmt.Errorf("server returned status %d: %s", code, status[2:])
+}
+
+func appendDHCP6Option(buf []byte, option dhcp6Option) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header[0:2], option.code)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(option.data)))
+	buf = append(buf, header...)
+	return append(buf, option.data...)
+}
+
+func parseDHCP6Options(raw []byte) ([]dhcp6Option, error) {
+	var options []dhcp6Option
+	for len(raw) > 0 {
+		if len(raw) < 4 {
+			return nil, fmt.Errorf("truncated option header")
+		}
+		code := binary.BigEndian.Uint16(raw[0:2])
+		length := int(binary.BigEndian.Uint16(raw[2:4]))
+		if len(raw) < 4+length {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		options = append(options, dhcp6Option{code, raw[4 : 4+length]})
+		raw = raw[4+length:]
+	}
+	return options, nil
+}
+
+func findDHCP6Option(options []dhcp6Option, code uint16) []byte {
+	for _, option := range options {
+		if option.code == code {
+			return option.data
+		}
+	}
+	return nil
+}
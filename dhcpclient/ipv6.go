@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/defgrid/defgrid-init/dhcpmsg"
+)
+
+// IPv6 configuration runs alongside the DHCPv4 client rather than as
+// part of it, since routers and DHCPv6 servers work on their own
+// timelines. The results are reported to the parent as separate
+// "lease6" messages.
+type ipv6Mode string
+
+const (
+	// ipv6Off leaves IPv6 configuration alone entirely.
+	ipv6Off ipv6Mode = "off"
+
+	// ipv6SLAAC asks the kernel to configure addresses and a default
+	// route from router advertisements, and reports what it configured.
+	ipv6SLAAC ipv6Mode = "slaac"
+
+	// ipv6DHCP obtains addresses from a DHCPv6 server, while still
+	// taking the default route from router advertisements since DHCPv6
+	// has no way to provide one.
+	ipv6DHCP ipv6Mode = "dhcpv6"
+)
+
+func parseIPv6Mode(arg string) (ipv6Mode, error) {
+	switch mode := ipv6Mode(arg); mode {
+	case ipv6Off, ipv6SLAAC, ipv6DHCP:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("must be %q, %q or %q", ipv6Off, ipv6SLAAC, ipv6DHCP)
+	}
+}
+
+// runIPv6 configures IPv6 on the named interface in the given mode, and
+// never returns unless the mode is ipv6Off. The default route comes from
+// router advertisements, and is only accepted if defaultRoute is set.
+func runIPv6(mode ipv6Mode, ifaceName string, defaultRoute bool, send func(*dhcpmsg.Message)) {
+	switch mode {
+	case ipv6SLAAC:
+		runSLAAC(ifaceName, defaultRoute, send)
+	case ipv6DHCP:
+		runDHCPv6(ifaceName, defaultRoute, send)
+	}
+}
+
+// enableRouterAdvertisements configures the kernel to accept router
+// advertisements on the named interface, and optionally to autoconfigure
+// addresses from the prefixes they announce and to take a default route
+// from them.
+func enableRouterAdvertisements(ifaceName string, autoconf bool, defaultRoute bool) error {
+	confDir := filepath.Join("/proc/sys/net/ipv6/conf", ifaceName)
+
+	sysctlBool := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+
+	settings := []struct {
+		name  string
+		value string
+	}{
+		{"disable_ipv6", "0"},
+		{"accept_ra", "1"},
+		{"autoconf", sysctlBool(autoconf)},
+		{"accept_ra_defrtr", sysctlBool(defaultRoute)},
+	}
+
+	for _, setting := range settings {
+		err := ioutil.WriteFile(
+			filepath.Join(confDir, setting.name), []byte(setting.value), 0644,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to set %s: %s", setting.name, err)
+		}
+	}
+	return nil
+}
+
+// globalIPv6Addresses returns the global unicast IPv6 addresses currently
+// assigned to the named interface.
+func globalIPv6Addresses(ifaceName string) ([]dhcpmsg.Address6, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []dhcpmsg.Address6
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		prefixLen, _ := ipNet.Mask.Size()
+		ret = append(ret, dhcpmsg.Address6{
+			IP:        ipNet.IP,
+			PrefixLen: prefixLen,
+		})
+	}
+	return ret, nil
+}
+
+// linkLocalIPv6Address returns the IPv6 link-local address of the named
+// interface, or nil if it doesn't have one yet.
+func linkLocalIPv6Address(ifaceName string) (net.IP, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, nil
+}
+
+func address6ListsEqual(a, b []dhcpmsg.Address6) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].IP.Equal(b[i].IP) || a[i].PrefixLen != b[i].PrefixLen {
+			return false
+		}
+	}
+	return true
+}
+
+// runSLAAC lets the kernel configure the interface from router
+// advertisements and then watches its addresses, along with any resolver
+// configuration that the advertisements carry, reporting them each time
+// they change.
+func runSLAAC(ifaceName string, defaultRoute bool, send func(*dhcpmsg.Message)) {
+	err := enableRouterAdvertisements(ifaceName, true, defaultRoute)
+	if err != nil {
+		log.Printf("[ERROR] Can't enable IPv6 autoconfiguration on %s: %s", ifaceName, err)
+		send(dhcpmsg.NewErrorMessage(
+			fmt.Errorf("can't enable IPv6 autoconfiguration: %s", err), false,
+		))
+		return
+	}
+
+	// Without the resolver options an IPv6-only node has no nameservers,
+	// but we can still report addresses.
+	var resolver *raResolver
+	iface, err := net.InterfaceByName(ifaceName)
+	if err == nil {
+		resolver, err = listenRouterAdvertisements(iface)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Can't listen for router advertisements on %s: %s", ifaceName, err)
+	}
+
+	current := &dhcpmsg.Lease6{}
+	for {
+		addrs, err := globalIPv6Addresses(ifaceName)
+		if err != nil {
+			log.Printf("[ERROR] Failed to read IPv6 addresses for %s: %s", ifaceName, err)
+		} else {
+			lease := &dhcpmsg.Lease6{Addresses: addrs}
+			if resolver != nil {
+				lease.NameServers, lease.SearchDomains = resolver.Current()
+			}
+			if !lease6Equal(lease, current) {
+				current = lease
+				send(dhcpmsg.NewLease6Message(lease))
+			}
+		}
+
+		// Poll quickly until the first router advertisement arrives,
+		// and then settle down to just noticing occasional changes.
+		wait := 30 * time.Second
+		if len(current.Addresses) == 0 {
+			wait = time.Second
+		}
+		var changed <-chan struct{}
+		if resolver != nil {
+			changed = resolver.Changed
+		}
+		select {
+		case <-time.After(wait):
+		case <-changed:
+		}
+	}
+}
+
+func lease6Equal(a, b *dhcpmsg.Lease6) bool {
+	if !address6ListsEqual(a.Addresses, b.Addresses) {
+		return false
+	}
+	if len(a.NameServers) != len(b.NameServers) || len(a.SearchDomains) != len(b.SearchDomains) {
+		return false
+	}
+	for i := range a.NameServers {
+		if !a.NameServers[i].Equal(b.NameServers[i]) {
+			return false
+		}
+	}
+	for i := range a.SearchDomains {
+		if a.SearchDomains[i] != b.SearchDomains[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// runDHCPv6 obtains and renews addresses from a DHCPv6 server.
+func runDHCPv6(ifaceName string, defaultRoute bool, send func(*dhcpmsg.Message)) {
+	err := enableRouterAdvertisements(ifaceName, false, defaultRoute)
+	if err != nil {
+		// We can still get addresses, so we'll carry on without a
+		// default route.
+		log.Printf("[WARN] Can't accept IPv6 router advertisements on %s: %s", ifaceName, err)
+	}
+
+	var client *dhcp6Client
+	for client == nil {
+		client, err = newDHCP6Client(ifaceName)
+		if err != nil {
+			log.Printf("[ERROR] Can't start DHCPv6 client on %s: %s", ifaceName, err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+
+	var lease *dhcp6Lease
+	var leaseExpiry time.Time
+	for {
+		if lease != nil && !time.Now().Before(leaseExpiry) {
+			log.Printf("[ERROR] DHCPv6 lease on %s has expired", ifaceName)
+			client.unconfigure(lease)
+			lease = nil
+			send(dhcpmsg.NewLease6Message(&dhcpmsg.Lease6{}))
+		}
+
+		newLease, err := client.request(lease)
+		if err != nil {
+			log.Printf("[ERROR] DHCPv6 request failed: %s", err)
+			send(dhcpmsg.NewErrorMessage(fmt.Errorf("DHCPv6 request failed: %s", err), false))
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		err = client.configure(newLease, lease)
+		if err != nil {
+			log.Printf("[ERROR] %s IPv6 configuration failed: %s", ifaceName, err)
+			send(dhcpmsg.NewErrorMessage(
+				fmt.Errorf("%s IPv6 configuration failed: %s", ifaceName, err), false,
+			))
+			time.Sleep(60 * time.Second)
+			continue
+		}
+
+		lease = newLease
+		leaseExpiry = time.Now().Add(lease.validLifetime())
+		send(dhcpmsg.NewLease6Message(lease.message()))
+
+		time.Sleep(lease.renewAfter())
+	}
+}
@@ -4,21 +4,19 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/d2g/dhcp4"
+	"github.com/defgrid/defgrid-init/dhcpmsg"
 )
 
+// Lease is a dhcpmsg.Lease along with the raw acknowledgement packet it
+// was built from, which we need in order to renew or release it.
 type Lease struct {
-	IPAddress   net.IP        `msgpack:"ip_address"`
-	Hostname    string        `msgpack:"hostname,omitempty"`
-	DomainName  string        `msgpack:"domain_name,omitempty"`
-	SubnetMask  net.IPMask    `msgpack:"subnet_mask"`
-	Routers     []net.IP      `msgpack:"routers"`
-	NameServers []net.IP      `msgpack:"name_servers"`
-	Duration    time.Duration `msgpack:"duration"`
-
-	rawPacket dhcp4.Packet `msgpack:"-"`
+	dhcpmsg.Lease
+
+	rawPacket dhcp4.Packet
 }
 
 func newLease(ackPacket dhcp4.Packet) (*Lease, error) {
@@ -44,28 +42,76 @@ func newLease(ackPacket dhcp4.Packet) (*Lease, error) {
 		return nil, fmt.Errorf("response has missing or malformed subnet mask")
 	}
 
+	if broadcastBytes := options[28]; broadcastBytes != nil {
+		if len(broadcastBytes) != 4 {
+			return nil, fmt.Errorf("response has malformed broadcast address")
+		}
+		lease.BroadcastAddress = net.IP(broadcastBytes)
+	}
+
 	if routerBytes := options[3]; routerBytes != nil {
-		if len(routerBytes) == 0 || len(routerBytes)%4 != 0 {
+		routers, err := parseIPv4List(routerBytes)
+		if err != nil {
 			return nil, fmt.Errorf("response has missing or malformed router list")
 		}
+		lease.Routers = routers
+	}
+
+	if routeBytes := options[121]; routeBytes != nil {
+		routes, err := parseClasslessRoutes(routeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("response has malformed classless static routes: %s", err)
+		}
 
-		routers := make([]net.IP, 0, len(routerBytes)/4)
-		for i := 0; i < len(routerBytes); i = i + 4 {
-			routers = append(routers, net.IP(routerBytes[i:i+4]))
+		// RFC 3442 requires that we ignore the router option when
+		// classless static routes are present, and take our default
+		// gateway(s) from any default routes in the list instead.
+		var routers []net.IP
+		var staticRoutes []dhcpmsg.Route
+		for _, route := range routes {
+			if route.IsDefault() {
+				routers = append(routers, route.Gateway)
+			} else {
+				staticRoutes = append(staticRoutes, route)
+			}
 		}
 		lease.Routers = routers
+		lease.StaticRoutes = staticRoutes
+	}
+
+	if mtuBytes := options[26]; mtuBytes != nil {
+		if len(mtuBytes) != 2 {
+			return nil, fmt.Errorf("response has malformed interface MTU")
+		}
+		// RFC 2132 says the minimum legal value is 68, so we'll ignore
+		// anything smaller rather than break the interface.
+		if mtu := int(binary.BigEndian.Uint16(mtuBytes)); mtu >= 68 {
+			lease.MTU = mtu
+		}
 	}
 
 	if nameServerBytes := options[6]; nameServerBytes != nil {
-		if len(nameServerBytes) == 0 || len(nameServerBytes)%4 != 0 {
+		nameServers, err := parseIPv4List(nameServerBytes)
+		if err != nil {
 			return nil, fmt.Errorf("response has missing or malformed nameserver list")
 		}
+		lease.NameServers = nameServers
+	}
 
-		nameServers := make([]net.IP, 0, len(nameServerBytes)/4)
-		for i := 0; i < len(nameServerBytes); i = i + 4 {
-			nameServers = append(nameServers, net.IP(nameServerBytes[i:i+4]))
+	if searchBytes := options[119]; searchBytes != nil {
+		searchDomains, err := parseDomainSearchList(searchBytes)
+		if err != nil {
+			return nil, fmt.Errorf("response has malformed domain search list: %s", err)
 		}
-		lease.NameServers = nameServers
+		lease.SearchDomains = searchDomains
+	}
+
+	if ntpServerBytes := options[42]; ntpServerBytes != nil {
+		ntpServers, err := parseIPv4List(ntpServerBytes)
+		if err != nil {
+			return nil, fmt.Errorf("response has missing or malformed NTP server list")
+		}
+		lease.NTPServers = ntpServers
 	}
 
 	if durationBytes := options[51]; durationBytes != nil && len(durationBytes) == 4 {
@@ -78,3 +124,132 @@ func newLease(ackPacket dhcp4.Packet) (*Lease, error) {
 
 	return lease, nil
 }
+
+// parseIPv4List parses an option value consisting of one or more
+// concatenated IPv4 addresses.
+func parseIPv4List(raw []byte) ([]net.IP, error) {
+	if len(raw) == 0 || len(raw)%4 != 0 {
+		return nil, fmt.Errorf("length %d is not a non-zero multiple of 4", len(raw))
+	}
+
+	ips := make([]net.IP, 0, len(raw)/4)
+	for i := 0; i < len(raw); i = i + 4 {
+		ips = append(ips, net.IP(raw[i:i+4]))
+	}
+	return ips, nil
+}
+
+// parseClasslessRoutes parses the value of the classless static route
+// option (121) as described in RFC 3442.
+//
+// Each route is encoded as a prefix length, followed by only the
+// significant octets of the destination, followed by the four-octet
+// router address.
+func parseClasslessRoutes(raw []byte) ([]dhcpmsg.Route, error) {
+	var routes []dhcpmsg.Route
+	for len(raw) > 0 {
+		prefixLen := int(raw[0])
+		if prefixLen > 32 {
+			return nil, fmt.Errorf("invalid prefix length %d", prefixLen)
+		}
+
+		destLen := (prefixLen + 7) / 8
+		if len(raw) < 1+destLen+4 {
+			return nil, fmt.Errorf("truncated route descriptor")
+		}
+
+		dest := make(net.IP, 4)
+		copy(dest, raw[1:1+destLen])
+		gateway := net.IP(raw[1+destLen : 1+destLen+4])
+		mask := net.CIDRMask(prefixLen, 32)
+
+		routes = append(routes, dhcpmsg.Route{
+			Destination: dest.Mask(mask),
+			Mask:        mask,
+			Gateway:     gateway,
+		})
+
+		raw = raw[1+destLen+4:]
+	}
+	return routes, nil
+}
+
+// parseDomainSearchList parses the value of the domain search option
+// (119) as described in RFC 3397.
+//
+// The value is a sequence of domain names in DNS wire format, where
+// compression pointers are offsets from the start of the option value.
+func parseDomainSearchList(raw []byte) ([]string, error) {
+	var domains []string
+	offset := 0
+	for offset < len(raw) {
+		name, next, err := parseDNSName(raw, offset)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			domains = append(domains, name)
+		}
+		offset = next
+	}
+	return domains, nil
+}
+
+// parseDNSName reads a single possibly-compressed domain name from raw
+// starting at offset, returning the name and the offset of the first
+// byte after it.
+func parseDNSName(raw []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+
+	// RFC 1035 limits a name to 255 octets in wire format, counting each
+	// label's length byte and the final zero.
+	nameLen := 1
+
+	// Each pointer must move strictly backwards, which guarantees that
+	// a malicious pointer loop can't keep us here forever.
+	limit := len(raw)
+
+	for {
+		if offset >= len(raw) {
+			return "", 0, fmt.Errorf("truncated domain name")
+		}
+
+		length := int(raw[offset])
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(raw) {
+				return "", 0, fmt.Errorf("truncated compression pointer")
+			}
+			ptr := int(binary.BigEndian.Uint16(raw[offset:offset+2]) & 0x3fff)
+			if ptr >= limit || ptr >= offset {
+				return "", 0, fmt.Errorf("invalid compression pointer")
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			limit = ptr
+			offset = ptr
+
+		case length&0xc0 != 0:
+			return "", 0, fmt.Errorf("invalid label length byte 0x%02x", length)
+
+		default:
+			if offset+1+length > len(raw) {
+				return "", 0, fmt.Errorf("truncated label")
+			}
+			nameLen += 1 + length
+			if nameLen > 255 {
+				return "", 0, fmt.Errorf("domain name too long")
+			}
+			labels = append(labels, string(raw[offset+1:offset+1+length]))
+			offset = offset + 1 + length
+		}
+	}
+}
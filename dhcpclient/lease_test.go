@@ -0,0 +1,248 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/defgrid/defgrid-init/dhcpmsg"
+)
+
+func TestParseClasslessRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    []dhcpmsg.Route
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			raw:  []byte{},
+			want: nil,
+		},
+		{
+			name: "default route",
+			raw:  []byte{0, 10, 0, 0, 1},
+			want: []dhcpmsg.Route{
+				{
+					Destination: net.IPv4(0, 0, 0, 0).To4(),
+					Mask:        net.CIDRMask(0, 32),
+					Gateway:     net.IPv4(10, 0, 0, 1).To4(),
+				},
+			},
+		},
+		{
+			name: "several routes",
+			raw: []byte{
+				24, 192, 168, 1, 10, 0, 0, 1,
+				9, 10, 128, 10, 0, 0, 2,
+				32, 172, 16, 0, 5, 0, 0, 0, 0,
+			},
+			want: []dhcpmsg.Route{
+				{
+					Destination: net.IPv4(192, 168, 1, 0).To4(),
+					Mask:        net.CIDRMask(24, 32),
+					Gateway:     net.IPv4(10, 0, 0, 1).To4(),
+				},
+				{
+					Destination: net.IPv4(10, 128, 0, 0).To4(),
+					Mask:        net.CIDRMask(9, 32),
+					Gateway:     net.IPv4(10, 0, 0, 2).To4(),
+				},
+				{
+					Destination: net.IPv4(172, 16, 0, 5).To4(),
+					Mask:        net.CIDRMask(32, 32),
+					Gateway:     net.IPv4(0, 0, 0, 0).To4(),
+				},
+			},
+		},
+		{
+			name: "significant octets masked",
+			raw:  []byte{9, 10, 255, 10, 0, 0, 1},
+			want: []dhcpmsg.Route{
+				{
+					Destination: net.IPv4(10, 128, 0, 0).To4(),
+					Mask:        net.CIDRMask(9, 32),
+					Gateway:     net.IPv4(10, 0, 0, 1).To4(),
+				},
+			},
+		},
+		{
+			name:    "overlong prefix",
+			raw:     []byte{33, 10, 0, 0, 0, 0, 10, 0, 0, 1},
+			wantErr: true,
+		},
+		{
+			name:    "truncated destination",
+			raw:     []byte{24, 192, 168},
+			wantErr: true,
+		},
+		{
+			name:    "truncated gateway",
+			raw:     []byte{24, 192, 168, 1, 10, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "truncated second route",
+			raw:     []byte{0, 10, 0, 0, 1, 8},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseClasslessRoutes(test.raw)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("succeeded with %#v; want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrong result\ngot:  %#v\nwant: %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDNSName(t *testing.T) {
+	// A label of 63 octets, the most a label can hold.
+	longLabel := string([]byte{63}) + strings.Repeat("a", 63)
+
+	tests := []struct {
+		name     string
+		raw      string
+		offset   int
+		want     string
+		wantNext int
+		wantErr  bool
+	}{
+		{
+			name:     "simple",
+			raw:      "\x07example\x03com\x00",
+			want:     "example.com",
+			wantNext: 13,
+		},
+		{
+			name:     "root",
+			raw:      "\x00",
+			want:     "",
+			wantNext: 1,
+		},
+		{
+			name:     "compressed",
+			raw:      "\x03com\x00\x07example\xc0\x00",
+			offset:   5,
+			want:     "example.com",
+			wantNext: 15,
+		},
+		{
+			name:     "chained pointers",
+			raw:      "\x03com\x00\x07example\xc0\x00\x03www\xc0\x05",
+			offset:   15,
+			want:     "www.example.com",
+			wantNext: 21,
+		},
+		{
+			name:     "longest allowed",
+			raw:      strings.Repeat(longLabel, 3) + "\x3d" + strings.Repeat("b", 61) + "\x00",
+			want:     strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("b", 61),
+			wantNext: 255,
+		},
+		{
+			name:    "overlong name",
+			raw:     strings.Repeat(longLabel, 4) + "\x00",
+			wantErr: true,
+		},
+		{
+			name:    "overlong name via pointers",
+			raw:     strings.Repeat(longLabel, 2) + "\x00" + strings.Repeat(longLabel, 2) + "\xc0\x00",
+			offset:  129,
+			wantErr: true,
+		},
+		{
+			name:    "invalid label length",
+			raw:     "\x40" + strings.Repeat("a", 64) + "\x00",
+			wantErr: true,
+		},
+		{
+			name:    "truncated label",
+			raw:     "\x07exa",
+			wantErr: true,
+		},
+		{
+			name:    "missing terminator",
+			raw:     "\x03com",
+			wantErr: true,
+		},
+		{
+			name:    "offset past end",
+			raw:     "\x00",
+			offset:  1,
+			wantErr: true,
+		},
+		{
+			name:    "truncated pointer",
+			raw:     "\x03com\xc0",
+			wantErr: true,
+		},
+		{
+			name:    "pointer to itself",
+			raw:     "\xc0\x00",
+			wantErr: true,
+		},
+		{
+			name:    "forward pointer",
+			raw:     "\xc0\x02\x03com\x00",
+			wantErr: true,
+		},
+		{
+			name:    "pointer loop",
+			raw:     "\x03com\xc0\x06\x03www\xc0\x00",
+			offset:  6,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, next, err := parseDNSName([]byte(test.raw), test.offset)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("succeeded with %q; want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("wrong name %q; want %q", got, test.want)
+			}
+			if next != test.wantNext {
+				t.Errorf("wrong next offset %d; want %d", next, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestParseDomainSearchList(t *testing.T) {
+	raw := []byte("\x07example\x03com\x00\x03dev\xc0\x00")
+	got, err := parseDomainSearchList(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []string{"example.com", "dev.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	_, err = parseDomainSearchList([]byte("\x07example\x03com"))
+	if err == nil {
+		t.Errorf("succeeded with truncated list; want error")
+	}
+}
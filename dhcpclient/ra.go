@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The kernel configures addresses and routes from router advertisements
+// but ignores the resolver options that RFC 8106 adds to them, so in SLAAC
+// mode we listen for the advertisements ourselves to collect those.
+const (
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+
+	raOptionRDNSS = 25
+	raOptionDNSSL = 31
+)
+
+// raDNSEntry is a nameserver address or search domain from a router
+// advertisement, which is valid for the given lifetime. A zero lifetime
+// withdraws an earlier entry.
+type raDNSEntry struct {
+	Value    string
+	Lifetime time.Duration
+}
+
+// raResolver tracks the nameservers and search domains announced by the
+// routers on one interface.
+type raResolver struct {
+	// Receives a value whenever the announced configuration may have
+	// changed.
+	Changed chan struct{}
+
+	mutex         sync.Mutex
+	nameServers   map[string]time.Time
+	searchDomains map[string]time.Time
+}
+
+// listenRouterAdvertisements starts collecting resolver options from the
+// router advertisements that arrive on the given interface, and solicits
+// an advertisement so that we needn't wait for the next periodic one.
+func listenRouterAdvertisements(iface *net.Interface) (*raResolver, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.BindToDevice(fd, iface.Name)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	r := &raResolver{
+		Changed:       make(chan struct{}, 1),
+		nameServers:   map[string]time.Time{},
+		searchDomains: map[string]time.Time{},
+	}
+	go r.receive(fd)
+
+	err = sendRouterSolicitation(fd, iface)
+	if err != nil {
+		// We'll just have to wait for the next periodic advertisement.
+		log.Printf("[WARN] Failed to send router solicitation on %s: %s", iface.Name, err)
+	}
+
+	return r, nil
+}
+
+func sendRouterSolicitation(fd int, iface *net.Interface) error {
+	// Routers ignore solicitations that could have come from off-link.
+	err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+	if err != nil {
+		return err
+	}
+
+	// The kernel fills in the checksum for ICMPv6 raw sockets.
+	msg := []byte{icmpv6RouterSolicitation, 0, 0, 0, 0, 0, 0, 0}
+	allRouters := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(allRouters.Addr[:], net.ParseIP("ff02::2"))
+	return syscall.Sendto(fd, msg, 0, allRouters)
+}
+
+func (r *raResolver) receive(fd int) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			log.Printf("[ERROR] Failed to receive router advertisement: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// Routers always send from their link-local address.
+		from6, ok := from.(*syscall.SockaddrInet6)
+		if !ok || !net.IP(from6.Addr[:]).IsLinkLocalUnicast() {
+			continue
+		}
+		if n == 0 || buf[0] != icmpv6RouterAdvertisement {
+			continue
+		}
+
+		nameServers, searchDomains, err := parseRADNSOptions(buf[:n])
+		if err != nil {
+			log.Printf("[WARN] Ignoring malformed router advertisement: %s", err)
+			continue
+		}
+		if len(nameServers) == 0 && len(searchDomains) == 0 {
+			continue
+		}
+
+		now := time.Now()
+		r.mutex.Lock()
+		updateRADNSEntries(r.nameServers, nameServers, now)
+		updateRADNSEntries(r.searchDomains, searchDomains, now)
+		r.mutex.Unlock()
+
+		select {
+		case r.Changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func updateRADNSEntries(current map[string]time.Time, entries []raDNSEntry, now time.Time) {
+	for _, entry := range entries {
+		if entry.Lifetime == 0 {
+			delete(current, entry.Value)
+		} else {
+			current[entry.Value] = now.Add(entry.Lifetime)
+		}
+	}
+}
+
+// Current returns the nameservers and search domains that are still
+// valid, in a stable order.
+func (r *raResolver) Current() ([]net.IP, []string) {
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var nameServers []net.IP
+	for _, server := range currentRADNSEntries(r.nameServers, now) {
+		nameServers = append(nameServers, net.ParseIP(server))
+	}
+	return nameServers, currentRADNSEntries(r.searchDomains, now)
+}
+
+func currentRADNSEntries(entries map[string]time.Time, now time.Time) []string {
+	var ret []string
+	for value, expiry := range entries {
+		if now.Before(expiry) {
+			ret = append(ret, value)
+		} else {
+			delete(entries, value)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// parseRADNSOptions returns the nameservers and search domains from the
+// RDNSS and DNSSL options of a router advertisement, given as an ICMPv6
+// message, as described in RFC 8106.
+func parseRADNSOptions(msg []byte) ([]raDNSEntry, []raDNSEntry, error) {
+	// The options follow the 16-byte ICMPv6 and advertisement headers.
+	const headerLen = 16
+	if len(msg) < headerLen {
+		return nil, nil, fmt.Errorf("truncated header")
+	}
+
+	var nameServers, searchDomains []raDNSEntry
+	options := msg[headerLen:]
+	for len(options) > 0 {
+		if len(options) < 2 {
+			return nil, nil, fmt.Errorf("truncated option")
+		}
+		optionLen := int(options[1]) * 8
+		if optionLen == 0 {
+			return nil, nil, fmt.Errorf("option %d has zero length", options[0])
+		}
+		if optionLen > len(options) {
+			return nil, nil, fmt.Errorf("truncated option %d", options[0])
+		}
+		option := options[:optionLen]
+		options = options[optionLen:]
+
+		switch option[0] {
+		case raOptionRDNSS:
+			if optionLen < 24 || (optionLen-8)%16 != 0 {
+				return nil, nil, fmt.Errorf("RDNSS option has invalid length %d", optionLen)
+			}
+			lifetime := raOptionLifetime(option)
+			for addrs := option[8:]; len(addrs) > 0; addrs = addrs[16:] {
+				nameServers = append(nameServers, raDNSEntry{
+					Value:    net.IP(addrs[:16]).String(),
+					Lifetime: lifetime,
+				})
+			}
+
+		case raOptionDNSSL:
+			if optionLen < 16 {
+				return nil, nil, fmt.Errorf("DNSSL option has invalid length %d", optionLen)
+			}
+			// The domains are padded out to the option length with
+			// zeros, which parse as empty names and are skipped.
+			domains, err := parseDomainSearchList(option[8:])
+			if err != nil {
+				return nil, nil, fmt.Errorf("DNSSL option is malformed: %s", err)
+			}
+			lifetime := raOptionLifetime(option)
+			for _, domain := range domains {
+				searchDomains = append(searchDomains, raDNSEntry{
+					Value:    domain,
+					Lifetime: lifetime,
+				})
+			}
+		}
+	}
+	return nameServers, searchDomains, nil
+}
+
+func raOptionLifetime(option []byte) time.Duration {
+	return time.Duration(binary.BigEndian.Uint32(option[4:8])) * time.Second
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRADNSOptions(t *testing.T) {
+	header := make([]byte, 16)
+	header[0] = icmpv6RouterAdvertisement
+
+	rdnss := []byte{
+		raOptionRDNSS, 5, 0, 0, 0, 0, 0x0e, 0x10, // lifetime 3600
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x53,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x54,
+	}
+	dnssl := []byte{
+		raOptionDNSSL, 3, 0, 0, 0, 0, 0, 0, // lifetime 0
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 0, 0,
+	}
+	// A prefix information option, which we skip.
+	prefixInfo := make([]byte, 32)
+	prefixInfo[0], prefixInfo[1] = 3, 4
+
+	tests := []struct {
+		name        string
+		options     []byte
+		wantServers []raDNSEntry
+		wantDomains []raDNSEntry
+		wantErr     bool
+	}{
+		{
+			name: "no options",
+		},
+		{
+			name:    "rdnss and dnssl",
+			options: concat(prefixInfo, rdnss, dnssl),
+			wantServers: []raDNSEntry{
+				{"2001:db8::53", time.Hour},
+				{"2001:db8::54", time.Hour},
+			},
+			wantDomains: []raDNSEntry{
+				{"example.com", 0},
+			},
+		},
+		{
+			name:    "zero length option",
+			options: []byte{3, 0, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "truncated option",
+			options: rdnss[:20],
+			wantErr: true,
+		},
+		{
+			name:    "rdnss without addresses",
+			options: []byte{raOptionRDNSS, 1, 0, 0, 0, 0, 0, 0},
+			wantErr: true,
+		},
+		{
+			name:    "rdnss with partial address",
+			options: concat([]byte{raOptionRDNSS, 2}, make([]byte, 14)),
+			wantErr: true,
+		},
+		{
+			name:    "malformed dnssl",
+			options: concat([]byte{raOptionDNSSL, 2, 0, 0, 0, 0, 0, 0, 9, 'e', 'x'}, make([]byte, 5)),
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			servers, domains, err := parseRADNSOptions(concat(header, test.options))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(servers, test.wantServers) {
+				t.Errorf("wrong nameservers\ngot:  %v\nwant: %v", servers, test.wantServers)
+			}
+			if !reflect.DeepEqual(domains, test.wantDomains) {
+				t.Errorf("wrong search domains\ngot:  %v\nwant: %v", domains, test.wantDomains)
+			}
+		})
+	}
+
+	_, _, err := parseRADNSOptions(header[:10])
+	if err == nil {
+		t.Errorf("succeeded with truncated header; want error")
+	}
+}
+
+func TestRADNSEntryLifetimes(t *testing.T) {
+	now := time.Now()
+	current := map[string]time.Time{}
+	updateRADNSEntries(current, []raDNSEntry{{"a", time.Hour}, {"b", time.Second}}, now)
+	updateRADNSEntries(current, []raDNSEntry{{"a", 0}, {"c", time.Hour}}, now)
+
+	got := currentRADNSEntries(current, now.Add(time.Minute))
+	want := []string{"c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if _, ok := current["b"]; ok {
+		t.Errorf("expired entry was not removed")
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var ret []byte
+	for _, part := range parts {
+		ret = append(ret, part...)
+	}
+	return ret
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// deleteRoute removes the IPv4 route to dest via gateway on the given
+// interface from the main routing table. A route that is already gone is
+// not an error.
+//
+// The vendored netlink package can add routes but not remove them, so we
+// speak netlink ourselves here.
+func deleteRoute(iface *net.Interface, dest *net.IPNet, gateway net.IP) error {
+	prefixLen, _ := dest.Mask.Size()
+	rtm := syscall.RtMsg{
+		Family:  syscall.AF_INET,
+		Dst_len: uint8(prefixLen),
+		Table:   syscall.RT_TABLE_MAIN,
+		Scope:   syscall.RT_SCOPE_UNIVERSE,
+		Type:    syscall.RTN_UNICAST,
+	}
+	body := append([]byte(nil), (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&rtm))[:]...)
+
+	if prefixLen != 0 {
+		body = appendRouteAttr(body, syscall.RTA_DST, dest.IP.To4())
+	}
+	if gateway != nil && !gateway.IsUnspecified() {
+		body = appendRouteAttr(body, syscall.RTA_GATEWAY, gateway.To4())
+	}
+	oif := uint32(iface.Index)
+	body = appendRouteAttr(body, syscall.RTA_OIF, (*[4]byte)(unsafe.Pointer(&oif))[:])
+
+	err := netlinkRequest(syscall.RTM_DELROUTE, 0, body)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// replaceAddress adds the given IPv4 address to the given interface, or
+// updates it if it's already there, setting its broadcast address if
+// broadcast isn't nil.
+//
+// The vendored netlink package can't set a broadcast address, so this is
+// another request we make ourselves.
+func replaceAddress(iface *net.Interface, network *net.IPNet, broadcast net.IP) error {
+	prefixLen, _ := network.Mask.Size()
+	ifa := syscall.IfAddrmsg{
+		Family:    syscall.AF_INET,
+		Prefixlen: uint8(prefixLen),
+		Scope:     syscall.RT_SCOPE_UNIVERSE,
+		Index:     uint32(iface.Index),
+	}
+	body := append([]byte(nil), (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&ifa))[:]...)
+
+	body = appendRouteAttr(body, syscall.IFA_LOCAL, network.IP.To4())
+	body = appendRouteAttr(body, syscall.IFA_ADDRESS, network.IP.To4())
+	if broadcast != nil {
+		body = appendRouteAttr(body, syscall.IFA_BROADCAST, broadcast.To4())
+	}
+
+	return netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, body)
+}
+
+// appendRouteAttr appends a route netlink attribute to buf. Address
+// messages use the same attribute format as routes do.
+func appendRouteAttr(buf []byte, attrType uint16, value []byte) []byte {
+	attr := syscall.RtAttr{
+		Len:  uint16(syscall.SizeofRtAttr + len(value)),
+		Type: attrType,
+	}
+	buf = append(buf, (*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&attr))[:]...)
+	buf = append(buf, value...)
+	for len(buf)%syscall.NLMSG_ALIGNTO != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// netlinkRequest sends a single route netlink request with the given
+// flags in addition to the usual request flags, and waits for the kernel
+// to acknowledge it, returning the error it reports, if any.
+func netlinkRequest(msgType uint16, flags uint16, body []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	err = syscall.Bind(fd, addr)
+	if err != nil {
+		return err
+	}
+
+	const seq = 1
+	hdr := syscall.NlMsghdr{
+		Len:   uint32(syscall.SizeofNlMsghdr + len(body)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   seq,
+	}
+	req := append([]byte(nil), (*[syscall.SizeofNlMsghdr]byte)(unsafe.Pointer(&hdr))[:]...)
+	req = append(req, body...)
+
+	err = syscall.Sendto(fd, req, 0, addr)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("truncated netlink acknowledgement")
+			}
+			errno := -*(*int32)(unsafe.Pointer(&m.Data[0]))
+			if errno == 0 {
+				return nil
+			}
+			return syscall.Errno(errno)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Package dhcpmsg defines the protocol spoken between defgrid-init and its
+// dhcpclient child process.
+//
+// The child writes a stream of msgpack-encoded Message values to its stdout.
+// The first message is always a "hello" message announcing the protocol
+// version the child speaks, and the parent should refuse to continue if it
+// doesn't understand that version. After that, messages may arrive in any
+// order as the child's situation changes.
+//
+// In the other direction, the parent writes a stream of msgpack-encoded
+// Command values to the child's stdin. The child treats the closing of
+// its stdin as an implicit "stop" command, so that it won't outlive a
+// parent that has gone away.
+package dhcpmsg
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Version is the protocol version implemented by this package. It must
+// be incremented whenever an incompatible change is made to the types
+// in this package.
+//
+// Adding new optional fields or new message types is not an incompatible
+// change, since decoders skip unknown fields and the parent ignores
+// message types it doesn't understand.
+const Version = 1
+
+type MessageType string
+
+const (
+	MessageHello         MessageType = "hello"
+	MessageLease         MessageType = "lease"
+	MessageLease6        MessageType = "lease6"
+	MessageState         MessageType = "state"
+	MessageError         MessageType = "error"
+	MessageExpiryWarning MessageType = "expiry_warning"
+)
+
+// Message is the envelope for everything sent from the child to the parent.
+//
+// Exactly one of the pointer fields is populated, as selected by Type.
+type Message struct {
+	Type MessageType `msgpack:"type"`
+
+	Hello         *Hello         `msgpack:"hello,omitempty"`
+	Lease         *Lease         `msgpack:"lease,omitempty"`
+	Lease6        *Lease6        `msgpack:"lease6,omitempty"`
+	State         *StateChange   `msgpack:"state,omitempty"`
+	Error         *Error         `msgpack:"error,omitempty"`
+	ExpiryWarning *ExpiryWarning `msgpack:"expiry_warning,omitempty"`
+}
+
+// Hello is sent once by the child as soon as it starts.
+type Hello struct {
+	Version   int    `msgpack:"version"`
+	Interface string `msgpack:"interface"`
+}
+
+type State string
+
+const (
+	StateRequesting State = "requesting"
+	StateBound      State = "bound"
+	StateRenewing   State = "renewing"
+	StateExpired    State = "expired"
+	StateReleased   State = "released"
+	StateStopped    State = "stopped"
+)
+
+// StateChange is sent each time the child moves to a new state.
+type StateChange struct {
+	State State `msgpack:"state"`
+}
+
+// Error reports a problem encountered by the child.
+//
+// If Fatal is set then the child is about to exit. Otherwise it will
+// retry the failed operation after a delay.
+type Error struct {
+	Message string `msgpack:"message"`
+	Fatal   bool   `msgpack:"fatal"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ExpiryWarning is sent when the child has been unable to renew its lease
+// and the lease is close to expiring, at which point the interface will
+// lose its address.
+type ExpiryWarning struct {
+	Remaining time.Duration `msgpack:"remaining"`
+}
+
+func NewHelloMessage(ifaceName string) *Message {
+	return &Message{
+		Type: MessageHello,
+		Hello: &Hello{
+			Version:   Version,
+			Interface: ifaceName,
+		},
+	}
+}
+
+func NewLeaseMessage(lease *Lease) *Message {
+	return &Message{
+		Type:  MessageLease,
+		Lease: lease,
+	}
+}
+
+func NewLease6Message(lease *Lease6) *Message {
+	return &Message{
+		Type:   MessageLease6,
+		Lease6: lease,
+	}
+}
+
+func NewStateMessage(state State) *Message {
+	return &Message{
+		Type:  MessageState,
+		State: &StateChange{State: state},
+	}
+}
+
+func NewErrorMessage(err error, fatal bool) *Message {
+	return &Message{
+		Type: MessageError,
+		Error: &Error{
+			Message: err.Error(),
+			Fatal:   fatal,
+		},
+	}
+}
+
+func NewExpiryWarningMessage(remaining time.Duration) *Message {
+	return &Message{
+		Type:          MessageExpiryWarning,
+		ExpiryWarning: &ExpiryWarning{Remaining: remaining},
+	}
+}
+
+type CommandType string
+
+const (
+	// CommandRenew asks the child to renew its lease immediately, or to
+	// request a new one if it doesn't currently have one.
+	CommandRenew CommandType = "renew"
+
+	// CommandRelease asks the child to release its lease and remove the
+	// address from the interface. The child will then wait for a
+	// CommandRenew before requesting a new lease.
+	CommandRelease CommandType = "release"
+
+	// CommandStop asks the child to exit without releasing its lease,
+	// leaving the interface configured.
+	CommandStop CommandType = "stop"
+)
+
+// Command is the envelope for everything sent from the parent to the child.
+type Command struct {
+	Type CommandType `msgpack:"type"`
+}
+
+// Encoder writes messages or commands to an underlying stream.
+//
+// It is safe to use an Encoder from multiple goroutines.
+type Encoder struct {
+	enc   *msgpack.Encoder
+	mutex sync.Mutex
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{enc: msgpack.NewEncoder(w)}
+}
+
+func (e *Encoder) WriteMessage(msg *Message) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.enc.Encode(msg)
+}
+
+func (e *Encoder) WriteCommand(cmd *Command) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.enc.Encode(cmd)
+}
+
+// Decoder reads messages or commands from an underlying stream.
+type Decoder struct {
+	dec *msgpack.Decoder
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{dec: msgpack.NewDecoder(r)}
+}
+
+// ReadMessage reads the next message, returning an error if it is one of
+// the message types we know but lacks the payload that its type calls for.
+// Messages of unknown types are returned as-is.
+func (d *Decoder) ReadMessage() (*Message, error) {
+	msg := &Message{}
+	err := d.dec.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !msg.hasPayload() {
+		return nil, fmt.Errorf("%q message has no payload", msg.Type)
+	}
+	return msg, nil
+}
+
+// hasPayload returns false if the pointer field selected by the message's
+// type is nil.
+func (m *Message) hasPayload() bool {
+	switch m.Type {
+	case MessageHello:
+		return m.Hello != nil
+	case MessageLease:
+		return m.Lease != nil
+	case MessageLease6:
+		return m.Lease6 != nil
+	case MessageState:
+		return m.State != nil
+	case MessageError:
+		return m.Error != nil
+	case MessageExpiryWarning:
+		return m.ExpiryWarning != nil
+	default:
+		return true
+	}
+}
+
+func (d *Decoder) ReadCommand() (*Command, error) {
+	cmd := &Command{}
+	err := d.dec.Decode(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// ReadHello reads the first message from a child and verifies that it is
+// a hello message for a protocol version we understand.
+func (d *Decoder) ReadHello() (*Hello, error) {
+	msg, err := d.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != MessageHello || msg.Hello == nil {
+		return nil, fmt.Errorf("expected hello message but got %q", msg.Type)
+	}
+	if msg.Hello.Version != Version {
+		return nil, fmt.Errorf(
+			"unsupported protocol version %d (want %d)",
+			msg.Hello.Version, Version,
+		)
+	}
+	return msg.Hello, nil
+}
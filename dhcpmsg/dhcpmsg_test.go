@@ -0,0 +1,67 @@
+package dhcpmsg
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []*Message{
+		NewHelloMessage("eth0"),
+		NewLeaseMessage(&Lease{IPAddress: net.IPv4(10, 0, 0, 2).To4()}),
+		NewLease6Message(&Lease6{}),
+		NewStateMessage(StateBound),
+		NewErrorMessage(fmt.Errorf("oops"), true),
+		NewExpiryWarningMessage(time.Minute),
+		{Type: "from_the_future"},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, msg := range msgs {
+		err := enc.WriteMessage(msg)
+		if err != nil {
+			t.Fatalf("failed to encode %q message: %s", msg.Type, err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range msgs {
+		got, err := dec.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to decode %q message: %s", want.Type, err)
+		}
+		if got.Type != want.Type {
+			t.Errorf("got %q message; want %q", got.Type, want.Type)
+		}
+	}
+}
+
+func TestReadMessageMissingPayload(t *testing.T) {
+	types := []MessageType{
+		MessageHello,
+		MessageLease,
+		MessageLease6,
+		MessageState,
+		MessageError,
+		MessageExpiryWarning,
+	}
+
+	for _, msgType := range types {
+		t.Run(string(msgType), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := NewEncoder(&buf).WriteMessage(&Message{Type: msgType})
+			if err != nil {
+				t.Fatalf("failed to encode: %s", err)
+			}
+
+			msg, err := NewDecoder(&buf).ReadMessage()
+			if err == nil {
+				t.Fatalf("succeeded with %#v; want error", msg)
+			}
+		})
+	}
+}
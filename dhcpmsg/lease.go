@@ -0,0 +1,58 @@
+package dhcpmsg
+
+import (
+	"net"
+	"time"
+)
+
+// Lease describes the network configuration obtained from a DHCP server,
+// which the child has already applied to its interface by the time the
+// lease is sent.
+type Lease struct {
+	IPAddress        net.IP        `msgpack:"ip_address"`
+	Hostname         string        `msgpack:"hostname,omitempty"`
+	DomainName       string        `msgpack:"domain_name,omitempty"`
+	SubnetMask       net.IPMask    `msgpack:"subnet_mask"`
+	BroadcastAddress net.IP        `msgpack:"broadcast_address,omitempty"`
+	Routers          []net.IP      `msgpack:"routers"`
+	StaticRoutes     []Route       `msgpack:"static_routes,omitempty"`
+	MTU              int           `msgpack:"mtu,omitempty"`
+	NameServers      []net.IP      `msgpack:"name_servers"`
+	SearchDomains    []string      `msgpack:"search_domains,omitempty"`
+	NTPServers       []net.IP      `msgpack:"ntp_servers,omitempty"`
+	Duration         time.Duration `msgpack:"duration"`
+}
+
+// Route is a single entry from the classless static route option.
+//
+// A nil or unspecified Gateway means that the destination is directly
+// reachable on the local link, per RFC 3442.
+type Route struct {
+	Destination net.IP     `msgpack:"destination"`
+	Mask        net.IPMask `msgpack:"mask"`
+	Gateway     net.IP     `msgpack:"gateway"`
+}
+
+// IsDefault returns true if the route is a default route, i.e. 0.0.0.0/0.
+func (r *Route) IsDefault() bool {
+	ones, _ := r.Mask.Size()
+	return ones == 0
+}
+
+// Lease6 describes the IPv6 configuration obtained either from router
+// advertisements (SLAAC) or from a DHCPv6 server, which the child has
+// already applied to its interface by the time the lease is sent.
+//
+// Each Lease6 message replaces any earlier one in its entirety.
+type Lease6 struct {
+	Addresses     []Address6 `msgpack:"addresses"`
+	NameServers   []net.IP   `msgpack:"name_servers,omitempty"`
+	SearchDomains []string   `msgpack:"search_domains,omitempty"`
+}
+
+// Address6 is a single global IPv6 address assigned to the interface.
+type Address6 struct {
+	IP            net.IP        `msgpack:"ip"`
+	PrefixLen     int           `msgpack:"prefix_len"`
+	ValidLifetime time.Duration `msgpack:"valid_lifetime,omitempty"`
+}
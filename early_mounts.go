@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// earlyMount is one of the filesystems we mount early in boot, when we're
+// running as init and nothing else has mounted them for us.
+type earlyMount struct {
+	Source string
+	Target string
+	FSType string
+	Flags  uintptr
+	Data   string
+}
+
+// kernelMounts are the filesystems we need before we can even choose a
+// flavor, since we read the kernel command line from /proc and detect the
+// platform partly from /sys.
+var kernelMounts = []earlyMount{
+	{"proc", "/proc", "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+	{"sysfs", "/sys", "sysfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+}
+
+// earlyMounts are the remaining filesystems that the rest of the system
+// expects to find, mounted in this order.
+var earlyMounts = []earlyMount{
+	{"devtmpfs", "/dev", "devtmpfs", syscall.MS_NOSUID, "mode=0755"},
+	{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "gid=5,mode=0620,ptmxmode=0666"},
+	{"tmpfs", "/run", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV, "mode=0755"},
+	{"tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV, "mode=1777"},
+}
+
+// optionalMounts are filesystems that only some features need, and so
+// whose absence, such as on a kernel built without them, isn't fatal.
+// The features that need them report their own errors later.
+var optionalMounts = []earlyMount{
+	{"cgroup2", "/sys/fs/cgroup", "cgroup2", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+}
+
+// The symlinks in /dev that programs expect, which devtmpfs doesn't
+// create for us.
+var devSymlinks = []struct {
+	Path   string
+	Target string
+}{
+	{"/dev/fd", "/proc/self/fd"},
+	{"/dev/stdin", "/proc/self/fd/0"},
+	{"/dev/stdout", "/proc/self/fd/1"},
+	{"/dev/stderr", "/proc/self/fd/2"},
+}
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// MountKernelFilesystems mounts /proc and /sys if they aren't already
+// mounted. This is only appropriate when we're running as init.
+func MountKernelFilesystems() error {
+	return mountAll(kernelMounts)
+}
+
+// MountEarlyFilesystems mounts the filesystems that a booting system
+// needs, such as /dev and /run, skipping any that are already mounted,
+// and creates the standard symlinks in /dev. A failure to mount one of
+// the optionalMounts is only logged. If remountRootRW is set,
+// the root filesystem is also remounted read-write if it isn't already.
+func MountEarlyFilesystems(remountRootRW bool) error {
+	err := mountAll(kernelMounts)
+	if err != nil {
+		return err
+	}
+	err = mountAll(earlyMounts)
+	if err != nil {
+		return err
+	}
+	for _, m := range optionalMounts {
+		err := mountAll([]earlyMount{m})
+		if err != nil {
+			log.Printf("[WARNING] Continuing without %s: %s", m.Target, err)
+		}
+	}
+
+	for _, link := range devSymlinks {
+		err := os.Symlink(link.Target, link.Path)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create %s: %s", link.Path, err)
+		}
+	}
+
+	if remountRootRW {
+		mounts, err := readMountInfo(mountInfoPath)
+		if err != nil {
+			return err
+		}
+		if root, ok := mounts["/"]; ok && root.ReadOnly() {
+			log.Println("Remounting / read-write")
+			err := syscall.Mount("", "/", "", syscall.MS_REMOUNT, "")
+			if err != nil {
+				return fmt.Errorf("failed to remount / read-write: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func mountAll(toMount []earlyMount) error {
+	// If /proc isn't mounted yet then nothing is, as far as we can tell.
+	mounts, err := readMountInfo(mountInfoPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, m := range toMount {
+		if _, ok := mounts[m.Target]; ok {
+			continue
+		}
+
+		log.Printf("Mounting %s on %s", m.FSType, m.Target)
+		err := os.MkdirAll(m.Target, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", m.Target, err)
+		}
+		err = syscall.Mount(m.Source, m.Target, m.FSType, m.Flags, m.Data)
+		if err != nil {
+			return fmt.Errorf("failed to mount %s on %s: %s", m.FSType, m.Target, err)
+		}
+	}
+
+	return nil
+}
+
+// mountInfo describes an existing mount, from /proc/self/mountinfo.
+type mountInfo struct {
+	FSType  string
+	Options []string
+}
+
+// ReadOnly returns true if the mount is read-only.
+func (m mountInfo) ReadOnly() bool {
+	return stringListContains(m.Options, "ro")
+}
+
+// readMountInfo reads the given mountinfo file, returning the mounts
+// keyed by mount point. If several mounts share a mount point, the last
+// (topmost) one wins.
+func readMountInfo(path string) (map[string]mountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := map[string]mountInfo{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		// The format is described in proc(5). The fields after the
+		// optional fields are separated from them by a lone "-".
+		fields := strings.Fields(lines.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+1 >= len(fields) {
+			continue
+		}
+
+		ret[unescapeMountPath(fields[4])] = mountInfo{
+			FSType:  fields[sep+1],
+			Options: strings.Split(fields[5], ","),
+		}
+	}
+	return ret, lines.Err()
+}
+
+// unescapeMountPath undoes the octal escaping of whitespace and
+// backslashes in mount paths in mountinfo.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var ret []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			c, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			if err == nil {
+				ret = append(ret, byte(c))
+				i += 3
+				continue
+			}
+		}
+		ret = append(ret, s[i])
+	}
+	return string(ret)
+}
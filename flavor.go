@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// FlavorDefinition describes a boot flavor: which implementation of each
+// of the Booter's components to use on a particular kind of platform, and
+// how to set them up.
+//
+// Besides the built-in flavors, flavors can be defined in a JSON file
+// mapping flavor names to definitions, so that new platforms can be
+// supported without rebuilding defgrid-init:
+//
+//	{
+//	    "rack-storage": {
+//	        "description": "Storage nodes with a separate data NIC",
+//	        "console": "/dev/tty1",
+//	        "log": "/dev/ttyS0",
+//	        "random": {"type": "haveged"},
+//	        "network": {"type": "dhcp", "params": {"Interface": "eth0"}},
+//	        "early_resolver": {"type": "resolv-direct"},
+//	        "node_config": {"type": "static"},
+//	        "resolver": {"type": "resolv-direct"},
+//	        "manages_links": true,
+//	        "services": [
+//	            {
+//	                "name": "consul",
+//	                "command": ["/usr/bin/consul", "agent", "-config-dir=/etc/consul"],
+//	                "icon": "consul",
+//	                "limits": {"memory_max": 536870912},
+//	                "watchdog": true,
+//	                "checks": [
+//	                    {"name": "api", "http": "http://127.0.0.1:8500/v1/status/leader"}
+//	                ]
+//	            }
+//	        ]
+//	    }
+//	}
+//
+// A flavor in the file replaces any built-in flavor of the same name.
+type FlavorDefinition struct {
+	// Description explains what the flavor is for.
+	Description string `json:"description"`
+
+	// ConsoleDevice and LogDevice are the paths of the console and log
+	// devices. These may refer to environment variables, as in
+	// "${DGI_DEV_LOG:-/dev/tty}", which uses /dev/tty if DGI_DEV_LOG
+	// is not set.
+	ConsoleDevice string `json:"console"`
+	LogDevice     string `json:"log"`
+
+	Random        ComponentDefinition `json:"random"`
+	Network       ComponentDefinition `json:"network"`
+	EarlyResolver ComponentDefinition `json:"early_resolver"`
+	NodeConfig    ComponentDefinition `json:"node_config"`
+	Resolver      ComponentDefinition `json:"resolver"`
+
+	// ManagesLinks is set for flavors where we own the network
+	// configuration; see Booter.ManagesLinks.
+	ManagesLinks bool `json:"manages_links"`
+
+	// EarlyMounts is set for flavors where we boot the system ourselves,
+	// and so must mount /dev, /run and friends; see
+	// MountEarlyFilesystems. RootReadWrite additionally remounts the root
+	// filesystem read-write.
+	EarlyMounts   bool `json:"early_mounts"`
+	RootReadWrite bool `json:"root_rw"`
+
+	// MetadataEndpoint is the host:port of the metadata service that the
+	// node config getter consults, if any, which the network checks
+	// verify is reachable. None of the built-in flavors has one.
+	MetadataEndpoint string `json:"metadata_endpoint"`
+
+	// CrashAction is "hang" or "reboot", saying what to do after a crash.
+	// The default is to hang.
+	CrashAction CrashAction `json:"crash_action"`
+
+	// CrashDir is where crash files are written, which should be on
+	// persistent storage. It may refer to environment variables, as with
+	// ConsoleDevice, and defaults to /var/lib/defgrid-init/crash.
+	CrashDir string `json:"crash_dir"`
+
+	// CrashMaxConsecutive is how many crashes in a row we reboot after
+	// before hanging instead, defaulting to 3, and CrashRebootDelay is
+	// how many seconds we wait before rebooting, defaulting to 30.
+	CrashMaxConsecutive int `json:"crash_max_consecutive"`
+	CrashRebootDelay    int `json:"crash_reboot_delay"`
+
+	// Watchdog is the path of the watchdog device to use, if any, and
+	// WatchdogTimeout is its timeout in seconds, defaulting to 60.
+	Watchdog        string `json:"watchdog"`
+	WatchdogTimeout int    `json:"watchdog_timeout"`
+
+	// Services are started once boot is complete, and supervised from
+	// then on. None of the built-in flavors has any.
+	Services []*ServiceDefinition `json:"services"`
+}
+
+// The default location of the flavor definitions file.
+const flavorsPath = "/etc/defgrid/flavors.json"
+
+var builtinFlavors = map[string]*FlavorDefinition{
+	// "dev" means just launching the program directly within a
+	// standalone dev environment; this mode may not do anything
+	// that requires root access or make any permanent changes
+	// to the system, since the primary motivation is to get
+	// through the boot process with little fanfare so we can
+	// test the service-supervision part.
+	//
+	// Environment variables can be used to customize how we
+	// fake various aspects of the system.
+	"dev": {
+		Description:   "Standalone dev environment",
+		ConsoleDevice: "${DGI_DEV_CONSOLE:-/dev/null}",
+		LogDevice:     "${DGI_DEV_LOG:-/dev/tty}",
+		CrashDir:      "${DGI_DEV_CRASH_DIR:-/tmp/defgrid-init-crash}",
+		Random:        ComponentDefinition{Type: "noop"},
+		Network:       ComponentDefinition{Type: "local-dev"},
+		EarlyResolver: ComponentDefinition{Type: "noop"},
+		NodeConfig:    ComponentDefinition{Type: "local-dev"},
+		Resolver:      ComponentDefinition{Type: "noop"},
+	},
+
+	// "devcontainer" is similar to "dev" except that we expect to be
+	// launching in some sort of container, such as a Docker container.
+	// This means it is somewhat isolated from the host system but still
+	// isn't controlling a full machine and so ends up being a mixture
+	// of "dev" and "testhost" config.
+	"devcontainer": {
+		Description:   "Dev environment in a container",
+		ConsoleDevice: "${DGI_DEV_CONSOLE:-/dev/null}",
+		LogDevice:     "${DGI_DEV_LOG:-/dev/tty}",
+		CrashDir:      "${DGI_DEV_CRASH_DIR:-/tmp/defgrid-init-crash}",
+		Random:        ComponentDefinition{Type: "noop"},
+		Network: ComponentDefinition{
+			Type: "local-dev",
+			// assume docker container with preconfigured eth0
+			Params: json.RawMessage(`{"ForceInterface": "eth0"}`),
+		},
+		EarlyResolver: ComponentDefinition{Type: "noop"},
+		NodeConfig:    ComponentDefinition{Type: "local-dev"},
+		Resolver:      ComponentDefinition{Type: "noop"},
+	},
+
+	// "testhost" is another kind of dev environment, but used
+	// when we're running in a local qemu instance launched from
+	// within the defgrid-images repository. In this case we
+	// *are* booting a virtual machine, and so we do need to go
+	// through all the usual network configuration steps, but
+	// there's no "metadata service" with which to discover our
+	// node id and region, and so we'll just use synthetic
+	// values for these which are designed to be "unique enough"
+	// for our test network.
+	"testhost": {
+		Description:   "Local qemu test host",
+		ConsoleDevice: "/dev/tty1",
+		LogDevice:     "/dev/hvc0", // virtio console
+		Random:        ComponentDefinition{Type: "haveged"},
+		Network: ComponentDefinition{
+			Type:   "dhcp",
+			Params: json.RawMessage(`{"Interface": "eth0", "LinkLocalFallback": "30s"}`),
+		},
+		EarlyResolver: ComponentDefinition{Type: "resolv-direct"},
+		NodeConfig:    ComponentDefinition{Type: "testnet"},
+
+		// TODO: Once we've got consul running, write implementation
+		// that configures dnsmasq to forward .consul requests over
+		// to the DNS interface on the local consul agent.
+		Resolver: ComponentDefinition{Type: "resolv-direct"},
+
+		ManagesLinks: true,
+		EarlyMounts:  true,
+	},
+
+	// "baremetal" is for physical machines in racks where there is
+	// no DHCP server and no metadata service, and so the network
+	// configuration and the node's placement are given either in a
+	// config file baked into the image or on the kernel command line.
+	"baremetal": {
+		Description:   "Physical machine with static configuration",
+		ConsoleDevice: "/dev/tty1",
+		LogDevice:     "/dev/ttyS0", // serial console
+		Random:        ComponentDefinition{Type: "haveged"},
+		Network: ComponentDefinition{
+			Type:   "static",
+			Params: json.RawMessage(`{"ConfigPath": "/etc/defgrid/network.json", "Interface": "eth0"}`),
+		},
+		EarlyResolver: ComponentDefinition{Type: "resolv-direct"},
+		NodeConfig:    ComponentDefinition{Type: "static"},
+
+		// TODO: Switch to the consul-aware resolver configurer once
+		// it exists, as with "testhost".
+		Resolver: ComponentDefinition{Type: "resolv-direct"},
+
+		ManagesLinks: true,
+		EarlyMounts:  true,
+
+		// Nobody is likely to be watching the console of a machine in
+		// a rack, so it's better to try rebooting, and to have the
+		// hardware reset us if we wedge.
+		CrashAction: CrashReboot,
+		Watchdog:    "/dev/watchdog",
+	},
+}
+
+// LoadFlavors returns the built-in flavor definitions combined with any
+// defined in the file at the given path. A missing file is not an error.
+func LoadFlavors(path string) (map[string]*FlavorDefinition, error) {
+	flavors := map[string]*FlavorDefinition{}
+	for name, def := range builtinFlavors {
+		flavors[name] = def
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return flavors, nil
+		}
+		return nil, err
+	}
+
+	var fileFlavors map[string]*FlavorDefinition
+	err = json.Unmarshal(data, &fileFlavors)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flavor definitions in %s: %s", path, err)
+	}
+	for name, def := range fileFlavors {
+		flavors[name] = def
+	}
+
+	return flavors, nil
+}
+
+// newBooter builds a Booter as described by the flavor definition.
+func (d *FlavorDefinition) newBooter() (*Booter, error) {
+	b := &Booter{
+		consoleDevPath:   expandFlavorValue(d.ConsoleDevice),
+		logDevPath:       expandFlavorValue(d.LogDevice),
+		managesLinks:     d.ManagesLinks,
+		earlyMounts:      d.EarlyMounts,
+		remountRootRW:    d.RootReadWrite,
+		metadataEndpoint: d.MetadataEndpoint,
+		watchdogPath:     expandFlavorValue(d.Watchdog),
+		watchdogTimeout:  watchdogDefaultTimeout,
+	}
+
+	var err error
+	if d.WatchdogTimeout > 0 {
+		b.watchdogTimeout = time.Duration(d.WatchdogTimeout) * time.Second
+	}
+	b.crashPolicy, err = d.crashPolicy()
+	if err != nil {
+		return nil, err
+	}
+	b.randomConfig, err = newRandomConfigurer(&d.Random)
+	if err != nil {
+		return nil, fmt.Errorf("random: %s", err)
+	}
+	b.networkConfig, err = newNetworkConfigurer(&d.Network)
+	if err != nil {
+		return nil, fmt.Errorf("network: %s", err)
+	}
+	b.earlyResolverConfig, err = newResolverConfigurer(&d.EarlyResolver)
+	if err != nil {
+		return nil, fmt.Errorf("early_resolver: %s", err)
+	}
+	b.nodeConfigGetter, err = newNodeConfigGetter(&d.NodeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("node_config: %s", err)
+	}
+	b.resolverConfig, err = newResolverConfigurer(&d.Resolver)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: %s", err)
+	}
+
+	seen := map[string]bool{}
+	for _, def := range d.Services {
+		err := def.validate()
+		if err != nil {
+			return nil, fmt.Errorf("services: %s", err)
+		}
+		if seen[def.Name] {
+			return nil, fmt.Errorf("services: %s is listed more than once", def.Name)
+		}
+		seen[def.Name] = true
+	}
+	b.services = d.Services
+
+	return b, nil
+}
+
+// crashPolicy returns the flavor's policy for handling crashes.
+func (d *FlavorDefinition) crashPolicy() (CrashPolicy, error) {
+	p := CrashPolicy{
+		Action:         CrashHang,
+		RebootDelay:    crashDefaultRebootDelay,
+		MaxConsecutive: crashDefaultMaxConsecutive,
+		Dir:            crashDefaultDir,
+	}
+
+	var err error
+	if d.CrashDir != "" {
+		p.Dir = expandFlavorValue(d.CrashDir)
+	}
+	if d.CrashAction != "" {
+		p.Action, err = ParseCrashAction(string(d.CrashAction))
+		if err != nil {
+			return p, err
+		}
+	}
+	if d.CrashMaxConsecutive < 0 || d.CrashRebootDelay < 0 {
+		return p, fmt.Errorf("crash_max_consecutive and crash_reboot_delay can't be negative")
+	}
+	if d.CrashMaxConsecutive > 0 {
+		p.MaxConsecutive = d.CrashMaxConsecutive
+	}
+	if d.CrashRebootDelay > 0 {
+		p.RebootDelay = time.Duration(d.CrashRebootDelay) * time.Second
+	}
+	return p, nil
+}
+
+// expandFlavorValue expands references to environment variables in the
+// given string, in either the $VAR or ${VAR} form, with ${VAR:-default}
+// giving a default for when the variable is unset or empty.
+func expandFlavorValue(s string) string {
+	return os.Expand(s, func(name string) string {
+		def := ""
+		if i := strings.Index(name, ":-"); i != -1 {
+			name, def = name[:i], name[i+2:]
+		}
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return def
+	})
+}
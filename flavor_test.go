@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLoadFlavors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string // no file at all if empty
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "no file",
+			want: map[string]string{
+				"dev":          "Standalone dev environment",
+				"devcontainer": builtinFlavors["devcontainer"].Description,
+				"testhost":     builtinFlavors["testhost"].Description,
+				"baremetal":    "Physical machine with static configuration",
+			},
+		},
+		{
+			name: "empty",
+			file: `{}`,
+			want: map[string]string{
+				"dev":          "Standalone dev environment",
+				"devcontainer": builtinFlavors["devcontainer"].Description,
+				"testhost":     builtinFlavors["testhost"].Description,
+				"baremetal":    "Physical machine with static configuration",
+			},
+		},
+		{
+			name: "override and add",
+			file: `{
+				"baremetal": {"description": "Our racks", "network": {"type": "dhcp"}},
+				"edge": {"description": "Edge node"}
+			}`,
+			want: map[string]string{
+				"dev":          "Standalone dev environment",
+				"devcontainer": builtinFlavors["devcontainer"].Description,
+				"testhost":     builtinFlavors["testhost"].Description,
+				"baremetal":    "Our racks",
+				"edge":         "Edge node",
+			},
+		},
+		{
+			name:    "invalid JSON",
+			file:    `{"baremetal": `,
+			wantErr: true,
+		},
+		{
+			name:    "wrong shape",
+			file:    `["baremetal"]`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "flavors.json")
+			if test.file != "" {
+				err := os.WriteFile(path, []byte(test.file), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			flavors, err := LoadFlavors(path)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var names []string
+			for name := range flavors {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if len(flavors) != len(test.want) {
+				t.Errorf("wrong flavors %q", names)
+			}
+			for name, want := range test.want {
+				def, ok := flavors[name]
+				if !ok {
+					t.Errorf("no %q flavor in %q", name, names)
+					continue
+				}
+				if def.Description != want {
+					t.Errorf("wrong description %q for %q; want %q", def.Description, name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFlavorsOverrideIsWhole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flavors.json")
+	err := os.WriteFile(path, []byte(`{"baremetal": {"description": "Our racks"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flavors, err := LoadFlavors(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// A flavor from the file replaces the built-in one of the same name
+	// rather than being merged into it, and leaves the built-in intact.
+	if got := flavors["baremetal"].Network.Type; got != "" {
+		t.Errorf("wrong network type %q; want none", got)
+	}
+	if got := builtinFlavors["baremetal"].Network.Type; got != "static" {
+		t.Errorf("built-in flavor was modified: network type %q", got)
+	}
+}
+
+func TestNewBooterInvalidFlavor(t *testing.T) {
+	flavors := map[string]*FlavorDefinition{
+		"typo": {
+			Random:  ComponentDefinition{Type: "noop"},
+			Network: ComponentDefinition{Type: "dhcp", Params: []byte(`{"Interfac": "eth0"}`)},
+		},
+		"bad-type": {
+			Random: ComponentDefinition{Type: "rdrand"},
+		},
+	}
+
+	tests := []struct {
+		flavor string
+		want   string
+	}{
+		{"missing", `unknown flavor "missing"`},
+		{"typo", `invalid flavor "typo": network: invalid params for "dhcp"`},
+		{"bad-type", `invalid flavor "bad-type": random: unknown random configurer type "rdrand"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.flavor, func(t *testing.T) {
+			_, err := NewBooter(&BootOptions{Flavor: test.flavor}, flavors)
+			if err == nil {
+				t.Fatalf("succeeded; want error")
+			}
+			if !strings.HasPrefix(err.Error(), test.want) {
+				t.Errorf("wrong error %q; want %q", err, test.want)
+			}
+		})
+	}
+}
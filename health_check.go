@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck is one way of checking whether a service is healthy. Exactly
+// one of Exec, HTTP and TCP must be set.
+//
+// The results follow Consul's conventions, so that the same checks can be
+// used in both places: a script exiting with status 0 is passing, 1 is a
+// warning and anything else is critical.
+type HealthCheck struct {
+	Name string `json:"name"`
+
+	// Exec is a command to run, with its arguments, whose exit status
+	// gives the result.
+	Exec []string `json:"exec"`
+
+	// HTTP is a URL to GET. If HTTPStatus is set then the response must
+	// have exactly that status to pass; otherwise any 2xx status passes,
+	// 429 Too Many Requests is a warning and anything else is critical.
+	HTTP       string `json:"http"`
+	HTTPStatus int    `json:"http_status"`
+
+	// TCP is a host:port that must accept connections to pass.
+	TCP string `json:"tcp"`
+
+	// Interval and Timeout are in seconds, defaulting to 10 and 5.
+	Interval int `json:"interval"`
+	Timeout  int `json:"timeout"`
+
+	// To keep a flapping service from flapping on the console too, a new
+	// result only takes effect once it has been seen this many times in
+	// a row. SuccessBeforePassing applies when the check is recovering,
+	// and FailuresBeforeCritical when it is getting worse. Both default
+	// to 1.
+	SuccessBeforePassing   int `json:"success_before_passing"`
+	FailuresBeforeCritical int `json:"failures_before_critical"`
+}
+
+const (
+	healthCheckDefaultInterval = 10 * time.Second
+	healthCheckDefaultTimeout  = 5 * time.Second
+)
+
+// How much of a check's output we keep, for the logs.
+const healthCheckMaxOutput = 4096
+
+func (hc *HealthCheck) validate() error {
+	kinds := 0
+	if len(hc.Exec) != 0 {
+		kinds++
+	}
+	if hc.HTTP != "" {
+		kinds++
+	}
+	if hc.TCP != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return fmt.Errorf("health check %q must have exactly one of exec, http and tcp", hc.Name)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.SuccessBeforePassing < 0 || hc.FailuresBeforeCritical < 0 {
+		return fmt.Errorf("health check %q has a negative setting", hc.Name)
+	}
+	return nil
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	if hc.Interval == 0 {
+		return healthCheckDefaultInterval
+	}
+	return time.Duration(hc.Interval) * time.Second
+}
+
+func (hc *HealthCheck) timeout() time.Duration {
+	if hc.Timeout == 0 {
+		return healthCheckDefaultTimeout
+	}
+	return time.Duration(hc.Timeout) * time.Second
+}
+
+// Check runs the check once, returning its result along with some output
+// explaining it.
+func (hc *HealthCheck) Check() (ServiceStatus, string) {
+	switch {
+	case len(hc.Exec) != 0:
+		return hc.checkExec()
+	case hc.HTTP != "":
+		return hc.checkHTTP()
+	default:
+		return hc.checkTCP()
+	}
+}
+
+func (hc *HealthCheck) checkExec() (ServiceStatus, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hc.Exec[0], hc.Exec[1:]...)
+	output := &limitedBuffer{Limit: healthCheckMaxOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Don't wait forever for any children that the command left holding
+	// its output open.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return ServiceCritical, fmt.Sprintf("timed out after %s", hc.timeout())
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if exitErr.ExitCode() == 1 {
+			return ServiceWarning, output.String()
+		}
+		return ServiceCritical, output.String()
+	}
+	if err != nil {
+		return ServiceCritical, err.Error()
+	}
+	return ServicePassing, output.String()
+}
+
+func (hc *HealthCheck) checkHTTP() (ServiceStatus, string) {
+	client := &http.Client{Timeout: hc.timeout()}
+	resp, err := client.Get(hc.HTTP)
+	if err != nil {
+		return ServiceCritical, err.Error()
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, healthCheckMaxOutput))
+	output := fmt.Sprintf("HTTP GET %s: %s %s", hc.HTTP, resp.Status, strings.TrimSpace(string(body)))
+
+	switch {
+	case hc.HTTPStatus != 0:
+		if resp.StatusCode == hc.HTTPStatus {
+			return ServicePassing, output
+		}
+		return ServiceCritical, output
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return ServicePassing, output
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return ServiceWarning, output
+	default:
+		return ServiceCritical, output
+	}
+}
+
+func (hc *HealthCheck) checkTCP() (ServiceStatus, string) {
+	conn, err := net.DialTimeout("tcp", hc.TCP, hc.timeout())
+	if err != nil {
+		return ServiceCritical, err.Error()
+	}
+	conn.Close()
+	return ServicePassing, fmt.Sprintf("TCP connect %s: success", hc.TCP)
+}
+
+// healthCheckState tracks the damped status of one check.
+type healthCheckState struct {
+	Status ServiceStatus
+	Output string
+
+	// The most recent result that differs from Status, and how many
+	// times in a row we've seen it.
+	pending      ServiceStatus
+	pendingCount int
+}
+
+// update records a new result, returning true if it changed the status.
+func (s *healthCheckState) update(hc *HealthCheck, status ServiceStatus, output string) bool {
+	s.Output = output
+	if status == s.Status {
+		s.pendingCount = 0
+		return false
+	}
+
+	if s.pendingCount == 0 || status != s.pending {
+		s.pending = status
+		s.pendingCount = 0
+	}
+	s.pendingCount++
+
+	threshold := hc.FailuresBeforeCritical
+	if status > s.Status {
+		threshold = hc.SuccessBeforePassing
+	}
+	if s.pendingCount < threshold {
+		return false
+	}
+
+	s.Status = status
+	s.pendingCount = 0
+	return true
+}
+
+// HealthMonitor runs a service's health checks on their intervals and
+// combines their results into the service's status, which is the worst of
+// its checks' statuses. A service with no checks is always passing.
+//
+// The status is shown on the console, and OnChange lets the service's
+// supervisor decide whether to restart it.
+type HealthMonitor struct {
+	Service string
+	Icon    ConsoleIcon
+	Console *Console
+
+	// OnChange, if set, is called whenever the service's status changes,
+	// with the output of the check that caused the change.
+	OnChange func(status ServiceStatus, output string)
+
+	checks []*HealthCheck
+
+	mutex  sync.Mutex
+	states []healthCheckState
+	status ServiceStatus
+	since  time.Time
+}
+
+// NewHealthMonitor validates the given checks and returns a monitor for
+// them. As in Consul, each check starts out critical until it passes.
+func NewHealthMonitor(service string, icon ConsoleIcon, console *Console, checks []*HealthCheck) (*HealthMonitor, error) {
+	for _, hc := range checks {
+		err := hc.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := &HealthMonitor{
+		Service: service,
+		Icon:    icon,
+		Console: console,
+		checks:  checks,
+		states:  make([]healthCheckState, len(checks)),
+		since:   time.Now(),
+	}
+	m.status = m.combinedStatus()
+	return m, nil
+}
+
+// Status returns the service's current status and when it took effect,
+// so that the supervisor can tell how long a service has been critical.
+func (m *HealthMonitor) Status() (ServiceStatus, time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status, m.since
+}
+
+// Run runs the checks until the given channel is closed.
+func (m *HealthMonitor) Run(stop <-chan struct{}) {
+	m.showStatus(m.status)
+
+	var wg sync.WaitGroup
+	for i := range m.checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.runCheck(i, stop)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (m *HealthMonitor) runCheck(i int, stop <-chan struct{}) {
+	hc := m.checks[i]
+	ticker := time.NewTicker(hc.interval())
+	defer ticker.Stop()
+
+	for {
+		status, output := hc.Check()
+		m.record(i, status, output)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record updates the state of the given check with a new result and
+// reports any resulting change in the service's status.
+func (m *HealthMonitor) record(i int, status ServiceStatus, output string) {
+	hc := m.checks[i]
+
+	m.mutex.Lock()
+	changed := m.states[i].update(hc, status, output)
+	if !changed {
+		m.mutex.Unlock()
+		return
+	}
+	if status == ServicePassing {
+		log.Printf("Health check %q for %s is passing", hc.Name, m.Service)
+	} else {
+		log.Printf("[WARNING] Health check %q for %s is %s: %s", hc.Name, m.Service, status, output)
+	}
+
+	newStatus := m.combinedStatus()
+	if newStatus == m.status {
+		m.mutex.Unlock()
+		return
+	}
+	m.status = newStatus
+	m.since = time.Now()
+	m.mutex.Unlock()
+
+	if newStatus == ServiceCritical {
+		log.Printf("[ALERT] Service %s is critical", m.Service)
+	} else {
+		log.Printf("Service %s is now %s", m.Service, newStatus)
+	}
+	m.showStatus(newStatus)
+	if m.OnChange != nil {
+		m.OnChange(newStatus, output)
+	}
+}
+
+// combinedStatus must be called with the mutex held.
+func (m *HealthMonitor) combinedStatus() ServiceStatus {
+	status := ServicePassing
+	for _, state := range m.states {
+		if state.Status < status {
+			status = state.Status
+		}
+	}
+	return status
+}
+
+func (m *HealthMonitor) showStatus(status ServiceStatus) {
+	if m.Console == nil || m.Icon == ConsoleIconNone {
+		return
+	}
+	m.Console.SetServiceStatus(m.Icon, status)
+}
+
+// limitedBuffer keeps only the first Limit bytes written to it, while
+// accepting everything so the writer doesn't fail.
+type limitedBuffer struct {
+	Limit int
+	buf   bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.Limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return strings.TrimSpace(b.buf.String())
+}
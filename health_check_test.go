@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckValidate(t *testing.T) {
+	valid := []*HealthCheck{
+		{Name: "exec", Exec: []string{"true"}},
+		{Name: "http", HTTP: "http://127.0.0.1:8500/", Interval: 30},
+		{Name: "tcp", TCP: "127.0.0.1:8300", FailuresBeforeCritical: 3},
+	}
+	for _, hc := range valid {
+		if err := hc.validate(); err != nil {
+			t.Errorf("unexpected error for %q: %s", hc.Name, err)
+		}
+	}
+
+	invalid := []*HealthCheck{
+		{Name: "none"},
+		{Name: "two", Exec: []string{"true"}, TCP: "127.0.0.1:8300"},
+		{Name: "negative", TCP: "127.0.0.1:8300", Timeout: -1},
+	}
+	for _, hc := range invalid {
+		if err := hc.validate(); err == nil {
+			t.Errorf("no error for %q", hc.Name)
+		}
+	}
+}
+
+func TestHealthCheckExec(t *testing.T) {
+	tests := []struct {
+		command []string
+		want    ServiceStatus
+		output  string
+	}{
+		{[]string{"sh", "-c", "echo ok"}, ServicePassing, "ok"},
+		{[]string{"sh", "-c", "echo slow; exit 1"}, ServiceWarning, "slow"},
+		{[]string{"sh", "-c", "echo down; exit 2"}, ServiceCritical, "down"},
+		{[]string{"/nonexistent/check"}, ServiceCritical, ""},
+	}
+
+	for _, test := range tests {
+		hc := &HealthCheck{Name: "exec", Exec: test.command}
+		got, output := hc.Check()
+		if got != test.want {
+			t.Errorf("%q: got %s; want %s", test.command, got, test.want)
+		}
+		if test.output != "" && output != test.output {
+			t.Errorf("%q: wrong output %q; want %q", test.command, output, test.output)
+		}
+	}
+}
+
+func TestHealthCheckExecTimeout(t *testing.T) {
+	hc := &HealthCheck{Name: "exec", Exec: []string{"sleep", "10"}, Timeout: 1}
+	started := time.Now()
+	got, _ := hc.Check()
+	if got != ServiceCritical {
+		t.Errorf("got %s; want critical", got)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("check took %s to time out", elapsed)
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusOK)
+		case "/busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/standby":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		want   ServiceStatus
+	}{
+		{"/ok", 0, ServicePassing},
+		{"/busy", 0, ServiceWarning},
+		{"/error", 0, ServiceCritical},
+		{"/standby", http.StatusServiceUnavailable, ServicePassing},
+		{"/ok", http.StatusServiceUnavailable, ServiceCritical},
+	}
+
+	for _, test := range tests {
+		hc := &HealthCheck{Name: "http", HTTP: server.URL + test.path, HTTPStatus: test.status}
+		got, output := hc.Check()
+		if got != test.want {
+			t.Errorf("%s (status %d): got %s; want %s: %s", test.path, test.status, got, test.want, output)
+		}
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	hc := &HealthCheck{Name: "tcp", TCP: addr}
+	if got, output := hc.Check(); got != ServicePassing {
+		t.Errorf("listening: got %s; want passing: %s", got, output)
+	}
+
+	l.Close()
+	if got, _ := hc.Check(); got != ServiceCritical {
+		t.Errorf("closed: got %s; want critical", got)
+	}
+}
+
+func TestHealthCheckStateDamping(t *testing.T) {
+	hc := &HealthCheck{SuccessBeforePassing: 2, FailuresBeforeCritical: 3}
+	state := healthCheckState{Status: ServiceCritical}
+
+	steps := []struct {
+		result  ServiceStatus
+		changed bool
+		want    ServiceStatus
+	}{
+		{ServicePassing, false, ServiceCritical},
+		{ServicePassing, true, ServicePassing},
+		{ServiceCritical, false, ServicePassing},
+		{ServiceCritical, false, ServicePassing},
+		// A passing result in between starts the count again.
+		{ServicePassing, false, ServicePassing},
+		{ServiceCritical, false, ServicePassing},
+		{ServiceCritical, false, ServicePassing},
+		{ServiceCritical, true, ServiceCritical},
+	}
+
+	for i, step := range steps {
+		changed := state.update(hc, step.result, "")
+		if changed != step.changed || state.Status != step.want {
+			t.Errorf("step %d: got %s (changed %t); want %s (changed %t)", i, state.Status, changed, step.want, step.changed)
+		}
+	}
+}
+
+func TestHealthMonitor(t *testing.T) {
+	m, err := NewHealthMonitor("test", ConsoleIconNone, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status, _ := m.Status(); status != ServicePassing {
+		t.Errorf("service with no checks is %s; want passing", status)
+	}
+
+	m, err = NewHealthMonitor("test", ConsoleIconNone, nil, []*HealthCheck{
+		{Name: "good", Exec: []string{"true"}},
+		{Name: "bad", Exec: []string{"sh", "-c", "exit 1"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status, _ := m.Status(); status != ServiceCritical {
+		t.Errorf("new service is %s; want critical", status)
+	}
+
+	changes := make(chan ServiceStatus, 10)
+	m.OnChange = func(status ServiceStatus, output string) {
+		changes <- status
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.Run(stop)
+		close(done)
+	}()
+
+	// The service is as bad as its worst check.
+	select {
+	case status := <-changes:
+		if status != ServiceWarning {
+			t.Errorf("service became %s; want warning", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("status didn't change")
+	}
+	close(stop)
+	<-done
+}
+
+func TestNewHealthMonitorInvalid(t *testing.T) {
+	_, err := NewHealthMonitor("test", ConsoleIconNone, nil, []*HealthCheck{{Name: "none"}})
+	if err == nil {
+		t.Errorf("succeeded; want error")
+	}
+}
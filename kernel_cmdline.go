@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// KernelCmdline is a parsed kernel command line, mapping each parameter
+// name to its value. Parameters given without a value, like "quiet",
+// map to the empty string.
+//
+// If a parameter appears more than once then the last value wins, as is
+// the convention for most kernel parameters.
+type KernelCmdline map[string]string
+
+const kernelCmdlinePath = "/proc/cmdline"
+
+// ReadKernelCmdline reads and parses the kernel command line from the
+// given path, which is usually kernelCmdlinePath.
+func ReadKernelCmdline(path string) (KernelCmdline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKernelCmdline(string(data)), nil
+}
+
+// ParseKernelCmdline parses the given kernel command line string.
+//
+// Like the kernel itself, we allow double quotes around values (or whole
+// parameters) so that they may contain spaces, and we stop at "--",
+// since anything after it is passed to init as arguments rather than
+// being kernel parameters.
+func ParseKernelCmdline(raw string) KernelCmdline {
+	ret := KernelCmdline{}
+
+	var param []rune
+	quoted := false
+	inQuotes := false
+	done := false
+	flush := func() {
+		if len(param) == 0 && !quoted {
+			return
+		}
+		s := string(param)
+		param = param[:0]
+		if s == "--" && !quoted {
+			done = true
+			return
+		}
+		quoted = false
+		if s == "" {
+			return
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			ret[s] = ""
+		} else {
+			ret[s[:eq]] = s[eq+1:]
+		}
+	}
+
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n'):
+			flush()
+		default:
+			param = append(param, r)
+		}
+		if done {
+			return ret
+		}
+	}
+	flush()
+
+	return ret
+}
+
+// Has returns true if the given parameter is present, with or without
+// a value.
+func (c KernelCmdline) Has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
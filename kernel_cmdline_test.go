@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKernelCmdline(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want KernelCmdline
+	}{
+		{
+			name: "empty",
+			raw:  "",
+			want: KernelCmdline{},
+		},
+		{
+			name: "values and flags",
+			raw:  "BOOT_IMAGE=/vmlinuz root=/dev/vda1 ro quiet defgrid.flavor=testhost\n",
+			want: KernelCmdline{
+				"BOOT_IMAGE":     "/vmlinuz",
+				"root":           "/dev/vda1",
+				"ro":             "",
+				"quiet":          "",
+				"defgrid.flavor": "testhost",
+			},
+		},
+		{
+			name: "extra whitespace",
+			raw:  "  a=1 \t b  \n",
+			want: KernelCmdline{"a": "1", "b": ""},
+		},
+		{
+			name: "quoted value",
+			raw:  `a="x y" b=2`,
+			want: KernelCmdline{"a": "x y", "b": "2"},
+		},
+		{
+			name: "quoted parameter",
+			raw:  `"a=x y" b`,
+			want: KernelCmdline{"a": "x y", "b": ""},
+		},
+		{
+			name: "empty quoted value",
+			raw:  `a="" b`,
+			want: KernelCmdline{"a": "", "b": ""},
+		},
+		{
+			name: "equals in value",
+			raw:  "ip=10.0.0.2::10.0.0.1:255.255.255.0 opt=a=b",
+			want: KernelCmdline{"ip": "10.0.0.2::10.0.0.1:255.255.255.0", "opt": "a=b"},
+		},
+		{
+			name: "repeated key",
+			raw:  "console=tty0 console=ttyS0,115200",
+			want: KernelCmdline{"console": "ttyS0,115200"},
+		},
+		{
+			name: "init arguments",
+			raw:  "quiet -- defgrid.flavor=dev auto",
+			want: KernelCmdline{"quiet": ""},
+		},
+		{
+			name: "quoted dashes",
+			raw:  `a "--" b`,
+			want: KernelCmdline{"a": "", "--": "", "b": ""},
+		},
+		{
+			name: "dashes in value",
+			raw:  "a=-- b",
+			want: KernelCmdline{"a": "--", "b": ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ParseKernelCmdline(test.raw)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKernelCmdlineHas(t *testing.T) {
+	cmdline := ParseKernelCmdline("quiet a=1")
+	for name, want := range map[string]bool{"quiet": true, "a": true, "b": false} {
+		if got := cmdline.Has(name); got != want {
+			t.Errorf("Has(%q) = %t; want %t", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/docker/libcontainer/netlink"
+)
+
+// LinkMonitor watches the kernel's netlink notifications for changes to
+// the network interfaces in the current NetworkConfig, showing their link
+// state on the console.
+//
+// When a link recovers after losing carrier, the network configurer is
+// asked to renew that interface's configuration right away rather than
+// waiting for its next scheduled renewal. If the Booter manages the
+// network links, any IPv4 address or default route from the NetworkConfig
+// that is deleted from under us is also put back.
+type LinkMonitor struct {
+	Booter  *Booter
+	Console *Console
+
+	// Must be held while accessing the fields below.
+	mutex  sync.Mutex
+	config *NetworkConfig
+
+	// Indexed by interface index, since that stays the same if an
+	// interface is renamed.
+	links map[int]*monitoredLink
+}
+
+type monitoredLink struct {
+	// name is the name the interface was configured under, which is the
+	// name the NetworkConfig knows it by.
+	name string
+
+	// currentName is the name the kernel most recently reported.
+	currentName string
+
+	up bool
+}
+
+// The netlink multicast groups we subscribe to, from linux/rtnetlink.h,
+// which the syscall package doesn't define.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+)
+
+// If the netlink socket fails we'll wait this long before trying again.
+const linkMonitorRetryInterval = 10 * time.Second
+
+// NewLinkMonitor returns a monitor for the interfaces in the given
+// network configuration.
+func NewLinkMonitor(booter *Booter, console *Console, netConfig *NetworkConfig) *LinkMonitor {
+	m := &LinkMonitor{
+		Booter:  booter,
+		Console: console,
+		links:   map[int]*monitoredLink{},
+	}
+	m.SetConfig(netConfig)
+	return m
+}
+
+// SetConfig replaces the network configuration that the monitor compares
+// the kernel's state against, such as after a DHCP lease renewal.
+func (m *LinkMonitor) SetConfig(netConfig *NetworkConfig) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.config = netConfig
+
+	// Interfaces might have been added, but we don't know their indexes
+	// yet. We'll learn them when we next see a link message.
+	for name := range linkConfigs(netConfig) {
+		if m.linkByName(name) != nil {
+			continue
+		}
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Printf("[WARNING] Can't monitor %s: %s", name, err)
+			continue
+		}
+		m.links[iface.Index] = &monitoredLink{
+			name:        name,
+			currentName: name,
+			up:          iface.Flags&net.FlagUp != 0,
+		}
+	}
+}
+
+// Run monitors the network links forever, and so should usually be run
+// in its own goroutine.
+func (m *LinkMonitor) Run() {
+	for {
+		err := m.monitor()
+		log.Printf("[ERROR] Network link monitoring failed: %s", err)
+		m.Console.SetWarning("link-monitor", "Link monitoring failed; see log")
+		time.Sleep(linkMonitorRetryInterval)
+	}
+}
+
+// monitor subscribes to netlink notifications and then handles them
+// until something goes wrong.
+func (m *LinkMonitor) monitor() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv4Route,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Now that we're subscribed we won't miss any changes, so we can get
+	// the current state of the links without a race.
+	err = m.sync()
+	if err != nil {
+		return err
+	}
+	m.Console.SetWarning("link-monitor", "")
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.ENOBUFS {
+			// The kernel dropped some notifications because we didn't
+			// keep up, so we'll need to check everything again.
+			log.Printf("[WARNING] Missed some network link notifications")
+			err = m.sync()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for i := range msgs {
+			m.handleMessage(&msgs[i])
+		}
+	}
+}
+
+// sync fetches the state of all links from the kernel and handles it as
+// if it had arrived as notifications, and then checks that the config
+// is still in place on every link that is up.
+func (m *LinkMonitor) sync() error {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		if msgs[i].Header.Type == syscall.RTM_NEWLINK {
+			m.handleLink(&msgs[i])
+		}
+	}
+
+	m.mutex.Lock()
+	var indexes []int
+	for index, link := range m.links {
+		if link.up {
+			indexes = append(indexes, index)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, index := range indexes {
+		m.repair(index)
+	}
+
+	m.refreshConsole()
+	return nil
+}
+
+func (m *LinkMonitor) handleMessage(msg *syscall.NetlinkMessage) {
+	switch msg.Header.Type {
+	case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+		m.handleLink(msg)
+
+	case syscall.RTM_DELADDR:
+		if len(msg.Data) < syscall.SizeofIfAddrmsg {
+			return
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+		m.repair(int(ifa.Index))
+
+	case syscall.RTM_DELROUTE:
+		if len(msg.Data) < syscall.SizeofRtMsg {
+			return
+		}
+		rtm := (*syscall.RtMsg)(unsafe.Pointer(&msg.Data[0]))
+		if rtm.Dst_len != 0 || rtm.Table != syscall.RT_TABLE_MAIN {
+			// We only restore default routes.
+			return
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+		if err != nil {
+			return
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == syscall.RTA_OIF && len(attr.Value) >= 4 {
+				m.repair(int(*(*uint32)(unsafe.Pointer(&attr.Value[0]))))
+			}
+		}
+	}
+}
+
+// handleLink deals with a message describing a new or changed link,
+// noticing if one of our links has changed state or been renamed.
+func (m *LinkMonitor) handleLink(msg *syscall.NetlinkMessage) {
+	if len(msg.Data) < syscall.SizeofIfInfomsg {
+		return
+	}
+	ifi := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+	index := int(ifi.Index)
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		return
+	}
+	var name string
+	for _, attr := range attrs {
+		if attr.Attr.Type == syscall.IFLA_IFNAME {
+			name = strings.TrimRight(string(attr.Value), "\x00")
+		}
+	}
+
+	deleted := msg.Header.Type == syscall.RTM_DELLINK
+	up := !deleted &&
+		ifi.Flags&syscall.IFF_UP != 0 &&
+		ifi.Flags&syscall.IFF_RUNNING != 0
+
+	m.mutex.Lock()
+	link := m.links[index]
+	if link == nil {
+		// An interface we're supposed to be managing may have been
+		// deleted and then recreated with a new index.
+		if _, managed := linkConfigs(m.config)[name]; !managed || m.linkByName(name) != nil {
+			m.mutex.Unlock()
+			return
+		}
+		link = &monitoredLink{name: name, currentName: name}
+		m.links[index] = link
+	}
+
+	renamed := false
+	if name != "" && name != link.currentName {
+		link.currentName = name
+		renamed = true
+	}
+
+	recovered := up && !link.up
+	lost := link.up && !up
+	link.up = up
+	if deleted {
+		delete(m.links, index)
+	}
+	m.mutex.Unlock()
+
+	if renamed {
+		// Each interface has its own warning, separate from monitoring
+		// failures, so that neither clears another's.
+		source := "link-rename-" + link.name
+		if name == link.name {
+			log.Printf("Interface %s has its original name again", link.name)
+			m.Console.SetWarning(source, "")
+		} else {
+			log.Printf("[WARNING] Interface %s was renamed to %s", link.name, name)
+			m.Console.SetWarning(source, fmt.Sprintf("%s was renamed to %s", link.name, name))
+		}
+	}
+
+	if deleted {
+		log.Printf("[WARNING] Interface %s was deleted", link.name)
+	} else if lost {
+		log.Printf("[WARNING] Interface %s lost its link", link.name)
+	}
+
+	if recovered {
+		log.Printf("Interface %s link is up", link.name)
+
+		err := m.Booter.RenewNetworkInterface(link.name)
+		if err != nil {
+			log.Printf("[ERROR] Failed to renew configuration for %s: %s", link.name, err)
+		}
+
+		m.repair(index)
+	}
+
+	if renamed || deleted || lost || recovered {
+		m.refreshConsole()
+	}
+}
+
+// repair puts back any IPv4 address or default route from the current
+// config that is missing from the interface with the given index, if
+// the interface is one of ours and its link is up.
+//
+// IPv6 addresses are left alone since they are maintained by the kernel
+// or the DHCPv6 client, which will put them back themselves.
+func (m *LinkMonitor) repair(index int) {
+	if !m.Booter.ManagesLinks() {
+		return
+	}
+
+	m.mutex.Lock()
+	link := m.links[index]
+	if link == nil || !link.up {
+		m.mutex.Unlock()
+		return
+	}
+	ifaceName := link.currentName
+	config := linkConfigs(m.config)[link.name]
+	isPrimary := link.name == m.config.Interface
+	m.mutex.Unlock()
+
+	if config == nil {
+		return
+	}
+
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		log.Printf("[ERROR] Can't check configuration of %s: %s", ifaceName, err)
+		return
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		log.Printf("[ERROR] Can't check addresses of %s: %s", ifaceName, err)
+		return
+	}
+
+	for _, want := range config.Addresses {
+		if want.IP.To4() == nil || interfaceHasAddress(addrs, want.IP) {
+			continue
+		}
+
+		log.Printf("[WARNING] Address %s was removed from %s; restoring it", want, ifaceName)
+		err := netlink.NetworkLinkAddIp(iface, want.IP, want)
+		if err != nil && err != syscall.EEXIST {
+			log.Printf("[ERROR] Failed to restore address %s on %s: %s", want, ifaceName, err)
+		}
+	}
+
+	// Only the primary interface gets the default route, since the other
+	// interfaces are for reaching specific networks.
+	if !isPrimary {
+		return
+	}
+
+	var gateway net.IP
+	for _, router := range config.Routers {
+		if router.To4() != nil {
+			gateway = router
+			break
+		}
+	}
+	if gateway == nil {
+		return
+	}
+
+	routes, err := getDefaultRoutes(syscall.AF_INET)
+	if err != nil {
+		log.Printf("[ERROR] Can't check default route: %s", err)
+		return
+	}
+	for _, route := range routes {
+		if route.Interface.Index == index && route.Gateway.Equal(gateway) {
+			return
+		}
+	}
+
+	log.Printf("[WARNING] Default route via %s was removed; restoring it", gateway)
+	err = netlink.AddDefaultGw(gateway.String(), ifaceName)
+	if err != nil && err != syscall.EEXIST {
+		log.Printf("[ERROR] Failed to restore default route via %s: %s", gateway, err)
+	}
+}
+
+func (m *LinkMonitor) refreshConsole() {
+	m.mutex.Lock()
+	var states []string
+	for _, link := range m.links {
+		state := "down"
+		if link.up {
+			state = "up"
+		}
+		states = append(states, fmt.Sprintf("%s %s", link.name, state))
+	}
+	m.mutex.Unlock()
+
+	sort.Strings(states)
+	m.Console.SetLinkState(strings.Join(states, ", "))
+}
+
+// linkByName finds the link that was configured under the given name.
+// The caller must hold the mutex.
+func (m *LinkMonitor) linkByName(name string) *monitoredLink {
+	for _, link := range m.links {
+		if link.name == name {
+			return link
+		}
+	}
+	return nil
+}
+
+// linkConfigs returns the configuration for each interface in the given
+// network config, keyed by interface name.
+func linkConfigs(netConfig *NetworkConfig) map[string]*NetworkConfig {
+	ret := map[string]*NetworkConfig{}
+	if len(netConfig.Interfaces) == 0 {
+		if netConfig.Interface != "" {
+			ret[netConfig.Interface] = netConfig
+		}
+		return ret
+	}
+	for _, ifaceConfig := range netConfig.Interfaces {
+		ret[ifaceConfig.Interface] = ifaceConfig
+	}
+	return ret
+}
+
+func interfaceHasAddress(addrs []net.Addr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
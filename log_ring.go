@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// LogRing is an io.Writer that remembers the most recent lines written to
+// it, so that they can be included in a crash report even when the log
+// device itself isn't persistent.
+type LogRing struct {
+	lines   []string
+	next    int
+	full    bool
+	partial []byte
+	mutex   sync.Mutex
+}
+
+// How many lines of log the crash report includes.
+const logRingLines = 200
+
+func NewLogRing(size int) *LogRing {
+	return &LogRing{
+		lines: make([]string, size),
+	}
+}
+
+func (r *LogRing) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	data := append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		r.lines[r.next] = string(data[:i])
+		r.next = (r.next + 1) % len(r.lines)
+		if r.next == 0 {
+			r.full = true
+		}
+		data = data[i+1:]
+	}
+	r.partial = append([]byte(nil), data...)
+
+	return len(p), nil
+}
+
+// Lines returns the remembered lines, oldest first.
+func (r *LogRing) Lines() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	ret := make([]string, 0, len(r.lines))
+	ret = append(ret, r.lines[r.next:]...)
+	return append(ret, r.lines[:r.next]...)
+}
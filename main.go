@@ -5,12 +5,21 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
 	"time"
 )
 
 func main() {
+	// We re-execute ourselves to start services, in which case we're not
+	// init and shouldn't boot anything.
+	if IsServiceExec() {
+		RunServiceExec()
+	}
+
 	// Trap if we return from this function, e.g. due to a panic, and
 	// prevent the program from actually exiting so we don't panic
 	// the kernel.
@@ -20,9 +29,33 @@ func main() {
 		log.Printf("[FATAL] %s\n%s", err, stack)
 	})
 
-	booter := NewBooter(os.Args[1])
-	if booter == nil {
-		panic(fmt.Errorf("unknown flavor %q", os.Args[1]))
+	// When we're init, nobody has mounted /proc and /sys for us, and we
+	// need them to read the boot options and detect the platform.
+	if os.Getpid() == 1 {
+		err := MountKernelFilesystems()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	bootOpts, err := ReadBootOptions(kernelCmdlinePath, os.Args[1:], &PlatformDetector{})
+	if err != nil {
+		panic(err)
+	}
+
+	flavors, err := LoadFlavors(bootOpts.FlavorsPath)
+	if err != nil {
+		panic(err)
+	}
+
+	booter, err := NewBooter(bootOpts, flavors)
+	if err != nil {
+		panic(err)
+	}
+
+	err = booter.MountFilesystems()
+	if err != nil {
+		panic(err)
 	}
 
 	console, err := booter.Console()
@@ -41,75 +74,276 @@ func main() {
 		console.FatalError(err)
 	})
 
-	log.SetOutput(io.MultiWriter(logWriter, console.LogWriter()))
+	logRing := NewLogRing(logRingLines)
+	log.SetOutput(io.MultiWriter(logWriter, console.LogWriter(), logRing))
 
-	bootStatus := func(s string) {
-		log.Println(s)
-		console.BootStatusMessage = s
-		console.Refresh()
+	crashRecovery := &CrashRecovery{
+		Policy:  booter.CrashPolicy(),
+		Flavor:  bootOpts.Flavor,
+		Console: console,
+		Log:     logRing,
 	}
+	panicHandler.Recovery = crashRecovery
 
-	bootStatus("Configuring PRNG...")
-	err = booter.ConfigurePRNG()
-	if err != nil {
-		panic(err)
+	log.Printf("Booting flavor %q", bootOpts.Flavor)
+	for _, reason := range bootOpts.FlavorReasons {
+		log.Printf("Flavor choice: %s", reason)
+	}
+	if booter.Debug() {
+		log.Printf("Boot options: %+v", *bootOpts)
 	}
 
-	bootStatus("Generating host key...")
-	// Not used yet; will come later when we add SSH server and
-	// TLS-based services.
-	_, err = booter.GenerateHostKey()
-	if err != nil {
-		panic(err)
+	var netConfig *NetworkConfig
+	var nodeConfig *NodeConfig
+
+	report := NewBootReport(bootOpts.Flavor)
+	panicHandler.AddAction(func(err error, stack string) {
+		report.LogSummary()
+		writeBootReport(report)
+	})
+
+	// Each step of the boot process is recorded in the boot report.
+	// Critical steps that fail even after retrying are fatal, but
+	// optional steps only leave the system degraded.
+	//
+	// Steps run as soon as the steps they come after are finished, so
+	// e.g. we generate the host key while the network is coming up.
+	bootSteps := []*BootStep{
+		{
+			// Not optional, since the host key generated next is only as
+			// good as the randomness behind it.
+			Name:   "prng",
+			Status: "Configuring PRNG...",
+			Retry:  retryLocal,
+			Run:    booter.ConfigurePRNG,
+		},
+		{
+			Name:   "host-key",
+			After:  []string{"prng"},
+			Status: "Generating host key...",
+			Retry:  retryNever,
+			Run: func() error {
+				// Not used yet; will come later when we add SSH server
+				// and TLS-based services.
+				_, err := booter.GenerateHostKey()
+				return err
+			},
+		},
+		{
+			Name:   "network",
+			After:  []string{"prng"},
+			Status: "Configuring network...",
+			Retry:  retryNetwork,
+			Run: func() error {
+				var err error
+				netConfig, err = booter.ConfigureNetwork()
+				if err != nil {
+					return err
+				}
+				subnetPrefix, _ := netConfig.SubnetMask.Size()
+				log.Printf("Network Up: %s/%d", netConfig.IPAddress, subnetPrefix)
+				for _, addr := range netConfig.Addresses {
+					if !addr.IP.Equal(netConfig.IPAddress) {
+						log.Printf("Additional address: %s", addr)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:     "early-resolver",
+			After:    []string{"network"},
+			Status:   "Configuring system resolver...",
+			Retry:    retryLocal,
+			Optional: true,
+			Run: func() error {
+				return booter.EarlyConfigureResolver(netConfig)
+			},
+		},
+		{
+			Name:   "network-check",
+			After:  []string{"early-resolver"},
+			Status: "Checking network connectivity...",
+			// AwaitNetworkChecks does its own retrying.
+			Retry:    retryNever,
+			Optional: true,
+			Run: func() error {
+				if !AwaitNetworkChecks(booter, console, netConfig) {
+					return fmt.Errorf("some network checks failed")
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "node-config",
+			After:  []string{"network-check"},
+			Status: "Getting node configuration...",
+			Retry:  retryNetwork,
+			Run: func() error {
+				var err error
+				nodeConfig, err = booter.GetNodeConfig(netConfig)
+				if err != nil {
+					return err
+				}
+				log.Printf("Node identity: %q, in region %q", nodeConfig.Hostname, nodeConfig.RegionName)
+				return nil
+			},
+		},
+		{
+			Name:     "resolver",
+			After:    []string{"node-config"},
+			Status:   "Re-configuring system resolver...",
+			Retry:    retryLocal,
+			Optional: true,
+			Run: func() error {
+				return booter.ConfigureResolver(netConfig, nodeConfig)
+			},
+		},
+		{
+			Name:     "cgroups",
+			Status:   "Setting up cgroups...",
+			Retry:    retryNever,
+			Optional: true,
+			Run:      booter.SetupCgroups,
+		},
+		{
+			Name:   "services",
+			After:  []string{"host-key", "resolver", "cgroups"},
+			Status: "Starting services...",
+			Retry:  retryNever,
+			Run: func() error {
+				linkMonitor := NewLinkMonitor(booter, console, netConfig)
+				go linkMonitor.Run()
+
+				watcher := NewNetworkWatcher(booter, console, netConfig, nodeConfig)
+				watcher.LinkMonitor = linkMonitor
+				go watcher.Run()
+
+				return booter.StartServices(console)
+			},
+		},
+	}
+
+	// Configuring the network can take a long time, so the configurer
+	// may explain on the console what it's waiting for.
+	for _, step := range bootSteps {
+		if step.Name == "network" {
+			booter.SetNetworkStatusFunc(step.SetStatus)
+		}
 	}
 
-	bootStatus("Configuring network...")
-	netConfig, err := booter.ConfigureNetwork()
+	err = RunBootSteps(report, console, bootSteps)
 	if err != nil {
 		panic(err)
 	}
-	_, subnetPrefix := netConfig.SubnetMask.Size()
-	log.Printf("Network Up: %s/%d", netConfig.IPAddress, subnetPrefix)
 
-	bootStatus("Configuring system resolver...")
+	report.Finish()
+	report.LogSummary()
+	writeBootReport(report)
 
-	err = booter.EarlyConfigureResolver(netConfig)
+	var ipv6Addr net.IP
+	if ipv6Addrs := netConfig.IPv6Addresses(); len(ipv6Addrs) > 0 {
+		ipv6Addr = ipv6Addrs[0]
+	}
+	console.SetRuntimeInfo("Dev System", netConfig.IPAddress, ipv6Addr, nodeConfig.Hostname, nodeConfig.RegionName)
+
+	// We only start the watchdog once boot is complete, since nothing
+	// would pet it during boot.
+	watchdog, err := booter.OpenWatchdog()
 	if err != nil {
-		panic(err)
+		log.Printf("[ERROR] Failed to open watchdog: %s", err)
+	}
+	petInterval := time.Hour
+	if watchdog != nil {
+		log.Printf("Watchdog %s armed with timeout %s", watchdog.Path, watchdog.Timeout)
+		petInterval = watchdog.PetInterval()
 	}
 
-	bootStatus("Getting node configuration...")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	nodeConfig, err := booter.GetNodeConfig(netConfig)
-	if err != nil {
-		panic(err)
+	// This is our main event loop. The watchdog is petted from here,
+	// rather than from a goroutine of its own, so that the system will
+	// be reset if the loop wedges.
+	ticker := time.NewTicker(petInterval)
+	unhealthy := false
+	stable := time.After(crashStableUptime)
+	for {
+		select {
+		case <-stable:
+			err := crashRecovery.ResetCount()
+			if err != nil {
+				log.Printf("[WARNING] Failed to reset crash count: %s", err)
+			}
+
+		case <-ticker.C:
+			if watchdog == nil {
+				continue
+			}
+			err := systemHealth(console, booter.Supervisors())
+			if err != nil {
+				if !unhealthy {
+					log.Printf("[ALERT] No longer petting the watchdog: %s", err)
+					unhealthy = true
+				}
+				continue
+			}
+			if unhealthy {
+				log.Printf("System is healthy again; petting the watchdog")
+				unhealthy = false
+			}
+			err = watchdog.Pet()
+			if err != nil {
+				log.Printf("[ERROR] Failed to pet watchdog: %s", err)
+			}
+
+		case sig := <-signals:
+			shutdown(sig, booter, watchdog)
+		}
 	}
-	log.Printf("Node identity: %q, in region %q", nodeConfig.Hostname, nodeConfig.RegionName)
+}
 
-	bootStatus("Re-configuring system resolver...")
+// shutdown stops the system in an orderly way in response to the given
+// signal. In the flavors where we're the system's init this powers off
+// the system; otherwise we just exit.
+func shutdown(sig os.Signal, booter *Booter, watchdog *Watchdog) {
+	log.Printf("Shutting down on %s", sig)
 
-	err = booter.ConfigureResolver(netConfig, nodeConfig)
-	if err != nil {
-		panic(err)
+	booter.StopServices()
+
+	if watchdog != nil {
+		err := watchdog.Close()
+		if err != nil {
+			log.Printf("[ERROR] Failed to disarm watchdog: %s", err)
+		}
 	}
 
-	console.BootStatusMessage = ""
-	console.SystemRoleName = "Dev System"
-	console.IPAddress = netConfig.IPAddress
-	console.Hostname = nodeConfig.Hostname
-	console.RegionName = nodeConfig.RegionName
-	console.Refresh()
+	if !booter.PowersOff() {
+		os.Exit(0)
+	}
 
-	// TODO: Eventually this will be our main event loop, but we
-	// don't have any events right now so we'll just pause here
-	// and do nothing.
-	for {
-		time.Sleep(3600)
+	syscall.Sync()
+	err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	// Exiting is the best we can do, such as in a container without
+	// CAP_SYS_BOOT. As PID 1 that still stops the system, by way of a
+	// kernel panic if need be.
+	log.Printf("[ERROR] Failed to power off: %s", err)
+	os.Exit(0)
+}
+
+func writeBootReport(report *BootReport) {
+	err := report.WriteFile(bootReportPath)
+	if err != nil {
+		log.Printf("[WARNING] Failed to write boot report: %s", err)
 	}
 }
 
 type PanicHandler struct {
 	actions []PanicAction
+
+	// If Recovery is set, it's used to record the crash once the actions
+	// are done, and may reboot the system rather than hanging.
+	Recovery *CrashRecovery
 }
 
 type PanicAction func(err error, stack string)
@@ -122,7 +356,7 @@ func (h *PanicHandler) AddAction(action PanicAction) {
 //
 // If the main function ever exits, it will call the configured panic actions
 // and then intentionally hang the program forever, thus preventing it from
-// exiting.
+// exiting, unless the crash recovery policy says to reboot instead.
 //
 // If we are exiting due to a panic, the panic error will be passed to the
 // actions. Otherwise, the error will merely be that the program exited.
@@ -162,6 +396,10 @@ func (h *PanicHandler) OnExit() {
 		}
 	}
 
+	if h.Recovery != nil {
+		h.Recovery.Recover(err, trace)
+	}
+
 	// Hang out here forever
 	for {
 		time.Sleep(3600)
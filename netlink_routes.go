@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// defaultRoute describes one default route from the kernel's main routing
+// table.
+type defaultRoute struct {
+	Gateway   net.IP
+	Interface *net.Interface
+	Metric    uint32
+}
+
+// getDefaultRoutes asks the kernel over netlink for the default routes of
+// the given address family (syscall.AF_INET or syscall.AF_INET6) in the
+// main routing table, returning them ordered with the preferred route
+// (the one with the lowest metric) first.
+//
+// The vendored netlink package can list routes too, but it doesn't
+// report the gateway, which is the main thing we're interested in here.
+func getDefaultRoutes(family int) ([]defaultRoute, error) {
+	data, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []defaultRoute
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+
+		rtm := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if int(rtm.Family) != family || rtm.Dst_len != 0 {
+			continue
+		}
+		if rtm.Table != syscall.RT_TABLE_MAIN || rtm.Type != syscall.RTN_UNICAST {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return nil, err
+		}
+
+		var route defaultRoute
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				route.Gateway = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				if len(attr.Value) < 4 {
+					continue
+				}
+				index := *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+				route.Interface, err = net.InterfaceByIndex(int(index))
+				if err != nil {
+					return nil, err
+				}
+			case syscall.RTA_PRIORITY:
+				if len(attr.Value) < 4 {
+					continue
+				}
+				route.Metric = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+			}
+		}
+
+		// Multipath routes have no single output interface, and we don't
+		// attempt to make sense of them here.
+		if route.Interface == nil {
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Metric < routes[j].Metric
+	})
+
+	return routes, nil
+}
@@ -5,9 +5,24 @@ import (
 )
 
 type NetworkConfig struct {
+	// Interface is the name of the network interface this configuration
+	// was applied to, if the configurer knows it.
+	Interface string
+
+	// IPAddress and SubnetMask describe the node's primary address, which
+	// is the one used to derive its identity. This is an IPv4 address
+	// whenever the node has one.
 	IPAddress  net.IP
 	SubnetMask net.IPMask
-	Routers    []net.IP
+
+	// Addresses lists all of the addresses assigned to the node from
+	// both address families, including the primary address.
+	Addresses []*net.IPNet
+
+	BroadcastAddress net.IP
+	Routers          []net.IP
+	StaticRoutes     []NetworkRoute
+	MTU              int
 
 	// The NetworkConfig layer returns the resolver-related config
 	// coming from the network if any, but the resolver configurer
@@ -17,9 +32,44 @@ type NetworkConfig struct {
 	// resolver suggestions; it just returns verbatim what was
 	// suggested by the network, if anything, as a hint or fallback
 	// for later configuration.
-	SuggestedHostname    string
-	SuggestedDomainName  string
-	SuggestedNameservers []net.IP
+	SuggestedHostname      string
+	SuggestedDomainName    string
+	SuggestedNameservers   []net.IP
+	SuggestedSearchDomains []string
+
+	// Likewise, the network may suggest time servers. Nothing is done
+	// with these at the network layer.
+	SuggestedNTPServers []net.IP
+
+	// Interfaces describes each interface separately when the node has
+	// more than one, as configured by NetworkConfigurerMulti, with the
+	// primary interface first. The other fields then describe the primary
+	// interface, except that Addresses includes the addresses of all of
+	// the interfaces.
+	//
+	// This is nil if only a single interface was configured.
+	Interfaces []*NetworkConfig
+}
+
+// IPv6Addresses returns the IPv6 addresses from Addresses.
+func (c *NetworkConfig) IPv6Addresses() []net.IP {
+	var ret []net.IP
+	for _, addr := range c.Addresses {
+		if addr.IP.To4() == nil {
+			ret = append(ret, addr.IP)
+		}
+	}
+	return ret
+}
+
+// NetworkRoute is a route to a specific destination network, in addition
+// to the default route via Routers.
+//
+// If Gateway is nil then the destination is reachable directly on the
+// local link.
+type NetworkRoute struct {
+	Destination *net.IPNet
+	Gateway     net.IP
 }
 
 // NetworkConfigurer implementations obtain IP configuration from
@@ -1,73 +1,585 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"gopkg.in/vmihailenco/msgpack.v2"
+	"github.com/defgrid/defgrid-init/dhcpmsg"
 )
 
 // NetworkConfigurerDHCP is a NetworkConfigurer implementation that
 // obtains a DHCP lease and configures the network stack based on that.
 //
+// The actual DHCP work is done by the dhcpclient child process, which
+// this configurer supervises: if the child exits for any reason it is
+// restarted after a delay, asking for the same address it held before
+// so that the node keeps its IP address across restarts.
+//
 // In order to keep renewing the DHCP lease, the caller *must* keep
 // calling ConfigureNetwork in the background. After the first call,
 // ConfigureNetwork will block until the lease is renewed.
 type NetworkConfigurerDHCP struct {
 	Interface string
 
-	leaseDecoder *msgpack.Decoder
+	// ClientID, if set, is sent to the DHCP server as the client identifier.
+	// A value prefixed with "hex:" is decoded and sent verbatim (including
+	// the type octet), allowing e.g. a DUID-based identifier. Otherwise
+	// the string is sent as an opaque identifier.
+	ClientID string
+
+	// Hostname, if set, is sent to the DHCP server as the host name.
+	Hostname string
+
+	// VendorClass, if set, overrides the vendor class identifier sent
+	// to the DHCP server, which otherwise defaults to "defgrid".
+	VendorClass string
+
+	// RequestOptions, if set, overrides the list of DHCP option codes
+	// requested from the server.
+	RequestOptions []byte
+
+	// IPv6Mode selects how the DHCP client configures IPv6 alongside
+	// the IPv4 lease: "off" (the default if empty), "slaac" to use router
+	// advertisements, or "dhcpv6" to also obtain addresses via DHCPv6.
+	IPv6Mode string
+
+	// IPv6Only skips DHCPv4 entirely, for links with no IPv4 service at
+	// all, and so requires an IPv6Mode. The node's primary address is
+	// then its first global IPv6 address.
+	IPv6Only bool
+
+	// IPv4Wait is how long to wait for an IPv4 lease once IPv6 is
+	// configured before making do with an IPv6-only configuration, which
+	// defaults to dhcpIPv4Wait. An IPv4 lease that arrives later replaces
+	// it, since the primary address is an IPv4 address whenever the node
+	// has one.
+	IPv4Wait time.Duration
+
+	// LinkLocalFallback, if non-zero, is how long to wait for the first
+	// DHCP lease before assigning an IPv4 link-local address, so that the
+	// node can at least be reached from elsewhere on the local link while
+	// we keep waiting. The link-local address is removed once a lease
+	// arrives, and is never returned from ConfigureNetwork since it isn't
+	// suitable as the node's identity.
+	LinkLocalFallback time.Duration
+
+	// NoDefaultRoute stops the default route being taken from the lease
+	// or from IPv6 router advertisements, for an interface other than
+	// the one that should carry the node's default route.
+	NoDefaultRoute bool
+
+	// Only ever holds the most recent configuration, so that a slow
+	// consumer doesn't block the child from renewing.
+	configs chan *NetworkConfig
+
+	// Only accessed by the supervisor goroutine.
+	lastLease   *dhcpmsg.Lease
+	lastLease6  *dhcpmsg.Lease6
+	ipv4Overdue bool
+
+	warn       func(msg string)
+	bootStatus func(msg string)
+
+	// Must be held while accessing the fields below.
+	mutex    sync.Mutex
+	commands *dhcpmsg.Encoder
+	stopped  bool
 }
 
+const dhcpClientPath = "/usr/lib/defgrid-init/dhcpclient"
+
+// After this many consecutive failures of the child process we'll start
+// warning on the console that something is wrong.
+const dhcpClientWarnFailures = 3
+
+// The delay before restarting the child doubles after each consecutive
+// failure, up to this limit.
+const dhcpClientMaxBackoff = 60 * time.Second
+
+// The default for IPv4Wait.
+const dhcpIPv4Wait = 30 * time.Second
+
 func (cer *NetworkConfigurerDHCP) ConfigureNetwork() (*NetworkConfig, error) {
 
-	// On the first call we'll launch the DHCP client as a child
-	// process, and then we'll monitor it via subsequent calls.
-	if cer.leaseDecoder == nil {
-		leaseRead, leaseWrite := io.Pipe()
-		cmd := exec.Command("/usr/lib/defgrid-init/dhcpclient", "eth0")
-		cmd.Stdout = leaseWrite
-		cmd.Stderr = os.Stderr
+	// On the first call we'll launch the DHCP client supervisor, and then
+	// we'll monitor it via subsequent calls.
+	if cer.configs == nil {
+		if cer.Interface == "" {
+			return nil, fmt.Errorf("no interface configured for DHCP")
+		}
+		if cer.IPv6Only && (cer.IPv6Mode == "" || cer.IPv6Mode == "off") {
+			return nil, fmt.Errorf("IPv6Only requires an IPv6Mode")
+		}
+
+		cer.configs = make(chan *NetworkConfig, 1)
+		go cer.supervise()
+
+		if cer.LinkLocalFallback > 0 {
+			return cer.awaitFirstLease()
+		}
+	}
+
+	config, ok := <-cer.configs
+	if !ok {
+		return nil, fmt.Errorf("DHCP client for %s has been stopped", cer.Interface)
+	}
+
+	return config, nil
+}
+
+// awaitFirstLease waits for the first lease, configuring a link-local
+// address in the meantime if the lease takes longer than
+// LinkLocalFallback to arrive.
+func (cer *NetworkConfigurerDHCP) awaitFirstLease() (*NetworkConfig, error) {
+	var config *NetworkConfig
+	var ok bool
+
+	select {
+	case config, ok = <-cer.configs:
+	case <-time.After(cer.LinkLocalFallback):
+		log.Printf(
+			"[WARNING] No DHCP lease for %s after %s; falling back to a link-local address",
+			cer.Interface, cer.LinkLocalFallback,
+		)
+
+		// The DHCP client keeps trying while we do this, and any lease
+		// it gets will wait in the channel for us.
+		addr, err := claimLinkLocalAddress(cer.Interface)
+		if err != nil {
+			log.Printf("[ERROR] Failed to configure link-local address on %s: %s", cer.Interface, err)
+			config, ok = <-cer.configs
+			break
+		}
+
+		log.Printf("Configured link-local address %s on %s", addr, cer.Interface)
+		cer.warning(fmt.Sprintf("No DHCP lease yet; reachable at %s", addr.IP))
+		if cer.bootStatus != nil {
+			cer.bootStatus(fmt.Sprintf(
+				"Waiting for DHCP on %s; reachable at %s", cer.Interface, addr.IP,
+			))
+		}
+
+		config, ok = <-cer.configs
+
+		err = releaseLinkLocalAddress(cer.Interface, addr)
+		if err != nil {
+			log.Printf("[ERROR] Failed to remove link-local address %s from %s: %s", addr, cer.Interface, err)
+		}
+		cer.warning("")
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("DHCP client for %s has been stopped", cer.Interface)
+	}
+	return config, nil
+}
+
+// SetWarningFunc implements warningReporter.
+func (cer *NetworkConfigurerDHCP) SetWarningFunc(warn func(msg string)) {
+	cer.warn = warn
+}
+
+// SetBootStatusFunc implements bootStatusReporter.
+func (cer *NetworkConfigurerDHCP) SetBootStatusFunc(fn func(msg string)) {
+	cer.bootStatus = fn
+}
+
+func (cer *NetworkConfigurerDHCP) warning(msg string) {
+	if cer.warn != nil {
+		cer.warn(msg)
+	}
+}
+
+// supervise runs the DHCP client child process, restarting it with
+// increasing delays whenever it exits, until Stop is called.
+func (cer *NetworkConfigurerDHCP) supervise() {
+	failures := 0
+
+	for {
+		gotLease := false
+		var err error
+		if !cer.isStopped() {
+			gotLease, err = cer.runClient()
+		}
+
+		if cer.isStopped() {
+			log.Printf("DHCP client for %s has stopped", cer.Interface)
+			close(cer.configs)
+			return
+		}
+
+		if gotLease {
+			// The client was working for a while, so this is a fresh
+			// problem rather than a continuation of an earlier one.
+			failures = 0
+		}
+		failures++
+
+		if err != nil {
+			log.Printf("[ERROR] DHCP client for %s failed: %s", cer.Interface, err)
+		} else {
+			log.Printf("[WARNING] DHCP client for %s has exited", cer.Interface)
+			err = fmt.Errorf("exited unexpectedly")
+		}
+
+		if failures >= dhcpClientWarnFailures {
+			cer.warning(fmt.Sprintf(
+				"DHCP client for %s keeps failing: %s", cer.Interface, err,
+			))
+		}
+
+		delay := time.Second << uint(failures-1)
+		if delay > dhcpClientMaxBackoff || delay <= 0 {
+			delay = dhcpClientMaxBackoff
+		}
+		log.Printf("Restarting DHCP client for %s in %s", cer.Interface, delay)
+		time.Sleep(delay)
+	}
+}
+
+// runClient runs a single instance of the DHCP client child process,
+// returning once it exits. The boolean result indicates whether the
+// child produced at least one lease before exiting.
+func (cer *NetworkConfigurerDHCP) runClient() (bool, error) {
+	cmd := exec.Command(dhcpClientPath, cer.clientArgs()...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return false, err
+	}
+
+	cer.setCommands(dhcpmsg.NewEncoder(stdin))
+	gotLease, readErr := cer.readMessages(dhcpmsg.NewDecoder(stdout))
+	cer.setCommands(nil)
+
+	if readErr != nil && readErr != io.EOF {
+		// The child is either misbehaving or speaking a protocol we
+		// don't understand, so we'll make sure it's gone before we
+		// try again.
+		cmd.Process.Kill()
+		cmd.Wait()
+		return gotLease, readErr
+	}
+
+	return gotLease, cmd.Wait()
+}
 
-		go func() {
-			err := cmd.Run()
+// readMessages processes messages from a DHCP client child process
+// until its output stream ends.
+func (cer *NetworkConfigurerDHCP) readMessages(messages *dhcpmsg.Decoder) (bool, error) {
+	hello, err := messages.ReadHello()
+	if err != nil {
+		return false, fmt.Errorf("handshake failed: %s", err)
+	}
+	log.Printf(
+		"DHCP client started for %s (protocol version %d)",
+		hello.Interface, hello.Version,
+	)
+
+	// We read in the background so that we can give up waiting for an
+	// IPv4 lease on an IPv6-only link.
+	msgs := make(chan *dhcpmsg.Message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := messages.ReadMessage()
 			if err != nil {
-				log.Printf("[ERROR] DHCP client failed: %s", err)
-				os.Exit(1)
+				readErr <- err
+				return
+			}
+			msgs <- msg
+		}
+	}()
+
+	var ipv4Deadline <-chan time.Time
+	gotLease := false
+	for {
+		var msg *dhcpmsg.Message
+		select {
+		case msg = <-msgs:
+		case err := <-readErr:
+			return gotLease, err
+		case <-ipv4Deadline:
+			ipv4Deadline = nil
+			if cer.lastLease == nil {
+				log.Printf(
+					"[WARNING] No IPv4 lease for %s after %s; continuing with IPv6 only",
+					cer.Interface, cer.ipv4Wait(),
+				)
+				cer.ipv4Overdue = true
+				cer.publish()
+			}
+			continue
+		}
+
+		switch msg.Type {
+		case dhcpmsg.MessageLease:
+			if !gotLease {
+				// Clear any warning from earlier failures.
+				cer.warning("")
+			}
+			gotLease = true
+			cer.lastLease = msg.Lease
+			cer.publish()
+		case dhcpmsg.MessageLease6:
+			cer.lastLease6 = msg.Lease6
+			if cer.lastLease == nil && !cer.ipv4Overdue && ipv4Deadline == nil && len(msg.Lease6.Addresses) != 0 {
+				ipv4Deadline = time.After(cer.ipv4Wait())
+			}
+			cer.publish()
+		case dhcpmsg.MessageState:
+			log.Printf("DHCP client is %s", msg.State.State)
+		case dhcpmsg.MessageError:
+			if msg.Error.Fatal {
+				log.Printf("[ERROR] DHCP client: %s", msg.Error)
 			} else {
-				log.Printf("[WARNING] DHCP client has exited")
-				os.Exit(0)
+				log.Printf("[WARNING] DHCP client: %s", msg.Error)
 			}
-		}()
+		case dhcpmsg.MessageExpiryWarning:
+			log.Printf(
+				"[WARNING] DHCP lease could not be renewed and expires in %s",
+				msg.ExpiryWarning.Remaining,
+			)
+			cer.warning(fmt.Sprintf(
+				"DHCP lease on %s expires in %s",
+				cer.Interface, msg.ExpiryWarning.Remaining,
+			))
+		default:
+			log.Printf("[WARNING] Ignoring unsupported DHCP client message %q", msg.Type)
+		}
+	}
+}
 
-		cer.leaseDecoder = msgpack.NewDecoder(leaseRead)
+// publish makes a network configuration from the most recent leases
+// available to ConfigureNetwork.
+func (cer *NetworkConfigurerDHCP) publish() {
+	if cer.lastLease == nil {
+		// IPv6 configuration may arrive first, but we wait a while for
+		// the IPv4 lease so that the primary address doesn't change
+		// under us, unless we know that there won't be one.
+		if !cer.IPv6Only && !cer.ipv4Overdue {
+			return
+		}
+		if cer.lastLease6 == nil || len(cer.lastLease6.Addresses) == 0 {
+			return
+		}
 	}
 
-	lease := &networkConfigurerDHCPLease{}
-	err := cer.leaseDecoder.Decode(&lease)
-	if err != nil {
-		return nil, err
+	config := networkConfigFromDHCPLease(cer.lastLease, cer.lastLease6)
+	config.Interface = cer.Interface
+
+	// Replace any config the consumer hasn't collected yet, since only
+	// the most recent one is interesting.
+	select {
+	case <-cer.configs:
+	default:
+	}
+	cer.configs <- config
+}
+
+func (cer *NetworkConfigurerDHCP) ipv4Wait() time.Duration {
+	if cer.IPv4Wait > 0 {
+		return cer.IPv4Wait
 	}
+	return dhcpIPv4Wait
+}
+
+func (cer *NetworkConfigurerDHCP) setCommands(commands *dhcpmsg.Encoder) {
+	cer.mutex.Lock()
+	defer cer.mutex.Unlock()
+	cer.commands = commands
+}
+
+func (cer *NetworkConfigurerDHCP) isStopped() bool {
+	cer.mutex.Lock()
+	defer cer.mutex.Unlock()
+	return cer.stopped
+}
+
+// Renew asks the DHCP client to renew its lease immediately. The new lease
+// will be returned from a subsequent call to ConfigureNetwork.
+func (cer *NetworkConfigurerDHCP) Renew() error {
+	return cer.sendCommand(dhcpmsg.CommandRenew)
+}
+
+// RenewInterface implements interfaceRenewer.
+func (cer *NetworkConfigurerDHCP) RenewInterface(ifaceName string) error {
+	if ifaceName != cer.Interface {
+		return fmt.Errorf("%s is not managed by this DHCP client", ifaceName)
+	}
+	return cer.Renew()
+}
+
+// Release asks the DHCP client to release its lease and deconfigure the
+// interface. The client will not request a new lease until Renew is called.
+func (cer *NetworkConfigurerDHCP) Release() error {
+	return cer.sendCommand(dhcpmsg.CommandRelease)
+}
 
-	return &NetworkConfig{
-		IPAddress:  lease.IPAddress,
-		SubnetMask: lease.SubnetMask,
-		Routers:    lease.Routers,
+// Stop asks the DHCP client to exit, leaving the interface configured,
+// and stops supervising it. Any subsequent call to ConfigureNetwork
+// will return an error.
+func (cer *NetworkConfigurerDHCP) Stop() error {
+	cer.mutex.Lock()
+	cer.stopped = true
+	cer.mutex.Unlock()
 
-		SuggestedHostname:    lease.Hostname,
-		SuggestedDomainName:  lease.DomainName,
-		SuggestedNameservers: lease.Nameservers,
-	}, nil
+	return cer.sendCommand(dhcpmsg.CommandStop)
+}
+
+func (cer *NetworkConfigurerDHCP) sendCommand(cmdType dhcpmsg.CommandType) error {
+	cer.mutex.Lock()
+	defer cer.mutex.Unlock()
+
+	if cer.commands == nil {
+		return fmt.Errorf("DHCP client is not running")
+	}
+	return cer.commands.WriteCommand(&dhcpmsg.Command{Type: cmdType})
 }
 
-type networkConfigurerDHCPLease struct {
-	IPAddress   net.IP     `msgpack:"ip_address"`
-	Hostname    string     `msgpack:"hostname"`
-	DomainName  string     `msgpack:"domain_name"`
-	SubnetMask  net.IPMask `msgpack:"subnet_mask"`
-	Routers     []net.IP   `msgpack:"routers"`
-	Nameservers []net.IP   `msgpack:"name_servers"`
+// networkConfigFromDHCPLease combines the given leases into a network
+// configuration. Either may be nil, but not both.
+func networkConfigFromDHCPLease(lease *dhcpmsg.Lease, lease6 *dhcpmsg.Lease6) *NetworkConfig {
+	if lease == nil {
+		return networkConfigFromIPv6Lease(lease6)
+	}
+
+	var staticRoutes []NetworkRoute
+	for _, route := range lease.StaticRoutes {
+		var gateway net.IP
+		if route.Gateway != nil && !route.Gateway.IsUnspecified() {
+			gateway = route.Gateway
+		}
+		staticRoutes = append(staticRoutes, NetworkRoute{
+			Destination: &net.IPNet{
+				IP:   route.Destination,
+				Mask: route.Mask,
+			},
+			Gateway: gateway,
+		})
+	}
+
+	config := &NetworkConfig{
+		IPAddress:        lease.IPAddress,
+		SubnetMask:       lease.SubnetMask,
+		Addresses:        []*net.IPNet{{IP: lease.IPAddress, Mask: lease.SubnetMask}},
+		BroadcastAddress: lease.BroadcastAddress,
+		Routers:          lease.Routers,
+		StaticRoutes:     staticRoutes,
+		MTU:              lease.MTU,
+
+		SuggestedHostname:      lease.Hostname,
+		SuggestedDomainName:    lease.DomainName,
+		SuggestedNameservers:   lease.NameServers,
+		SuggestedSearchDomains: lease.SearchDomains,
+		SuggestedNTPServers:    lease.NTPServers,
+	}
+
+	if lease6 != nil {
+		for _, addr := range lease6.Addresses {
+			config.Addresses = append(config.Addresses, &net.IPNet{
+				IP:   addr.IP,
+				Mask: net.CIDRMask(addr.PrefixLen, 128),
+			})
+		}
+		config.SuggestedNameservers = append(
+			config.SuggestedNameservers, lease6.NameServers...,
+		)
+		for _, domain := range lease6.SearchDomains {
+			if !stringListContains(config.SuggestedSearchDomains, domain) {
+				config.SuggestedSearchDomains = append(config.SuggestedSearchDomains, domain)
+			}
+		}
+	}
+
+	return config
+}
+
+// networkConfigFromIPv6Lease makes a configuration for an IPv6-only link,
+// whose primary address is the first of the lease's addresses. The
+// default route comes from router advertisements, which the kernel
+// handles itself, so there are no Routers.
+func networkConfigFromIPv6Lease(lease6 *dhcpmsg.Lease6) *NetworkConfig {
+	config := &NetworkConfig{
+		SuggestedNameservers:   lease6.NameServers,
+		SuggestedSearchDomains: lease6.SearchDomains,
+	}
+	for _, addr := range lease6.Addresses {
+		config.Addresses = append(config.Addresses, &net.IPNet{
+			IP:   addr.IP,
+			Mask: net.CIDRMask(addr.PrefixLen, 128),
+		})
+	}
+	if len(config.Addresses) != 0 {
+		config.IPAddress = config.Addresses[0].IP
+		config.SubnetMask = config.Addresses[0].Mask
+	}
+	return config
+}
+
+func stringListContains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clientArgs returns the command line arguments for the dhcpclient child
+// process.
+func (cer *NetworkConfigurerDHCP) clientArgs() []string {
+	var args []string
+
+	if cer.lastLease != nil {
+		// Ask for the address we had before, so a restart of the child
+		// doesn't disturb the rest of the system.
+		args = append(args, "-request-ip", cer.lastLease.IPAddress.String())
+	}
+
+	if cer.ClientID != "" {
+		args = append(args, "-client-id", cer.ClientID)
+	}
+	if cer.Hostname != "" {
+		args = append(args, "-hostname", cer.Hostname)
+	}
+	if cer.VendorClass != "" {
+		args = append(args, "-vendor-class", cer.VendorClass)
+	}
+	if cer.IPv6Mode != "" {
+		args = append(args, "-ipv6", cer.IPv6Mode)
+	}
+	if cer.IPv6Only {
+		args = append(args, "-ipv4=false")
+	}
+	if cer.NoDefaultRoute {
+		args = append(args, "-no-default-route")
+	}
+	if len(cer.RequestOptions) != 0 {
+		codes := make([]string, len(cer.RequestOptions))
+		for i, code := range cer.RequestOptions {
+			codes[i] = strconv.Itoa(int(code))
+		}
+		args = append(args, "-request-options", strings.Join(codes, ","))
+	}
+
+	return append(args, cer.Interface)
 }
@@ -1,13 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
-	"os/exec"
+	"os"
+	"strings"
+	"syscall"
 )
 
+const resolvConfPath = "/etc/resolv.conf"
+
 // NetworkConfigurerLocalDev is a NetworkConfigurer implementation that
 // does not actually alter the network configuration at all, and instead
 // just returns the pre-existing network configuration for whatever
@@ -25,54 +29,30 @@ func (cer *NetworkConfigurerLocalDev) ConfigureNetwork() (*NetworkConfig, error)
 
 	ifaceName := cer.ForceInterface
 
-	if ifaceName == "" {
-		// We're going to use the "ip route" command (tested only on Linux)
-		// to ask for the route table entry that would get us to 255.0.0.0
-		// and then assume that the interface used for that route is the
-		// "primary" one for the sake of our work here.
-		//
-		// This is a bit shifty but should work well enough for the simple
-		// dev environment case.
-
-		cmd := exec.Command("ip", "route", "get", "255.0.0.0")
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return nil, fmt.Errorf("failed to connect pipe to 'ip route': %s", err)
-		}
-
-		if err := cmd.Start(); err != nil {
-			return nil, fmt.Errorf("error launching 'ip route': %s", err)
-		}
-
-		output, err := ioutil.ReadAll(stdout)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read 'ip route' output: %s", err)
-		}
-
-		if err := cmd.Wait(); err != nil {
-			return nil, fmt.Errorf("'ip route' failed: %s", err)
-		}
-
-		// Now we'll do some shaky-shaky "parsing" of the output!
-		srcIndex := bytes.Index(output, []byte(" dev "))
-		if srcIndex == -1 {
-			return nil, fmt.Errorf("'ip route' output does not meet expectations")
+	// The interface holding the preferred default route is assumed to be
+	// the "primary" one for the sake of our work here, with IPv4 routes
+	// preferred over IPv6 routes.
+	routes, err := getDefaultRoutes(syscall.AF_INET)
+	if err != nil {
+		// We only need the routes to choose an interface, so when one
+		// has been forced we can do without its routers.
+		if ifaceName == "" {
+			return nil, fmt.Errorf("failed to read IPv4 route table: %s", err)
 		}
+		log.Printf("[WARNING] Failed to read IPv4 route table: %s", err)
+	}
+	routes6, err := getDefaultRoutes(syscall.AF_INET6)
+	if err != nil {
+		// Probably just means the kernel has IPv6 disabled.
+		log.Printf("[WARNING] Failed to read IPv6 route table: %s", err)
+	}
+	routes = append(routes, routes6...)
 
-		// Position the start of our slice at the beginning of the interface name
-		output = output[srcIndex+5:]
-
-		endIndex := bytes.IndexAny(output, " \n")
-		if endIndex == -1 {
-			return nil, fmt.Errorf("'ip route' output does not meet expectations")
+	if ifaceName == "" {
+		if len(routes) == 0 {
+			return nil, fmt.Errorf("there is no default route")
 		}
-
-		// Position the end of our slice at the end of the interface name
-		output = output[:endIndex]
-
-		// Now "output" should frame just the name of our "default route"
-		// interface!
-		ifaceName = string(output)
+		ifaceName = routes[0].Interface.Name
 	}
 
 	iface, err := net.InterfaceByName(ifaceName)
@@ -87,6 +67,7 @@ func (cer *NetworkConfigurerLocalDev) ConfigureNetwork() (*NetworkConfig, error)
 
 	var ip net.IP
 	var mask net.IPMask
+	var allAddrs []*net.IPNet
 	for _, addr := range addrs {
 		var ipNet *net.IPNet
 		var ok bool
@@ -94,25 +75,94 @@ func (cer *NetworkConfigurerLocalDev) ConfigureNetwork() (*NetworkConfig, error)
 			continue
 		}
 
-		_, len := ipNet.Mask.Size()
-		if len != 32 {
+		// Link-local IPv6 addresses are present on every interface and
+		// aren't useful to anyone beyond the local link.
+		if !ipNet.IP.IsGlobalUnicast() {
 			continue
 		}
 
-		ip = ipNet.IP.To4()
-		mask = ipNet.Mask
-		break
+		allAddrs = append(allAddrs, ipNet)
+
+		_, len := ipNet.Mask.Size()
+		if len == 32 && (ip == nil || ip.To4() == nil) {
+			// IPv4 is always preferred as the primary address.
+			ip = ipNet.IP.To4()
+			mask = ipNet.Mask
+		} else if ip == nil {
+			ip = ipNet.IP
+			mask = ipNet.Mask
+		}
 	}
 
 	if ip == nil {
-		return nil, fmt.Errorf("%q has no IPv4 addresses", ifaceName)
+		return nil, fmt.Errorf("%q has no usable addresses", ifaceName)
+	}
+
+	// Only the default routes via our chosen interface are relevant, and
+	// of those only the ones that actually name a gateway; a default route
+	// with no gateway just means everything is on-link.
+	var routers []net.IP
+	for _, route := range routes {
+		if route.Interface.Name == ifaceName && route.Gateway != nil {
+			routers = append(routers, route.Gateway)
+		}
+	}
+
+	nameservers, searchDomains, err := readResolvConf(resolvConfPath)
+	if err != nil {
+		// Not fatal, since we can still get through the boot process
+		// without name resolution in the dev environment.
+		log.Printf("[WARNING] Failed to read nameservers from %s: %s", resolvConfPath, err)
 	}
 
 	return &NetworkConfig{
+		Interface:  ifaceName,
 		IPAddress:  ip,
 		SubnetMask: mask,
-		Routers:    []net.IP{ip},
+		Addresses:  allAddrs,
+		Routers:    routers,
 
-		SuggestedNameservers: []net.IP{},
+		SuggestedNameservers:   nameservers,
+		SuggestedSearchDomains: searchDomains,
 	}, nil
 }
+
+// readResolvConf returns the nameservers and search domains listed in
+// the resolv.conf file at the given path. A missing file is treated the
+// same as one with no entries.
+func readResolvConf(path string) ([]net.IP, []string, error) {
+	nameservers := []net.IP{}
+	var searchDomains []string
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nameservers, nil, nil
+		}
+		return nameservers, nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			// Nameservers can have an IPv6 zone suffix, which net.IP
+			// can't represent, so we just skip those.
+			ns := net.ParseIP(fields[1])
+			if ns != nil {
+				nameservers = append(nameservers, ns)
+			}
+		case "search":
+			// Only the last "search" (or "domain") line takes effect.
+			searchDomains = fields[1:]
+		case "domain":
+			searchDomains = fields[1:2]
+		}
+	}
+
+	return nameservers, searchDomains, nil
+}
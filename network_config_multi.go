@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/libcontainer/netlink"
+)
+
+// NetworkConfigurerMulti is a NetworkConfigurer implementation that
+// configures several network interfaces at once, each with its own
+// NetworkConfigurer, such as for storage nodes that have a separate NIC
+// for data traffic or for sites where the node must join tagged VLANs.
+//
+// One of the interfaces is the primary, whose configuration is used for
+// the node's identity and which alone carries the default route. The
+// NetworkConfig returned describes the primary interface, with the others
+// listed in its Interfaces field.
+//
+// Each interface's configurer is called repeatedly in the background,
+// and after the first call ConfigureNetwork blocks until any one of them
+// reports a new configuration.
+type NetworkConfigurerMulti struct {
+	Interfaces []NetworkInterface
+
+	// SecondaryWait is how long the first call to ConfigureNetwork waits
+	// for the interfaces other than the primary once the primary has
+	// been attempted, which defaults to networkSecondaryWait. Any that
+	// come up later are reported by subsequent calls.
+	SecondaryWait time.Duration
+
+	started bool
+	warn    func(msg string)
+
+	// Signalled whenever any interface's state changes. Only ever holds
+	// one signal, since ConfigureNetwork always reports the latest state
+	// of every interface anyway.
+	changed chan struct{}
+
+	// Must be held while accessing the fields below.
+	mutex    sync.Mutex
+	states   []networkInterfaceState
+	warnings map[string]string
+}
+
+// The default for NetworkConfigurerMulti.SecondaryWait.
+const networkSecondaryWait = 10 * time.Second
+
+// NetworkInterface describes one of the interfaces to be configured by
+// NetworkConfigurerMulti.
+type NetworkInterface struct {
+	// Name is the name of the interface.
+	Name string
+
+	// VLAN, if set, causes the interface to be created as a VLAN
+	// subinterface before it is configured.
+	VLAN *NetworkVLAN
+
+	// Primary marks the interface used for the node's identity. At most
+	// one interface may be primary; if none is then the first is used.
+	Primary bool
+
+	// Configurer configures the interface. It must be set up to
+	// configure the interface given in Name.
+	Configurer NetworkConfigurer
+}
+
+// NetworkVLAN describes a tagged VLAN subinterface.
+type NetworkVLAN struct {
+	// Parent is the name of the physical interface that carries the VLAN.
+	Parent string
+
+	// ID is the VLAN tag, between 1 and 4094.
+	ID uint16
+}
+
+// UnmarshalJSON allows a NetworkInterface to be given in a flavor
+// definition, with its configurer given as a ComponentDefinition.
+func (i *NetworkInterface) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Name       string
+		VLAN       *NetworkVLAN
+		Primary    bool
+		Configurer ComponentDefinition
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	configurer, err := newNetworkConfigurer(&raw.Configurer)
+	if err != nil {
+		return fmt.Errorf("interface %s: %s", raw.Name, err)
+	}
+
+	*i = NetworkInterface{
+		Name:       raw.Name,
+		VLAN:       raw.VLAN,
+		Primary:    raw.Primary,
+		Configurer: configurer,
+	}
+	return nil
+}
+
+type networkInterfaceState struct {
+	config *NetworkConfig
+	err    error
+
+	// Set once the interface's configurer has returned at least once,
+	// whether successfully or not.
+	attempted bool
+}
+
+func (cer *NetworkConfigurerMulti) ConfigureNetwork() (*NetworkConfig, error) {
+	if !cer.started {
+		err := cer.start()
+		if err != nil {
+			return nil, err
+		}
+		cer.started = true
+
+		// On the first call we wait until the primary interface has had
+		// one attempt at configuration, and then give the others a little
+		// longer so that the boot process sees all of the interfaces that
+		// come up promptly. A secondary interface that never comes up,
+		// such as one whose DHCP server is down, mustn't hold up boot.
+		primary := cer.primaryIndex()
+		for !cer.attempted(primary) {
+			<-cer.changed
+		}
+		deadline := time.After(cer.secondaryWait())
+	wait:
+		for !cer.allAttempted() {
+			select {
+			case <-cer.changed:
+			case <-deadline:
+				log.Printf(
+					"[WARNING] Continuing without waiting for interfaces %s",
+					strings.Join(cer.unattempted(), ", "),
+				)
+				break wait
+			}
+		}
+	} else {
+		<-cer.changed
+	}
+
+	return cer.config()
+}
+
+// SetWarningFunc implements warningReporter, passing on the warnings from
+// any of the interfaces' configurers.
+func (cer *NetworkConfigurerMulti) SetWarningFunc(warn func(msg string)) {
+	cer.warn = warn
+
+	for _, iface := range cer.Interfaces {
+		reporter, ok := iface.Configurer.(warningReporter)
+		if !ok {
+			continue
+		}
+
+		name := iface.Name
+		reporter.SetWarningFunc(func(msg string) {
+			cer.warning(name, msg)
+		})
+	}
+}
+
+// SetBootStatusFunc implements bootStatusReporter, passing the function
+// on to the primary interface's configurer, since only the primary holds
+// up the boot.
+func (cer *NetworkConfigurerMulti) SetBootStatusFunc(fn func(msg string)) {
+	if len(cer.Interfaces) == 0 {
+		return
+	}
+	primary := cer.Interfaces[cer.primaryIndex()]
+	if reporter, ok := primary.Configurer.(bootStatusReporter); ok {
+		reporter.SetBootStatusFunc(fn)
+	}
+}
+
+// RenewInterface implements interfaceRenewer, passing the request on to
+// the configurer for the named interface if it supports renewal.
+func (cer *NetworkConfigurerMulti) RenewInterface(ifaceName string) error {
+	for _, iface := range cer.Interfaces {
+		if iface.Name != ifaceName {
+			continue
+		}
+		if renewer, ok := iface.Configurer.(interfaceRenewer); ok {
+			return renewer.RenewInterface(ifaceName)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not a managed interface", ifaceName)
+}
+
+// warning records the latest warning for the named interface and then
+// reports the warnings from all interfaces together, since there's only
+// room for one network warning on the console.
+func (cer *NetworkConfigurerMulti) warning(ifaceName string, msg string) {
+	cer.mutex.Lock()
+	if cer.warnings == nil {
+		cer.warnings = map[string]string{}
+	}
+	if msg == "" {
+		delete(cer.warnings, ifaceName)
+	} else {
+		cer.warnings[ifaceName] = msg
+	}
+
+	names := make([]string, 0, len(cer.warnings))
+	for name := range cer.warnings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, cer.warnings[name])
+	}
+	cer.mutex.Unlock()
+
+	if cer.warn != nil {
+		cer.warn(strings.Join(msgs, "; "))
+	}
+}
+
+// start checks the interface list, creates any VLAN subinterfaces and
+// then starts a background goroutine to configure each interface.
+func (cer *NetworkConfigurerMulti) start() error {
+	if len(cer.Interfaces) == 0 {
+		return fmt.Errorf("no network interfaces given")
+	}
+
+	primaries := 0
+	seen := map[string]bool{}
+	for _, iface := range cer.Interfaces {
+		if iface.Name == "" {
+			return fmt.Errorf("network interface has no name")
+		}
+		if seen[iface.Name] {
+			return fmt.Errorf("network interface %s is listed more than once", iface.Name)
+		}
+		seen[iface.Name] = true
+
+		if iface.Configurer == nil {
+			return fmt.Errorf("network interface %s has no configurer", iface.Name)
+		}
+		if iface.Primary {
+			primaries++
+		}
+	}
+	if primaries > 1 {
+		return fmt.Errorf("only one network interface may be primary")
+	}
+
+	// Otherwise whichever interface was configured first would get the
+	// default route, which might be the one for storage traffic.
+	primary := cer.primaryIndex()
+	for i, iface := range cer.Interfaces {
+		if i == primary {
+			continue
+		}
+		err := disableDefaultRoute(iface.Configurer)
+		if err != nil {
+			return fmt.Errorf("network interface %s: %s", iface.Name, err)
+		}
+	}
+
+	for _, iface := range cer.Interfaces {
+		if iface.VLAN == nil {
+			continue
+		}
+		err := createVLANInterface(iface.Name, iface.VLAN)
+		if err != nil {
+			return fmt.Errorf("failed to create VLAN interface %s: %s", iface.Name, err)
+		}
+	}
+
+	cer.changed = make(chan struct{}, 1)
+	cer.states = make([]networkInterfaceState, len(cer.Interfaces))
+
+	for i := range cer.Interfaces {
+		go cer.run(i)
+	}
+
+	return nil
+}
+
+// run keeps calling the configurer for the interface with the given index
+// forever, recording each result.
+func (cer *NetworkConfigurerMulti) run(index int) {
+	iface := cer.Interfaces[index]
+
+	for {
+		started := time.Now()
+
+		config, err := iface.Configurer.ConfigureNetwork()
+		if err != nil {
+			log.Printf("[ERROR] Failed to configure %s: %s", iface.Name, err)
+		}
+
+		cer.mutex.Lock()
+		state := &cer.states[index]
+		state.attempted = true
+		state.err = err
+		if err == nil {
+			state.config = config
+		}
+		cer.mutex.Unlock()
+
+		select {
+		case cer.changed <- struct{}{}:
+		default:
+			// A change is already pending.
+		}
+
+		// Some NetworkConfigurer implementations return immediately
+		// rather than blocking until something changes, so we'll
+		// throttle them in the same way as NetworkWatcher does.
+		if elapsed := time.Since(started); elapsed < networkWatchMinInterval {
+			time.Sleep(networkWatchMinInterval - elapsed)
+		}
+	}
+}
+
+func (cer *NetworkConfigurerMulti) secondaryWait() time.Duration {
+	if cer.SecondaryWait > 0 {
+		return cer.SecondaryWait
+	}
+	return networkSecondaryWait
+}
+
+func (cer *NetworkConfigurerMulti) attempted(index int) bool {
+	cer.mutex.Lock()
+	defer cer.mutex.Unlock()
+	return cer.states[index].attempted
+}
+
+func (cer *NetworkConfigurerMulti) allAttempted() bool {
+	return len(cer.unattempted()) == 0
+}
+
+// unattempted returns the names of the interfaces whose configurers have
+// yet to return.
+func (cer *NetworkConfigurerMulti) unattempted() []string {
+	cer.mutex.Lock()
+	defer cer.mutex.Unlock()
+
+	var names []string
+	for i, state := range cer.states {
+		if !state.attempted {
+			names = append(names, cer.Interfaces[i].Name)
+		}
+	}
+	return names
+}
+
+func (cer *NetworkConfigurerMulti) primaryIndex() int {
+	for i, iface := range cer.Interfaces {
+		if iface.Primary {
+			return i
+		}
+	}
+	return 0
+}
+
+// setPrimaryInterface renames the primary interface, as requested on the
+// kernel command line, along with the interface its configurer configures.
+// It must be called before the first call to ConfigureNetwork.
+func (cer *NetworkConfigurerMulti) setPrimaryInterface(ifaceName string) error {
+	if len(cer.Interfaces) == 0 {
+		return fmt.Errorf("no network interfaces given")
+	}
+
+	primary := &cer.Interfaces[cer.primaryIndex()]
+	if primary.Name == ifaceName {
+		return nil
+	}
+	if primary.VLAN != nil {
+		// The VLAN subinterface is ours to name, so overriding it makes
+		// no sense; the operator wants a different parent instead.
+		return fmt.Errorf(
+			"can't override the interface for primary VLAN interface %s; change its parent in the flavor instead",
+			primary.Name,
+		)
+	}
+	for _, iface := range cer.Interfaces {
+		if iface.Name == ifaceName {
+			return fmt.Errorf(
+				"can't make %s the primary network interface since the flavor already configures it as a secondary",
+				ifaceName,
+			)
+		}
+	}
+
+	err := setNetworkInterface(primary.Configurer, ifaceName)
+	if err != nil {
+		return fmt.Errorf("primary interface %s: %s", primary.Name, err)
+	}
+	primary.Name = ifaceName
+	return nil
+}
+
+// disableDefaultRoute stops the given configurer, which is for a
+// secondary interface, from installing a default route.
+func disableDefaultRoute(cer NetworkConfigurer) error {
+	switch cer := cer.(type) {
+	case *NetworkConfigurerDHCP:
+		cer.NoDefaultRoute = true
+	case *NetworkConfigurerStatic:
+		cer.NoDefaultRoute = true
+	case *NetworkConfigurerLocalDev:
+		// Only reports the host's configuration, without changing it.
+	default:
+		return fmt.Errorf("%T can't configure a secondary interface, since it can't leave the default route alone", cer)
+	}
+	return nil
+}
+
+// config combines the latest configuration of each interface into a
+// single NetworkConfig describing the primary interface.
+func (cer *NetworkConfigurerMulti) config() (*NetworkConfig, error) {
+	cer.mutex.Lock()
+	defer cer.mutex.Unlock()
+
+	primary := cer.primaryIndex()
+	primaryState := cer.states[primary]
+	if primaryState.config == nil {
+		return nil, fmt.Errorf(
+			"primary interface %s is not configured: %s",
+			cer.Interfaces[primary].Name, primaryState.err,
+		)
+	}
+
+	// Copy the primary config so we don't modify the one that belongs
+	// to its configurer.
+	ret := *primaryState.config
+	ret.Interface = cer.Interfaces[primary].Name
+	ret.Addresses = nil
+	ret.Interfaces = nil
+
+	// The primary interface always comes first, followed by the others
+	// in the order they were given.
+	order := []int{primary}
+	for i := range cer.Interfaces {
+		if i != primary {
+			order = append(order, i)
+		}
+	}
+
+	for _, i := range order {
+		state := cer.states[i]
+		if state.config == nil {
+			// Never successfully configured, so there's nothing to
+			// report yet.
+			continue
+		}
+
+		ifaceConfig := *state.config
+		ifaceConfig.Interface = cer.Interfaces[i].Name
+
+		ret.Interfaces = append(ret.Interfaces, &ifaceConfig)
+		ret.Addresses = append(ret.Addresses, ifaceConfig.Addresses...)
+	}
+
+	return &ret, nil
+}
+
+// createVLANInterface creates the named VLAN subinterface, unless it
+// already exists, and brings up its parent interface, since the VLAN
+// can't pass traffic unless the parent is up.
+func createVLANInterface(name string, vlan *NetworkVLAN) error {
+	if vlan.ID < 1 || vlan.ID > 4094 {
+		return fmt.Errorf("invalid VLAN ID %d", vlan.ID)
+	}
+
+	parent, err := net.InterfaceByName(vlan.Parent)
+	if err != nil {
+		return fmt.Errorf("parent interface %s: %s", vlan.Parent, err)
+	}
+
+	if parent.Flags&net.FlagUp == 0 {
+		err = netlink.NetworkLinkUp(parent)
+		if err != nil {
+			return fmt.Errorf("failed to bring up %s: %s", vlan.Parent, err)
+		}
+	}
+
+	if _, err := net.InterfaceByName(name); err == nil {
+		// Probably created by an earlier instance of defgrid-init, so
+		// we'll just use it as-is.
+		return nil
+	}
+
+	log.Printf("Creating VLAN interface %s on %s with ID %d", name, vlan.Parent, vlan.ID)
+	err = netlink.NetworkLinkAddVlan(vlan.Parent, name, vlan.ID)
+	if err != nil && err != syscall.EEXIST {
+		return err
+	}
+	return nil
+}
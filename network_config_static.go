@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/docker/libcontainer/netlink"
+)
+
+// NetworkConfigurerStatic is a NetworkConfigurer implementation that
+// applies a fixed network configuration, for environments such as
+// bare-metal racks where no DHCP server is available.
+//
+// The configuration is taken from a JSON config file if one is present
+// at ConfigPath, and otherwise from the "ip=" parameter on the kernel
+// command line, using the same syntax as the kernel's own IP
+// autoconfiguration:
+//
+//	ip=<client-ip>:<server-ip>:<gw-ip>:<netmask>:<hostname>:<device>:<autoconf>:<dns0-ip>:<dns1-ip>
+//
+// Only the kernel command line's "off", "none" and "static" autoconf
+// values are accepted, since DHCP is handled by NetworkConfigurerDHCP.
+//
+// The config file looks like this, where every property except
+// "address" is optional:
+//
+//	{
+//	    "interface": "eth0",
+//	    "address": "10.1.2.3/24",
+//	    "gateway": "10.1.2.1",
+//	    "nameservers": ["10.1.0.2", "10.1.0.3"],
+//	    "search_domains": ["example.com"],
+//	    "routes": [
+//	        {"destination": "10.2.0.0/16", "gateway": "10.1.2.254"}
+//	    ],
+//	    "mtu": 9000,
+//	    "hostname": "rack1-node3"
+//	}
+//
+// Since the configuration never changes, calls to ConfigureNetwork after
+// the first just return the same configuration again.
+type NetworkConfigurerStatic struct {
+	// ConfigPath is the location of the optional JSON config file.
+	ConfigPath string
+
+	// CmdlinePath is the location of the kernel command line. If empty,
+	// /proc/cmdline is used.
+	CmdlinePath string
+
+	// Interface is the interface to configure if neither the config file
+	// nor the kernel command line names one.
+	Interface string
+
+	// NoDefaultRoute stops the gateway being installed as the default
+	// route, for an interface other than the one that should carry the
+	// node's default route.
+	NoDefaultRoute bool
+
+	config *NetworkConfig
+}
+
+type networkConfigStaticFile struct {
+	Interface     string   `json:"interface"`
+	Address       string   `json:"address"`
+	Gateway       string   `json:"gateway"`
+	Nameservers   []string `json:"nameservers"`
+	SearchDomains []string `json:"search_domains"`
+	Routes        []struct {
+		Destination string `json:"destination"`
+		Gateway     string `json:"gateway"`
+	} `json:"routes"`
+	MTU      int    `json:"mtu"`
+	Hostname string `json:"hostname"`
+}
+
+func (cer *NetworkConfigurerStatic) ConfigureNetwork() (*NetworkConfig, error) {
+	if cer.config != nil {
+		return cer.config, nil
+	}
+
+	config, ifaceName, err := cer.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if ifaceName == "" {
+		ifaceName = cer.Interface
+	}
+	if ifaceName == "" {
+		return nil, fmt.Errorf("no interface given for static network config")
+	}
+
+	err = applyStaticNetworkConfig(ifaceName, config, !cer.NoDefaultRoute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure %s: %s", ifaceName, err)
+	}
+
+	config.Interface = ifaceName
+	cer.config = config
+	return config, nil
+}
+
+// load reads the configuration from whichever source is available,
+// returning it along with the interface name it specified, if any.
+func (cer *NetworkConfigurerStatic) load() (*NetworkConfig, string, error) {
+	if cer.ConfigPath != "" {
+		data, err := ioutil.ReadFile(cer.ConfigPath)
+		if err == nil {
+			log.Printf("Reading static network config from %s", cer.ConfigPath)
+			return parseStaticNetworkConfigFile(data)
+		}
+		if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+
+	cmdlinePath := cer.CmdlinePath
+	if cmdlinePath == "" {
+		cmdlinePath = kernelCmdlinePath
+	}
+	cmdline, err := ReadKernelCmdline(cmdlinePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ipParam, ok := cmdline["ip"]
+	if !ok {
+		return nil, "", fmt.Errorf("no static network config file and no ip= kernel parameter")
+	}
+
+	log.Println("Reading static network config from kernel command line")
+	return parseKernelIPParam(ipParam)
+}
+
+func parseStaticNetworkConfigFile(data []byte) (*NetworkConfig, string, error) {
+	raw := &networkConfigStaticFile{}
+	err := json.Unmarshal(data, raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid static network config: %s", err)
+	}
+
+	ip, ipNet, err := net.ParseCIDR(raw.Address)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid address %q", raw.Address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	config := &NetworkConfig{
+		IPAddress:  ip,
+		SubnetMask: ipNet.Mask,
+		Addresses:  []*net.IPNet{{IP: ip, Mask: ipNet.Mask}},
+		MTU:        raw.MTU,
+
+		SuggestedHostname:      raw.Hostname,
+		SuggestedNameservers:   []net.IP{},
+		SuggestedSearchDomains: raw.SearchDomains,
+	}
+
+	if raw.Gateway != "" {
+		gateway := net.ParseIP(raw.Gateway)
+		if gateway == nil {
+			return nil, "", fmt.Errorf("invalid gateway %q", raw.Gateway)
+		}
+		config.Routers = []net.IP{gateway}
+	}
+
+	for _, nsStr := range raw.Nameservers {
+		ns := net.ParseIP(nsStr)
+		if ns == nil {
+			return nil, "", fmt.Errorf("invalid nameserver %q", nsStr)
+		}
+		config.SuggestedNameservers = append(config.SuggestedNameservers, ns)
+	}
+
+	for _, rawRoute := range raw.Routes {
+		_, dest, err := net.ParseCIDR(rawRoute.Destination)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid route destination %q", rawRoute.Destination)
+		}
+		route := NetworkRoute{Destination: dest}
+		if rawRoute.Gateway != "" {
+			route.Gateway = net.ParseIP(rawRoute.Gateway)
+			if route.Gateway == nil {
+				return nil, "", fmt.Errorf("invalid route gateway %q", rawRoute.Gateway)
+			}
+		}
+		config.StaticRoutes = append(config.StaticRoutes, route)
+	}
+
+	return config, raw.Interface, nil
+}
+
+// parseKernelIPParam parses the value of an "ip=" kernel parameter.
+func parseKernelIPParam(param string) (*NetworkConfig, string, error) {
+	fields := strings.Split(param, ":")
+
+	// Missing trailing fields are the same as empty ones.
+	for len(fields) < 9 {
+		fields = append(fields, "")
+	}
+
+	field := func(i int) string {
+		return strings.TrimSpace(fields[i])
+	}
+
+	switch field(6) {
+	case "", "off", "none", "static":
+	default:
+		return nil, "", fmt.Errorf("ip= autoconf method %q is not supported for static config", field(6))
+	}
+
+	ip := net.ParseIP(field(0)).To4()
+	if ip == nil {
+		return nil, "", fmt.Errorf("ip= has invalid client address %q", field(0))
+	}
+
+	mask := ip.DefaultMask()
+	if field(3) != "" {
+		maskIP := net.ParseIP(field(3)).To4()
+		if maskIP == nil {
+			return nil, "", fmt.Errorf("ip= has invalid netmask %q", field(3))
+		}
+		mask = net.IPMask(maskIP)
+
+		// Size reports no bits at all for a mask that isn't a run of
+		// ones followed by zeros, such as 255.0.255.0.
+		if _, bits := mask.Size(); bits == 0 {
+			return nil, "", fmt.Errorf("ip= has non-contiguous netmask %q", field(3))
+		}
+	}
+
+	config := &NetworkConfig{
+		IPAddress:  ip,
+		SubnetMask: mask,
+		Addresses:  []*net.IPNet{{IP: ip, Mask: mask}},
+
+		SuggestedHostname:    field(4),
+		SuggestedNameservers: []net.IP{},
+	}
+
+	if field(2) != "" {
+		gateway := net.ParseIP(field(2)).To4()
+		if gateway == nil {
+			return nil, "", fmt.Errorf("ip= has invalid gateway %q", field(2))
+		}
+		config.Routers = []net.IP{gateway}
+	}
+
+	for _, i := range []int{7, 8} {
+		if field(i) == "" {
+			continue
+		}
+		ns := net.ParseIP(field(i))
+		if ns == nil {
+			return nil, "", fmt.Errorf("ip= has invalid nameserver %q", field(i))
+		}
+		config.SuggestedNameservers = append(config.SuggestedNameservers, ns)
+	}
+
+	return config, field(5), nil
+}
+
+// applyStaticNetworkConfig configures the named interface with the
+// addresses and routes from the given config, including its default
+// route if defaultRoute is set.
+func applyStaticNetworkConfig(ifaceName string, config *NetworkConfig, defaultRoute bool) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	if config.MTU != 0 {
+		err := netlink.NetworkSetMTU(iface, config.MTU)
+		if err != nil {
+			return fmt.Errorf("failed to set MTU %d: %s", config.MTU, err)
+		}
+	}
+
+	err = netlink.NetworkLinkUp(iface)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range config.Addresses {
+		// EEXIST means that something (perhaps a previous instance of
+		// us) already configured this address, which is fine.
+		err := netlink.NetworkLinkAddIp(iface, addr.IP, addr)
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add address %s: %s", addr, err)
+		}
+	}
+
+	// Static routes go in before the default gateway, since the gateway
+	// may only be reachable via one of them.
+	for _, route := range config.StaticRoutes {
+		gateway := ""
+		if route.Gateway != nil {
+			gateway = route.Gateway.String()
+		}
+		err := netlink.AddRoute(route.Destination.String(), "", gateway, ifaceName)
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add route to %s: %s", route.Destination, err)
+		}
+	}
+
+	if defaultRoute && len(config.Routers) > 0 {
+		err := netlink.AddDefaultGw(config.Routers[0].String(), ifaceName)
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to add default gateway: %s", err)
+		}
+	}
+
+	return nil
+}
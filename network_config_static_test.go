@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// staticConfigSummary is the parts of a parsed static config that the
+// tests compare, in a form that doesn't depend on how net.IP values
+// happen to be stored.
+type staticConfigSummary struct {
+	Interface   string
+	Address     string
+	Gateway     string
+	Nameservers []string
+	Routes      []string
+	MTU         int
+	Hostname    string
+}
+
+func summarizeStaticConfig(config *NetworkConfig, ifaceName string) staticConfigSummary {
+	ones, _ := config.SubnetMask.Size()
+	s := staticConfigSummary{
+		Interface:   ifaceName,
+		Address:     fmt.Sprintf("%s/%d", config.IPAddress, ones),
+		Nameservers: []string{},
+		MTU:         config.MTU,
+		Hostname:    config.SuggestedHostname,
+	}
+	if len(config.Addresses) != 1 || config.Addresses[0].String() != s.Address {
+		s.Address += fmt.Sprintf(" (addresses %v)", config.Addresses)
+	}
+	for _, router := range config.Routers {
+		s.Gateway += router.String()
+	}
+	for _, ns := range config.SuggestedNameservers {
+		s.Nameservers = append(s.Nameservers, ns.String())
+	}
+	for _, route := range config.StaticRoutes {
+		s.Routes = append(s.Routes, fmt.Sprintf("%s via %s", route.Destination, route.Gateway))
+	}
+	return s
+}
+
+func TestParseKernelIPParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    staticConfigSummary
+		wantErr bool
+	}{
+		{
+			name:  "full",
+			param: "10.1.2.3::10.1.2.1:255.255.255.0:rack1-node3:eth1:off:10.1.0.2:10.1.0.3",
+			want: staticConfigSummary{
+				Interface:   "eth1",
+				Address:     "10.1.2.3/24",
+				Gateway:     "10.1.2.1",
+				Nameservers: []string{"10.1.0.2", "10.1.0.3"},
+				Hostname:    "rack1-node3",
+			},
+		},
+		{
+			name:  "address only",
+			param: "10.1.2.3",
+			want: staticConfigSummary{
+				Address:     "10.1.2.3/8",
+				Nameservers: []string{},
+			},
+		},
+		{
+			name:  "class C default mask",
+			param: "192.168.1.5",
+			want: staticConfigSummary{
+				Address:     "192.168.1.5/24",
+				Nameservers: []string{},
+			},
+		},
+		{
+			name:  "trailing fields omitted",
+			param: "10.1.2.3::10.1.2.1:255.255.0.0",
+			want: staticConfigSummary{
+				Address:     "10.1.2.3/16",
+				Gateway:     "10.1.2.1",
+				Nameservers: []string{},
+			},
+		},
+		{
+			name:  "no gateway",
+			param: "10.1.2.3:::255.255.255.0::eth0:static",
+			want: staticConfigSummary{
+				Interface:   "eth0",
+				Address:     "10.1.2.3/24",
+				Nameservers: []string{},
+			},
+		},
+		{
+			name:  "second nameserver only",
+			param: "10.1.2.3::::::none::10.1.0.3",
+			want: staticConfigSummary{
+				Address:     "10.1.2.3/8",
+				Nameservers: []string{"10.1.0.3"},
+			},
+		},
+		{
+			// The colons in an IPv6 address split it across fields.
+			name:    "IPv6 nameserver",
+			param:   "10.1.2.3:::::::2001:db8::53",
+			wantErr: true,
+		},
+		{
+			name:    "DHCP autoconf",
+			param:   "10.1.2.3:::::eth0:dhcp",
+			wantErr: true,
+		},
+		{
+			name:    "no address",
+			param:   "::10.1.2.1:255.255.255.0",
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 address",
+			param:   "2001:db8::5",
+			wantErr: true,
+		},
+		{
+			name:    "bad netmask",
+			param:   "10.1.2.3:::255.255.255.bad",
+			wantErr: true,
+		},
+		{
+			name:    "non-contiguous netmask",
+			param:   "10.1.2.3:::255.0.255.0",
+			wantErr: true,
+		},
+		{
+			name:    "bad gateway",
+			param:   "10.1.2.3::gateway",
+			wantErr: true,
+		},
+		{
+			name:    "bad nameserver",
+			param:   "10.1.2.3:::::::10.1.0",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, ifaceName, err := parseKernelIPParam(test.param)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := summarizeStaticConfig(config, ifaceName)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrong config\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseStaticNetworkConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    staticConfigSummary
+		wantErr bool
+	}{
+		{
+			name: "full",
+			file: `{
+				"interface": "eth1",
+				"address": "10.1.2.3/24",
+				"gateway": "10.1.2.1",
+				"nameservers": ["10.1.0.2", "2001:db8::53"],
+				"search_domains": ["example.com"],
+				"routes": [
+					{"destination": "10.2.0.0/16", "gateway": "10.1.2.254"},
+					{"destination": "10.3.0.0/16"}
+				],
+				"mtu": 9000,
+				"hostname": "rack1-node3"
+			}`,
+			want: staticConfigSummary{
+				Interface:   "eth1",
+				Address:     "10.1.2.3/24",
+				Gateway:     "10.1.2.1",
+				Nameservers: []string{"10.1.0.2", "2001:db8::53"},
+				Routes:      []string{"10.2.0.0/16 via 10.1.2.254", "10.3.0.0/16 via <nil>"},
+				MTU:         9000,
+				Hostname:    "rack1-node3",
+			},
+		},
+		{
+			name: "address only",
+			file: `{"address": "10.1.2.3/16"}`,
+			want: staticConfigSummary{
+				Address:     "10.1.2.3/16",
+				Nameservers: []string{},
+			},
+		},
+		{
+			name:    "no address",
+			file:    `{"gateway": "10.1.2.1"}`,
+			wantErr: true,
+		},
+		{
+			name:    "address without prefix",
+			file:    `{"address": "10.1.2.3"}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad gateway",
+			file:    `{"address": "10.1.2.3/24", "gateway": "10.1.2"}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad nameserver",
+			file:    `{"address": "10.1.2.3/24", "nameservers": ["ns1"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad route destination",
+			file:    `{"address": "10.1.2.3/24", "routes": [{"destination": "10.2.0.0"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad route gateway",
+			file:    `{"address": "10.1.2.3/24", "routes": [{"destination": "10.2.0.0/16", "gateway": "x"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid JSON",
+			file:    `{"address": `,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, ifaceName, err := parseStaticNetworkConfigFile([]byte(test.file))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("succeeded; want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := summarizeStaticConfig(config, ifaceName)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wrong config\ngot:  %+v\nwant: %+v", got, test.want)
+			}
+			if len(config.IPAddress) != net.IPv4len {
+				t.Errorf("IPv4 address %s isn't in 4-byte form", config.IPAddress)
+			}
+		})
+	}
+}
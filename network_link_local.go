@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/docker/libcontainer/netlink"
+)
+
+// The timing constants from RFC 3927 section 9.
+const (
+	linkLocalProbeWait     = 1 * time.Second
+	linkLocalProbeNum      = 3
+	linkLocalProbeMin      = 1 * time.Second
+	linkLocalProbeMax      = 2 * time.Second
+	linkLocalAnnounceWait  = 2 * time.Second
+	linkLocalAnnounceNum   = 2
+	linkLocalAnnounceDelay = 2 * time.Second
+	linkLocalMaxConflicts  = 10
+)
+
+var linkLocalMask = net.CIDRMask(16, 32)
+
+const arpRequest = 1
+
+// claimLinkLocalAddress selects an IPv4 link-local address (169.254/16)
+// for the named interface as described in RFC 3927, using ARP probes to
+// make sure that nobody else on the local link is already using it, and
+// then assigns it to the interface and announces it.
+//
+// Unlike a full RFC 3927 implementation, we don't go on to defend the
+// address once we have it, since it's only a stopgap until a DHCP lease
+// arrives.
+func claimLinkLocalAddress(ifaceName string) (*net.IPNet, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("%s does not have an Ethernet address", ifaceName)
+	}
+
+	fd, err := openARPSocket(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ARP socket: %s", err)
+	}
+	defer syscall.Close(fd)
+
+	// Seeding from the hardware address means we'll usually pick the
+	// same address each time we boot, as the RFC recommends.
+	hash := fnv.New64a()
+	hash.Write(iface.HardwareAddr)
+	random := rand.New(rand.NewSource(int64(hash.Sum64())))
+
+	for conflicts := 0; conflicts < linkLocalMaxConflicts; conflicts++ {
+		ip := net.IPv4(169, 254, byte(1+random.Intn(254)), byte(random.Intn(256))).To4()
+
+		conflict, err := probeLinkLocalAddress(fd, iface, ip, random)
+		if err != nil {
+			return nil, err
+		}
+		if conflict {
+			log.Printf("[WARNING] Link-local address %s is already in use on %s", ip, ifaceName)
+			continue
+		}
+
+		addr := &net.IPNet{IP: ip, Mask: linkLocalMask}
+		err = netlink.NetworkLinkAddIp(iface, ip, addr)
+		if err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("failed to add address %s: %s", addr, err)
+		}
+
+		for i := 0; i < linkLocalAnnounceNum; i++ {
+			if i > 0 {
+				time.Sleep(linkLocalAnnounceDelay)
+			}
+			err := sendARP(fd, iface, arpRequest, ip, ip)
+			if err != nil {
+				// The address is usable even if nobody heard about it.
+				log.Printf("[WARNING] Failed to announce %s on %s: %s", ip, ifaceName, err)
+				break
+			}
+		}
+
+		return addr, nil
+	}
+
+	return nil, fmt.Errorf("gave up after %d address conflicts", linkLocalMaxConflicts)
+}
+
+// releaseLinkLocalAddress removes an address previously returned from
+// claimLinkLocalAddress.
+func releaseLinkLocalAddress(ifaceName string, addr *net.IPNet) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	return netlink.NetworkLinkDelIp(iface, addr.IP, addr)
+}
+
+// probeLinkLocalAddress sends ARP probes for the given address, returning
+// true if another host turns out to be using it or trying to claim it.
+func probeLinkLocalAddress(fd int, iface *net.Interface, ip net.IP, random *rand.Rand) (bool, error) {
+	time.Sleep(time.Duration(random.Int63n(int64(linkLocalProbeWait))))
+
+	for i := 0; i < linkLocalProbeNum; i++ {
+		err := sendARP(fd, iface, arpRequest, net.IPv4zero.To4(), ip)
+		if err != nil {
+			return false, fmt.Errorf("failed to send ARP probe: %s", err)
+		}
+
+		wait := linkLocalAnnounceWait
+		if i < linkLocalProbeNum-1 {
+			wait = linkLocalProbeMin + time.Duration(random.Int63n(int64(linkLocalProbeMax-linkLocalProbeMin)))
+		}
+
+		conflict, err := awaitARPConflict(fd, iface, ip, wait)
+		if err != nil || conflict {
+			return conflict, err
+		}
+	}
+
+	return false, nil
+}
+
+func openARPSocket(iface *net.Interface) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return -1, err
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  iface.Index,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+// sendARP broadcasts an ARP packet with the given operation and sender
+// and target protocol addresses.
+func sendARP(fd int, iface *net.Interface, op uint16, senderIP, targetIP net.IP) error {
+	broadcast := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	packet := make([]byte, 42)
+	copy(packet[0:6], broadcast)
+	copy(packet[6:12], iface.HardwareAddr)
+	binary.BigEndian.PutUint16(packet[12:14], syscall.ETH_P_ARP)
+
+	arp := packet[14:]
+	binary.BigEndian.PutUint16(arp[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], syscall.ETH_P_IP)
+	arp[4] = 6 // hardware address length
+	arp[5] = 4 // protocol address length
+	binary.BigEndian.PutUint16(arp[6:8], op)
+	copy(arp[8:14], iface.HardwareAddr)
+	copy(arp[14:18], senderIP.To4())
+	// Target hardware address stays zero.
+	copy(arp[24:28], targetIP.To4())
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], broadcast)
+
+	return syscall.Sendto(fd, packet, 0, addr)
+}
+
+// awaitARPConflict listens for ARP packets for the given duration,
+// returning true if one shows that another host is using the given
+// address or is probing for it at the same time as us.
+func awaitARPConflict(fd int, iface *net.Interface, ip net.IP, wait time.Duration) (bool, error) {
+	deadline := time.Now().Add(wait)
+	buf := make([]byte, 1500)
+
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return false, nil
+		}
+
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+		if err != nil {
+			return false, err
+		}
+
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		packet := buf[:n]
+		if len(packet) < 42 || binary.BigEndian.Uint16(packet[12:14]) != syscall.ETH_P_ARP {
+			continue
+		}
+
+		arp := packet[14:]
+		op := binary.BigEndian.Uint16(arp[6:8])
+		senderMAC := net.HardwareAddr(arp[8:14])
+		senderIP := net.IP(arp[14:18])
+		targetIP := net.IP(arp[24:28])
+
+		if bytes.Equal(senderMAC, iface.HardwareAddr) {
+			// Our own packets are looped back to us.
+			continue
+		}
+
+		if senderIP.Equal(ip) {
+			return true, nil
+		}
+		if op == arpRequest && senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip) {
+			return true, nil
+		}
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
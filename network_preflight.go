@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NetworkCheck is the result of one of the connectivity checks made by
+// CheckNetwork.
+type NetworkCheck struct {
+	// Name describes what was checked, such as "gateway 10.0.0.1".
+	Name string
+
+	// Err is nil if the check passed.
+	Err error
+
+	// Skipped is set if the check couldn't be made at all, such as
+	// because we lack the privileges to send raw packets. Skipped checks
+	// don't count as failures.
+	Skipped bool
+}
+
+func (c *NetworkCheck) Failed() bool {
+	return c.Err != nil && !c.Skipped
+}
+
+// How long each individual check waits for an answer.
+const networkCheckTimeout = 3 * time.Second
+
+// Failed checks are retried with a delay that doubles after each attempt,
+// but after networkCheckAttempts we give up and carry on booting anyway,
+// since later steps may still work well enough to be useful.
+const (
+	networkCheckAttempts       = 5
+	networkCheckInitialBackoff = 2 * time.Second
+	networkCheckMaxBackoff     = 30 * time.Second
+)
+
+// AwaitNetworkChecks runs CheckNetwork until all of the checks pass or
+// we run out of attempts, logging each result and showing any failures
+// on the console. It returns true if everything passed.
+func AwaitNetworkChecks(booter *Booter, console *Console, config *NetworkConfig) bool {
+	backoff := networkCheckInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		checks := CheckNetwork(config, booter.MetadataEndpoint())
+		for _, check := range checks {
+			switch {
+			case check.Skipped:
+				log.Printf("Network check: %s skipped: %s", check.Name, check.Err)
+			case check.Err != nil:
+				log.Printf("[WARNING] Network check: %s failed: %s", check.Name, check.Err)
+			default:
+				log.Printf("Network check: %s ok", check.Name)
+			}
+		}
+
+		summary := networkCheckSummary(checks)
+		console.SetWarning("network-check", summary)
+		if summary == "" {
+			return true
+		}
+
+		if attempt == networkCheckAttempts {
+			log.Printf("[WARNING] Network checks still failing after %d attempts; continuing anyway", attempt)
+			return false
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > networkCheckMaxBackoff {
+			backoff = networkCheckMaxBackoff
+		}
+	}
+}
+
+// CheckNetwork verifies that the given network configuration actually
+// works, by checking that the default gateway answers ARP, that each
+// suggested nameserver answers a DNS query, and that the metadata
+// endpoint (a host:port, if not empty) accepts TCP connections.
+func CheckNetwork(config *NetworkConfig, metadataEndpoint string) []NetworkCheck {
+	var checks []NetworkCheck
+
+	for _, router := range config.Routers {
+		if router.To4() == nil {
+			// IPv6 has no ARP, and its routers come from router
+			// advertisements which show they're alive anyway.
+			continue
+		}
+		check := NetworkCheck{Name: fmt.Sprintf("gateway %s", router)}
+		check.Err = checkGateway(config, router)
+		if check.Err == syscall.EPERM {
+			check.Skipped = true
+		}
+		checks = append(checks, check)
+		break
+	}
+
+	for _, ns := range config.SuggestedNameservers {
+		check := NetworkCheck{Name: fmt.Sprintf("nameserver %s", ns)}
+		check.Err = checkNameserver(ns)
+		checks = append(checks, check)
+	}
+
+	if metadataEndpoint != "" {
+		check := NetworkCheck{Name: fmt.Sprintf("metadata endpoint %s", metadataEndpoint)}
+		conn, err := net.DialTimeout("tcp", metadataEndpoint, networkCheckTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		check.Err = err
+		checks = append(checks, check)
+	} else {
+		// None of the built-in flavors has a metadata service, so this
+		// check only applies to flavors from the flavors file that set
+		// metadata_endpoint. Saying so in the log makes it clear that
+		// the check wasn't forgotten.
+		checks = append(checks, NetworkCheck{
+			Name:    "metadata endpoint",
+			Err:     fmt.Errorf("flavor has no metadata_endpoint"),
+			Skipped: true,
+		})
+	}
+
+	return checks
+}
+
+// checkGateway sends an ARP request for the given gateway and waits for
+// it to reply.
+func checkGateway(config *NetworkConfig, gateway net.IP) error {
+	ifaceName := config.Interface
+	if ifaceName == "" {
+		routes, err := getDefaultRoutes(syscall.AF_INET)
+		if err != nil {
+			return err
+		}
+		if len(routes) == 0 {
+			return fmt.Errorf("there is no default route")
+		}
+		ifaceName = routes[0].Interface.Name
+	}
+
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+
+	fd, err := openARPSocket(iface)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	senderIP := config.IPAddress.To4()
+	if senderIP == nil {
+		senderIP = net.IPv4zero.To4()
+	}
+
+	err = sendARP(fd, iface, arpRequest, senderIP, gateway)
+	if err != nil {
+		return err
+	}
+
+	// A reply from the gateway looks just like a conflict with its
+	// address would when we're probing for one.
+	replied, err := awaitARPConflict(fd, iface, gateway, networkCheckTimeout)
+	if err != nil {
+		return err
+	}
+	if !replied {
+		return fmt.Errorf("no ARP reply")
+	}
+	return nil
+}
+
+// checkNameserver sends a query for the root zone's nameservers to the
+// given nameserver and checks that it answers successfully.
+func checkNameserver(ns net.IP) error {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(ns.String(), "53"), networkCheckTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	id := uint16(rand.Intn(65536))
+	query := make([]byte, 17)
+	binary.BigEndian.PutUint16(query[0:2], id)
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(query[4:6], 1)      // one question
+	// query[12] is the empty name of the root zone.
+	binary.BigEndian.PutUint16(query[13:15], 2) // type NS
+	binary.BigEndian.PutUint16(query[15:17], 1) // class IN
+
+	conn.SetDeadline(time.Now().Add(networkCheckTimeout))
+	_, err = conn.Write(query)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n < 12 || binary.BigEndian.Uint16(buf[0:2]) != id {
+			// Not an answer to our query.
+			continue
+		}
+
+		flags := binary.BigEndian.Uint16(buf[2:4])
+		if flags&0x8000 == 0 {
+			continue
+		}
+
+		switch rcode := flags & 0xf; rcode {
+		case 0, 3:
+			// NOERROR and NXDOMAIN both mean that the server is working.
+			return nil
+		case 2:
+			return fmt.Errorf("server failure")
+		case 5:
+			return fmt.Errorf("query refused")
+		default:
+			return fmt.Errorf("response code %d", rcode)
+		}
+	}
+}
+
+// networkCheckSummary describes the failed checks in the given results,
+// or returns the empty string if none failed.
+func networkCheckSummary(checks []NetworkCheck) string {
+	var failed []string
+	for _, check := range checks {
+		if check.Failed() {
+			failed = append(failed, check.Name)
+		}
+	}
+	if len(failed) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Unreachable: %s", strings.Join(failed, ", "))
+}
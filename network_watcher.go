@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// NetworkWatcher keeps calling ConfigureNetwork in the background after
+// boot, as NetworkConfigurer requires, and feeds any changes in network
+// configuration through to the rest of the system.
+type NetworkWatcher struct {
+	Booter     *Booter
+	Console    *Console
+	NodeConfig *NodeConfig
+
+	// LinkMonitor, if set, is kept informed of each new configuration so
+	// that it monitors the right interfaces.
+	LinkMonitor *LinkMonitor
+
+	current *NetworkConfig
+	broken  bool
+}
+
+// Some NetworkConfigurer implementations return immediately rather than
+// blocking until something changes, so we'll never call ConfigureNetwork
+// more often than this.
+const networkWatchMinInterval = time.Minute
+
+// NewNetworkWatcher returns a watcher that will compare future network
+// configurations against the given initial configuration.
+func NewNetworkWatcher(booter *Booter, console *Console, netConfig *NetworkConfig, nodeConfig *NodeConfig) *NetworkWatcher {
+	return &NetworkWatcher{
+		Booter:     booter,
+		Console:    console,
+		NodeConfig: nodeConfig,
+		current:    netConfig,
+	}
+}
+
+// Run watches for network configuration changes forever, and so should
+// usually be run in its own goroutine.
+func (w *NetworkWatcher) Run() {
+	for {
+		started := time.Now()
+
+		netConfig, err := w.Booter.ConfigureNetwork()
+		if err != nil {
+			log.Printf("[ERROR] Failed to refresh network configuration: %s", err)
+			w.Console.SetWarning("network-watch", "Network refresh failed; see log")
+		} else {
+			w.Console.SetWarning("network-watch", "")
+			w.update(netConfig)
+		}
+
+		if elapsed := time.Since(started); elapsed < networkWatchMinInterval {
+			time.Sleep(networkWatchMinInterval - elapsed)
+		}
+	}
+}
+
+func (w *NetworkWatcher) update(netConfig *NetworkConfig) {
+	if !netConfig.IPAddress.Equal(w.current.IPAddress) {
+		// The rest of defgrid assumes that a node's IP address never
+		// changes, so once this happens there's nothing sensible we can
+		// do except make a lot of noise and wait for an operator to
+		// replace the node.
+		if !w.broken {
+			w.broken = true
+			err := fmt.Errorf(
+				"IP address changed from %s to %s",
+				w.current.IPAddress, netConfig.IPAddress,
+			)
+			log.Printf("[ALERT] %s; this node must be replaced", err)
+			w.Console.FatalError(err)
+		}
+		return
+	}
+
+	ipv6Changed := !ipListsEqual(netConfig.IPv6Addresses(), w.current.IPv6Addresses())
+	routersChanged := !ipListsEqual(netConfig.Routers, w.current.Routers)
+	nameserversChanged := !ipListsEqual(netConfig.SuggestedNameservers, w.current.SuggestedNameservers)
+	w.current = netConfig
+
+	if w.LinkMonitor != nil {
+		w.LinkMonitor.SetConfig(netConfig)
+	}
+
+	if ipv6Changed {
+		// Unlike the primary address, IPv6 addresses may legitimately
+		// come and go as router advertisements and DHCPv6 leases change.
+		ipv6Addrs := netConfig.IPv6Addresses()
+		log.Printf("IPv6 addresses changed to %s", ipListString(ipv6Addrs))
+		var ipv6Addr net.IP
+		if len(ipv6Addrs) > 0 {
+			ipv6Addr = ipv6Addrs[0]
+		}
+		w.Console.SetIPv6Address(ipv6Addr)
+	}
+
+	if routersChanged {
+		log.Printf("Network routers changed to %s", ipListString(netConfig.Routers))
+	}
+
+	if nameserversChanged {
+		log.Printf("Network nameservers changed to %s", ipListString(netConfig.SuggestedNameservers))
+	}
+
+	if routersChanged || nameserversChanged {
+		err := w.Booter.ReconfigureResolver(netConfig, w.NodeConfig)
+		if err != nil {
+			log.Printf("[ERROR] Failed to reconfigure resolver: %s", err)
+			w.Console.SetWarning("resolver", "Resolver reconfiguration failed; see log")
+		} else {
+			w.Console.SetWarning("resolver", "")
+		}
+	}
+}
+
+func ipListsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func ipListString(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "(none)"
+	}
+	s := ips[0].String()
+	for _, ip := range ips[1:] {
+		s = s + ", " + ip.String()
+	}
+	return s
+}
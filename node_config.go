@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
 // NodeConfig is the configuration of a particular node from the perspective
 // of how it interacts with its hosting platform and with the rest of the
 // defgrid infrastructure.
@@ -20,3 +26,19 @@ type NodeConfigGetter interface {
 	// returned will remain valid for the lifetime of the node.
 	GetNodeConfig(*NetworkConfig) (*NodeConfig, error)
 }
+
+// hostnameFromIP synthesizes a hostname that is unique to the given IP
+// address, for use by NodeConfigGetter implementations that have no
+// better source of node identity.
+//
+// IPv4 addresses produce names like "ip-0a000001", and IPv6 addresses
+// produce names like "ip6-20010db8000000000000000000000001".
+func hostnameFromIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf(
+			"ip-%02x%02x%02x%02x",
+			ip4[0], ip4[1], ip4[2], ip4[3],
+		)
+	}
+	return "ip6-" + hex.EncodeToString(ip.To16())
+}
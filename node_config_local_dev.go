@@ -1,9 +1,5 @@
 package main
 
-import (
-	"fmt"
-)
-
 // NodeConfigGetterLocalDev is a NodeConfigGetter implementation that just
 // synthesizes some reasonable NodeConfig values based on the given network
 // config.
@@ -15,13 +11,7 @@ type NodeConfigGetterLocalDev struct {
 }
 
 func (n *NodeConfigGetterLocalDev) GetNodeConfig(net *NetworkConfig) (*NodeConfig, error) {
-	ipAddr := net.IPAddress
-	// Here we're assuming an IPv4 address, since that's all we support
-	// right now.
-	hostname := fmt.Sprintf(
-		"ip-%02x%02x%02x%02x",
-		ipAddr[0], ipAddr[1], ipAddr[2], ipAddr[3],
-	)
+	hostname := hostnameFromIP(net.IPAddress)
 	return &NodeConfig{
 		Hostname:       hostname,
 		RegionName:     "local-dev",
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+)
+
+// NodeConfigGetterStatic is a NodeConfigGetter implementation for
+// environments with no metadata service, such as bare-metal racks, where
+// the node's placement is given on the kernel command line instead.
+//
+// The region and datacenter are taken from the "defgrid.region" and
+// "defgrid.datacenter" kernel parameters. The hostname is taken from the
+// network configuration if it suggests one, or is otherwise synthesized
+// from the node's IP address.
+type NodeConfigGetterStatic struct {
+	// CmdlinePath is the location of the kernel command line. If empty,
+	// /proc/cmdline is used.
+	CmdlinePath string
+}
+
+func (n *NodeConfigGetterStatic) GetNodeConfig(net *NetworkConfig) (*NodeConfig, error) {
+	cmdlinePath := n.CmdlinePath
+	if cmdlinePath == "" {
+		cmdlinePath = kernelCmdlinePath
+	}
+	cmdline, err := ReadKernelCmdline(cmdlinePath)
+	if err != nil {
+		return nil, err
+	}
+
+	regionName := cmdline["defgrid.region"]
+	if regionName == "" {
+		return nil, fmt.Errorf("defgrid.region kernel parameter is required")
+	}
+
+	datacenterName := cmdline["defgrid.datacenter"]
+	if datacenterName == "" {
+		datacenterName = regionName
+	}
+
+	hostname := net.SuggestedHostname
+	if hostname == "" {
+		hostname = hostnameFromIP(net.IPAddress)
+	}
+
+	return &NodeConfig{
+		Hostname:       hostname,
+		RegionName:     regionName,
+		DatacenterName: datacenterName,
+	}, nil
+}
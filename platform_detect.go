@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PlatformDetector inspects the system to choose a boot flavor, for when
+// the operator hasn't named one.
+//
+// It considers container markers, DMI data from /sys/class/dmi/id, the
+// presence of a config drive and the "hypervisor" CPU flag in
+// /proc/cpuinfo, in that order of precedence. A chassis asset tag of the
+// form
+// "defgrid.flavor=<name>" overrides the hardware-based detection, so
+// that operators can label machines whose hardware is ambiguous.
+type PlatformDetector struct {
+	// Root is prefixed to every path the detector reads, so that it can
+	// be pointed at a fake filesystem tree. If empty, the real root
+	// filesystem is used.
+	Root string
+
+	// PID is our process id, used to tell whether we're running as init.
+	// If zero, the real process id is used.
+	PID int
+}
+
+// Platform is the result of platform detection.
+type Platform struct {
+	// Flavor is the chosen flavor, or empty if none is suitable.
+	Flavor string
+
+	// Reasons explains, in order, the observations that led to the
+	// choice of flavor, for logging.
+	Reasons []string
+}
+
+// The DMI system vendors of hypervisors, which we can recognize even if
+// the CPU flag is hidden.
+var hypervisorVendors = map[string]string{
+	"QEMU":                  "QEMU",
+	"VMware, Inc.":          "VMware",
+	"innotek GmbH":          "VirtualBox",
+	"Xen":                   "Xen",
+	"Microsoft Corporation": "Hyper-V",
+	"Amazon EC2":            "EC2",
+	"Google":                "Google Compute Engine",
+}
+
+// configDrivePath is where the config drive appears, by its filesystem
+// label.
+const configDrivePath = "dev/disk/by-label/config-2"
+
+// Detect examines the system and chooses a flavor. If no flavor is
+// suitable, the result has an empty Flavor and its Reasons explain why.
+func (d *PlatformDetector) Detect() *Platform {
+	p := &Platform{}
+
+	if marker := d.containerMarker(); marker != "" {
+		p.reason("running in a container (%s)", marker)
+		p.Flavor = "devcontainer"
+		return p
+	}
+
+	pid := d.PID
+	if pid == 0 {
+		pid = os.Getpid()
+	}
+	if pid != 1 {
+		p.reason("not running as init (pid %d)", pid)
+		p.Flavor = "dev"
+		return p
+	}
+
+	vendor := d.readDMI("sys_vendor")
+	product := d.readDMI("product_name")
+	if vendor != "" || product != "" {
+		p.reason("DMI reports %q %q", vendor, product)
+	}
+
+	assetTag := d.readDMI("chassis_asset_tag")
+	if strings.HasPrefix(assetTag, "defgrid.flavor=") {
+		p.reason("chassis asset tag is %q", assetTag)
+		p.Flavor = strings.TrimPrefix(assetTag, "defgrid.flavor=")
+		return p
+	}
+
+	hypervisor := hypervisorVendors[vendor]
+	if hypervisor == "" && strings.Contains(product, "KVM") {
+		hypervisor = "KVM"
+	}
+
+	// Bare-metal provisioners such as OpenStack Ironic attach a config
+	// drive, which tells us we're a bare-metal node even if the CPU
+	// claims a hypervisor, as it does on hardware partitioned by its
+	// firmware.
+	configDrive := d.exists(configDrivePath)
+	if configDrive {
+		p.reason("config drive is present")
+	}
+	if hypervisor == "" && configDrive {
+		p.reason("no hypervisor named in DMI, so assuming a provisioned bare-metal node")
+		p.Flavor = "baremetal"
+		return p
+	}
+
+	if hypervisor == "" && d.hasCPUFlag("hypervisor") {
+		hypervisor = "an unknown hypervisor"
+	}
+
+	if hypervisor != "" {
+		p.reason("running under %s", hypervisor)
+		switch hypervisor {
+		case "QEMU", "KVM":
+			// Our only virtual machine flavor is the local qemu test
+			// host, so that's what we must be.
+			p.Flavor = "testhost"
+		default:
+			p.reason("no flavor supports this hypervisor")
+		}
+		return p
+	}
+
+	p.reason("no hypervisor detected, so assuming physical hardware")
+	p.Flavor = "baremetal"
+	return p
+}
+
+func (p *Platform) reason(format string, args ...interface{}) {
+	p.Reasons = append(p.Reasons, fmt.Sprintf(format, args...))
+}
+
+func (d *PlatformDetector) path(name string) string {
+	root := d.Root
+	if root == "" {
+		root = "/"
+	}
+	return filepath.Join(root, name)
+}
+
+func (d *PlatformDetector) exists(name string) bool {
+	_, err := os.Stat(d.path(name))
+	return err == nil
+}
+
+// readDMI returns the value of the named DMI attribute, or the empty
+// string if it isn't available.
+func (d *PlatformDetector) readDMI(name string) string {
+	data, err := ioutil.ReadFile(d.path(filepath.Join("sys/class/dmi/id", name)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// containerMarker returns a description of whatever shows that we're in
+// a container, or the empty string if nothing does.
+func (d *PlatformDetector) containerMarker() string {
+	for _, marker := range []string{".dockerenv", "run/.containerenv"} {
+		if d.exists(marker) {
+			return "/" + marker
+		}
+	}
+
+	f, err := os.Open(d.path("proc/1/cgroup"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		line := lines.Text()
+		for _, runtime := range []string{"docker", "kubepods", "lxc", "containerd"} {
+			if strings.Contains(line, runtime) {
+				return fmt.Sprintf("%s cgroup", runtime)
+			}
+		}
+	}
+	return ""
+}
+
+// hasCPUFlag returns true if the first CPU in /proc/cpuinfo has the given
+// flag.
+func (d *PlatformDetector) hasCPUFlag(flag string) bool {
+	f, err := os.Open(d.path("proc/cpuinfo"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.SplitN(lines.Text(), ":", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) != "flags" {
+			continue
+		}
+		for _, name := range strings.Fields(fields[1]) {
+			if name == flag {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlatformDetectorDetect(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      map[string]string
+		pid        int
+		wantFlavor string
+	}{
+		{
+			name: "docker container",
+			files: map[string]string{
+				".dockerenv": "",
+			},
+			pid:        1,
+			wantFlavor: "devcontainer",
+		},
+		{
+			name: "container cgroup",
+			files: map[string]string{
+				"proc/1/cgroup": "0::/kubepods/besteffort/pod1234\n",
+			},
+			pid:        1,
+			wantFlavor: "devcontainer",
+		},
+		{
+			name: "container wins over pid",
+			files: map[string]string{
+				"run/.containerenv": "",
+			},
+			pid:        42,
+			wantFlavor: "devcontainer",
+		},
+		{
+			name:       "not init",
+			pid:        42,
+			wantFlavor: "dev",
+		},
+		{
+			name: "not init under qemu",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor": "QEMU\n",
+			},
+			pid:        42,
+			wantFlavor: "dev",
+		},
+		{
+			name: "asset tag",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor":        "QEMU\n",
+				"sys/class/dmi/id/chassis_asset_tag": "defgrid.flavor=baremetal\n",
+			},
+			pid:        1,
+			wantFlavor: "baremetal",
+		},
+		{
+			name: "unrelated asset tag",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor":        "QEMU\n",
+				"sys/class/dmi/id/chassis_asset_tag": "rack 12\n",
+			},
+			pid:        1,
+			wantFlavor: "testhost",
+		},
+		{
+			name: "qemu vendor",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor":   "QEMU\n",
+				"sys/class/dmi/id/product_name": "Standard PC (Q35 + ICH9, 2009)\n",
+			},
+			pid:        1,
+			wantFlavor: "testhost",
+		},
+		{
+			name: "kvm product",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor":   "Red Hat\n",
+				"sys/class/dmi/id/product_name": "KVM\n",
+			},
+			pid:        1,
+			wantFlavor: "testhost",
+		},
+		{
+			name: "unsupported hypervisor",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor": "VMware, Inc.\n",
+			},
+			pid:        1,
+			wantFlavor: "",
+		},
+		{
+			name: "hypervisor cpu flag",
+			files: map[string]string{
+				"proc/cpuinfo": "processor\t: 0\nflags\t\t: fpu vme hypervisor lahf_lm\n",
+			},
+			pid:        1,
+			wantFlavor: "",
+		},
+		{
+			name: "bare metal",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor":   "Supermicro\n",
+				"sys/class/dmi/id/product_name": "SYS-1029P-WTR\n",
+				"proc/cpuinfo":                  "processor\t: 0\nflags\t\t: fpu vme lahf_lm\n",
+				"proc/1/cgroup":                 "0::/init.scope\n",
+			},
+			pid:        1,
+			wantFlavor: "baremetal",
+		},
+		{
+			name: "config drive",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor": "Dell Inc.\n",
+				configDrivePath:               "",
+			},
+			pid:        1,
+			wantFlavor: "baremetal",
+		},
+		{
+			name: "config drive despite hypervisor cpu flag",
+			files: map[string]string{
+				"proc/cpuinfo":  "processor\t: 0\nflags\t\t: fpu vme hypervisor lahf_lm\n",
+				configDrivePath: "",
+			},
+			pid:        1,
+			wantFlavor: "baremetal",
+		},
+		{
+			name: "config drive under qemu",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor": "QEMU\n",
+				configDrivePath:               "",
+			},
+			pid:        1,
+			wantFlavor: "testhost",
+		},
+		{
+			name:       "bare metal without dmi",
+			pid:        1,
+			wantFlavor: "baremetal",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range test.files {
+				path := filepath.Join(root, name)
+				err := os.MkdirAll(filepath.Dir(path), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(path, []byte(content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := &PlatformDetector{Root: root, PID: test.pid}
+			got := d.Detect()
+			if got.Flavor != test.wantFlavor {
+				t.Errorf("wrong flavor %q; want %q\nreasons: %q", got.Flavor, test.wantFlavor, got.Reasons)
+			}
+			if len(got.Reasons) == 0 {
+				t.Errorf("no reasons given for %q", got.Flavor)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 // ResolverConfigurerResolvDirect is a ResolverConfigurer implementation that
@@ -17,16 +18,25 @@ type ResolverConfigurerResolvDirect struct {
 }
 
 func (r *ResolverConfigurerResolvDirect) ConfigureResolver(net *NetworkConfig, node *NodeConfig) error {
-	f, err := os.Create("/etc/resolv.conf")
+	f, err := os.Create(resolvConfPath)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	if net.SuggestedNameservers == nil || len(net.SuggestedNameservers) == 0 {
 		return nil
 	}
 
-	log.Println("Configuring /etc/resolv.conf...")
+	log.Printf("Configuring %s...", resolvConfPath)
+	if len(net.SuggestedSearchDomains) > 0 {
+		searchList := strings.Join(net.SuggestedSearchDomains, " ")
+		log.Printf("resolv.conf search %s", searchList)
+		_, err := fmt.Fprintf(f, "search %s\n", searchList)
+		if err != nil {
+			return err
+		}
+	}
 	for _, nsIP := range net.SuggestedNameservers {
 		log.Printf("resolv.conf nameserver %s", nsIP)
 		_, err := fmt.Fprintf(f, "nameserver %s\n", nsIP)
@@ -39,8 +49,8 @@ func (r *ResolverConfigurerResolvDirect) ConfigureResolver(net *NetworkConfig, n
 }
 
 func (r *ResolverConfigurerResolvDirect) UnconfigureResolver() error {
-	log.Println("Removing /etc/resolv.conf...")
-	err := os.Remove("/etc/resolv.conf")
+	log.Printf("Removing %s...", resolvConfPath)
+	err := os.Remove(resolvConfPath)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
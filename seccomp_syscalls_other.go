@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package main
+
+// We don't have syscall tables for other architectures, so seccomp
+// profiles can't be used on them.
+
+const seccompAuditArch = 0
+const seccompSyscallBits = 0
+
+var seccompSyscalls map[string]uint32
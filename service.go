@@ -7,3 +7,16 @@ const (
 	ServiceWarning
 	ServicePassing
 )
+
+func (s ServiceStatus) String() string {
+	switch s {
+	case ServiceCritical:
+		return "critical"
+	case ServiceWarning:
+		return "warning"
+	case ServicePassing:
+		return "passing"
+	default:
+		return "unknown"
+	}
+}
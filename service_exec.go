@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// ServiceExec describes how defgrid-init sets up a service's process
+// between fork and exec.
+//
+// Go can't run code of our own in the child between fork and exec, so
+// instead the child is defgrid-init itself, re-executed with a special
+// argv[0], which sets up the service's environment as described here and
+// then executes the service's program in its place.
+type ServiceExec struct {
+	// Isolation, if set, runs the service in namespaces of its own.
+	Isolation *ServiceIsolation `json:"isolation"`
+
+	// Privileges, if set, restricts what the service may do.
+	Privileges *ServicePrivileges `json:"privileges"`
+}
+
+// serviceExecArg is the argv[0] that tells defgrid-init that it has been
+// re-executed to set up a service's environment, and serviceExecChildArg
+// the one for an isolated service's second re-execution, as the child of
+// runServiceInit.
+const (
+	serviceExecArg      = "defgrid-init:service-exec"
+	serviceExecChildArg = "defgrid-init:service-exec-child"
+)
+
+// The environment variables that pass the ServiceExec and the path of
+// the service's cgroup to the re-executed defgrid-init.
+const (
+	serviceExecEnvVar   = "DGI_SERVICE_EXEC"
+	serviceCgroupEnvVar = "DGI_SERVICE_CGROUP"
+)
+
+// Command returns a command that runs the given program, with the given
+// arguments, in the environment described by the ServiceExec. When the
+// service is isolated, the program path is as seen from within its
+// isolated root filesystem.
+//
+// If cgroup isn't nil, the program runs in that cgroup. The re-executed
+// defgrid-init moves itself into the cgroup before executing the program,
+// so that the program can't start any processes outside of it.
+func (e *ServiceExec) Command(cgroup *Cgroup, path string, args ...string) (*exec.Cmd, error) {
+	if e.Isolation == nil && e.Privileges == nil && cgroup == nil {
+		return exec.Command(path, args...), nil
+	}
+
+	if e.Isolation != nil {
+		err := e.Isolation.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.Privileges != nil {
+		err := e.Privileges.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	spec, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("/proc/self/exe", append([]string{path}, args...)...)
+	cmd.Args[0] = serviceExecArg
+	cmd.Env = append(os.Environ(), serviceExecEnvVar+"="+string(spec))
+	if cgroup != nil {
+		cmd.Env = append(cmd.Env, serviceCgroupEnvVar+"="+cgroup.Path)
+	}
+
+	if e.Isolation != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags: e.Isolation.cloneFlags(),
+		}
+	}
+
+	return cmd, nil
+}
+
+// IsServiceExec returns true if we were started by a command from
+// ServiceExec.Command, in which case main should call RunServiceExec
+// instead of booting.
+func IsServiceExec() bool {
+	return len(os.Args) > 0 && (os.Args[0] == serviceExecArg || os.Args[0] == serviceExecChildArg)
+}
+
+// RunServiceExec sets up the service environment described in our
+// environment and then executes the service's program in it. It only
+// returns if something goes wrong, in which case we exit with an error,
+// since we're not init in this case.
+func RunServiceExec() {
+	err := runServiceExec()
+	fmt.Fprintf(os.Stderr, "defgrid-init: failed to start service: %s\n", err)
+	os.Exit(127)
+}
+
+func runServiceExec() error {
+	// Capabilities, no_new_privs and seccomp filters all belong to the
+	// thread that sets them, and it's that thread's which the program
+	// inherits when that thread calls exec, so everything from here on
+	// must happen on one thread.
+	runtime.LockOSThread()
+
+	if len(os.Args) < 2 {
+		return fmt.Errorf("no program given")
+	}
+
+	var e ServiceExec
+	err := json.Unmarshal([]byte(os.Getenv(serviceExecEnvVar)), &e)
+	if err != nil {
+		return fmt.Errorf("invalid service exec spec: %s", err)
+	}
+	cgroupPath := os.Getenv(serviceCgroupEnvVar)
+	env := make([]string, 0, len(os.Environ()))
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, serviceExecEnvVar+"=") && !strings.HasPrefix(v, serviceCgroupEnvVar+"=") {
+			env = append(env, v)
+		}
+	}
+
+	// An isolated service's child was set up by its parent, and only
+	// needs its privileges applied.
+	if os.Args[0] == serviceExecArg {
+		// This must come before the isolation setup, after which the
+		// cgroup filesystem may no longer be visible.
+		if cgroupPath != "" {
+			// Pid 0 means the process writing to cgroup.procs.
+			err := (&Cgroup{Path: cgroupPath}).AddProcess(0)
+			if err != nil {
+				return fmt.Errorf("failed to join cgroup: %s", err)
+			}
+		}
+
+		if e.Isolation != nil {
+			err := e.Isolation.setup()
+			if err != nil {
+				return err
+			}
+			return runServiceInit()
+		}
+	}
+
+	// Find the program before applying the privilege restrictions, since
+	// a seccomp profile might not allow us to look for it afterwards.
+	path := os.Args[1]
+	if !strings.Contains(path, "/") {
+		path, err = exec.LookPath(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.Privileges != nil {
+		err := e.Privileges.apply()
+		if err != nil {
+			return err
+		}
+	}
+
+	return syscall.Exec(path, os.Args[1:], env)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// The tests that start services re-execute the test binary in place
+	// of defgrid-init.
+	if IsServiceExec() {
+		RunServiceExec()
+	}
+	if os.Getenv(seccompRuntimeTestEnvVar) != "" {
+		seccompRuntimeTestChild()
+	}
+	os.Exit(m.Run())
+}
+
+// requireRoot skips tests that need to create namespaces and mounts.
+func requireRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must be run as root")
+	}
+}
+
+func TestServiceIsolationHidden(t *testing.T) {
+	iso := &ServiceIsolation{}
+	if got := iso.hidden(); len(got) != len(isolationDefaultHidden) || got[0] != "/var/lib/defgrid" {
+		t.Errorf("wrong default hidden directories %q", got)
+	}
+
+	iso.Hidden = []string{}
+	if got := iso.hidden(); len(got) != 0 {
+		t.Errorf("empty list hides %q; want nothing", got)
+	}
+}
+
+func TestServiceIsolationValidate(t *testing.T) {
+	valid := &ServiceIsolation{
+		Hidden: []string{"/var/lib/defgrid"},
+		Binds:  []ServiceBind{{Source: "/var/lib/defgrid/consul", Target: "/var/lib/defgrid/consul"}},
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for _, iso := range []*ServiceIsolation{
+		{Root: "srv/consul"},
+		{Hidden: []string{"var/lib"}},
+		{Binds: []ServiceBind{{Source: "data", Target: "/data"}}},
+	} {
+		if err := iso.validate(); err == nil {
+			t.Errorf("no error for %#v", iso)
+		}
+	}
+}
+
+func TestServiceIsolationRun(t *testing.T) {
+	requireRoot(t)
+
+	// The data directory mustn't be beneath /tmp, since the service gets
+	// a private /tmp.
+	dir, err := os.MkdirTemp("/var/tmp", "defgrid-isolation-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hidden := filepath.Join(dir, "hidden")
+	data := filepath.Join(dir, "data")
+	for _, d := range []string{hidden, data} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(hidden, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, "file"), []byte("bound"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &ServiceExec{
+		Isolation: &ServiceIsolation{
+			Hostname: "isolated",
+			Network:  true,
+			Hidden:   []string{hidden},
+			Binds:    []ServiceBind{{Source: data, Target: filepath.Join(hidden, "data")}},
+		},
+	}
+	script := `
+echo "pid $$"
+echo "init $(tr '\0' '\n' < /proc/1/cmdline | head -1)"
+echo "hostname $(hostname)"
+echo "hidden $(ls -A ` + hidden + `)"
+echo "bound $(cat ` + hidden + `/data/file)"
+touch ` + hidden + `/data/written && echo "bind writable"
+touch /isolation-probe 2>/dev/null && echo "root writable"
+touch /tmp/probe && echo "tmp writable"
+awk '$5 == "/proc/sys" || $5 == "/proc/sysrq-trigger" { split($6, o, ","); print $5, o[1] }' /proc/self/mountinfo
+echo "links $(ls /sys/class/net)"
+`
+	cmd, err := e.Command(nil, "sh", "-c", script)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("service failed: %s\n%s", err, stderr.String())
+	}
+
+	want := []string{
+		"init " + serviceExecArg + "\n",
+		"hostname isolated",
+		"hidden data",
+		"bound bound",
+		"bind writable",
+		"tmp writable",
+		"/proc/sys ro",
+		"links lo",
+	}
+	if _, err := os.Stat("/proc/sysrq-trigger"); err == nil {
+		want = append(want, "/proc/sysrq-trigger ro")
+	}
+	got := string(out)
+	if strings.Contains(got, "pid 1\n") {
+		t.Errorf("service is PID 1 in its namespace")
+	}
+	for _, line := range want {
+		if !strings.Contains(got, line) {
+			t.Errorf("output lacks %q\n%s", line, got)
+		}
+	}
+	if strings.Contains(got, "root writable") {
+		t.Errorf("root filesystem is writable")
+		os.Remove("/isolation-probe")
+	}
+	if _, err := os.Stat(filepath.Join(data, "written")); err != nil {
+		t.Errorf("write to bind mount didn't reach the data directory: %s", err)
+	}
+}
+
+func TestServiceIsolationSignals(t *testing.T) {
+	requireRoot(t)
+
+	// The stand-in init must pass SIGTERM on to the service, and exit
+	// with the service's status.
+	e := &ServiceExec{Isolation: &ServiceIsolation{}}
+	cmd, err := e.Command(nil, "sh", "-c", `trap 'exit 7' TERM; echo ready; while true; do sleep 0.1; done`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := stdout.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	err = cmd.Wait()
+	if cmd.ProcessState.ExitCode() != 7 {
+		t.Errorf("wrong exit status %s; want 7", err)
+	}
+}
+
+func TestServiceIsolationReapsOrphans(t *testing.T) {
+	requireRoot(t)
+
+	// The orphaned sleep is inherited by the stand-in init, which must
+	// reap it rather than leave a zombie.
+	e := &ServiceExec{Isolation: &ServiceIsolation{}}
+	cmd, err := e.Command(nil, "sh", "-c", `sh -c 'sleep 0.1 &'; sleep 0.5; echo "zombies $(grep -l '^State:.*Z' /proc/[0-9]*/status | wc -l)"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("service failed: %s", err)
+	}
+	if got, want := strings.TrimSpace(string(out)), "zombies 0"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
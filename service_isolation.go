@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/libcontainer/netlink"
+)
+
+// ServiceIsolation describes how to isolate a service's processes from
+// the rest of the system, and in particular from other services on the
+// same node, so that e.g. Nomad can't read Vault's files.
+//
+// An isolated service runs in new mount, PID, UTS and IPC namespaces, and
+// optionally a new network namespace. Its root filesystem is read-only
+// except for a private /tmp and /run, a minimal /dev, and the data
+// directories that are bind-mounted in for it. Kernel settings in
+// /proc/sys and /proc/sysrq-trigger are read-only too.
+//
+// The re-executed defgrid-init that sets up the namespaces stays on as
+// PID 1 within them, with the service as its child; see runServiceInit.
+type ServiceIsolation struct {
+	// Root is the directory to use as the service's root filesystem,
+	// which defaults to the real root filesystem.
+	Root string `json:"root"`
+
+	// Hostname, if set, is the service's hostname within its own UTS
+	// namespace.
+	Hostname string `json:"hostname"`
+
+	// Network gives the service a network namespace of its own, with
+	// only a loopback interface, for services that don't need the
+	// network at all.
+	Network bool `json:"network"`
+
+	// Hidden lists directories under Root that are replaced with empty
+	// directories for the service. The data directories of all services
+	// should be beneath one of these, so that each service sees only its
+	// own. If Hidden is omitted, isolationDefaultHidden is used, whereas
+	// an empty list hides nothing. Directories that don't exist are
+	// skipped.
+	Hidden []string `json:"hidden"`
+
+	// Binds are the directories bind-mounted into the service's root
+	// filesystem, such as its data directory.
+	Binds []ServiceBind `json:"binds"`
+}
+
+// ServiceBind is a directory bind-mounted into an isolated service's root
+// filesystem. The target directory is created if necessary, beneath a
+// hidden directory if need be.
+type ServiceBind struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// Where an isolated service's root filesystem is assembled before we
+// pivot into it. This is only a mount point, which each service mounts
+// over in its own mount namespace, so they can all share it.
+const isolationStagingDir = "/run/defgrid-init/isolated-root"
+
+// The directories hidden from isolated services unless they say
+// otherwise, which hold the data of all services and of defgrid-init
+// itself.
+var isolationDefaultHidden = []string{"/var/lib/defgrid", "/var/lib/defgrid-init"}
+
+// The files in an isolated service's /proc that are made read-only, since
+// they control the whole system rather than just the service's
+// namespaces.
+var isolationReadOnlyProc = []string{"/proc/sys", "/proc/sysrq-trigger"}
+
+// The signals that runServiceInit passes on to the service.
+var isolationForwardedSignals = []os.Signal{
+	syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+// The devices available in an isolated service's /dev.
+var isolatedDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// cloneFlags returns the flags for creating the service's namespaces.
+func (iso *ServiceIsolation) cloneFlags() uintptr {
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC)
+	if iso.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return flags
+}
+
+// validate checks the isolation settings for mistakes before we try to
+// start a service with them.
+func (iso *ServiceIsolation) validate() error {
+	if iso.Root != "" && !filepath.IsAbs(iso.Root) {
+		return fmt.Errorf("isolation root %q is not an absolute path", iso.Root)
+	}
+	for _, dir := range iso.Hidden {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("hidden directory %q is not an absolute path", dir)
+		}
+	}
+	for _, bind := range iso.Binds {
+		if !filepath.IsAbs(bind.Source) || !filepath.IsAbs(bind.Target) {
+			return fmt.Errorf("bind of %q to %q must use absolute paths", bind.Source, bind.Target)
+		}
+	}
+	return nil
+}
+
+func (iso *ServiceIsolation) hidden() []string {
+	if iso.Hidden == nil {
+		return isolationDefaultHidden
+	}
+	return iso.Hidden
+}
+
+// setup runs in the re-executed defgrid-init, within the service's new
+// namespaces, and prepares its environment.
+func (iso *ServiceIsolation) setup() error {
+	err := iso.setupRoot()
+	if err != nil {
+		return err
+	}
+
+	if iso.Hostname != "" {
+		err := syscall.Sethostname([]byte(iso.Hostname))
+		if err != nil {
+			return fmt.Errorf("failed to set hostname: %s", err)
+		}
+	}
+
+	if iso.Network {
+		lo, err := net.InterfaceByName("lo")
+		if err != nil {
+			return err
+		}
+		err = netlink.NetworkLinkUp(lo)
+		if err != nil {
+			return fmt.Errorf("failed to bring up loopback interface: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// setupRoot assembles the service's root filesystem in the staging
+// directory, pivots into it and makes it read-only.
+func (iso *ServiceIsolation) setupRoot() error {
+	root := iso.Root
+	if root == "" {
+		root = "/"
+	}
+
+	// Our mount namespace starts as a copy of the parent's, so first we
+	// must make sure nothing we do here propagates back to it.
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("failed to make mounts private: %s", err)
+	}
+
+	staging := isolationStagingDir
+	err = os.MkdirAll(staging, 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount(root, staging, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind %s: %s", root, err)
+	}
+	in := func(path string) string {
+		return filepath.Join(staging, path)
+	}
+
+	// The directories that stay writable once the rest of the root
+	// filesystem is made read-only.
+	writable := map[string]bool{}
+
+	for _, dir := range []string{"/tmp", "/run"} {
+		mode := "mode=0755"
+		if dir == "/tmp" {
+			mode = "mode=1777"
+		}
+		err := mountIsolatedTmpfs(in(dir), mode)
+		if err != nil {
+			return err
+		}
+		writable[dir] = true
+	}
+
+	for _, dir := range iso.hidden() {
+		if _, err := os.Stat(in(dir)); os.IsNotExist(err) {
+			continue
+		}
+		err := mountIsolatedTmpfs(in(dir), "mode=0755")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = setupIsolatedDev(in("/dev"))
+	if err != nil {
+		return err
+	}
+	writable["/dev"] = true
+	writable["/dev/pts"] = true
+	writable["/dev/shm"] = true
+
+	for _, bind := range iso.Binds {
+		err := os.MkdirAll(in(bind.Target), 0755)
+		if err != nil {
+			return err
+		}
+		err = syscall.Mount(bind.Source, in(bind.Target), "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return fmt.Errorf("failed to bind %s to %s: %s", bind.Source, bind.Target, err)
+		}
+		if !bind.ReadOnly {
+			writable[filepath.Clean(bind.Target)] = true
+		}
+	}
+
+	// Our new PID namespace needs a /proc of its own, showing only its
+	// own processes.
+	err = os.MkdirAll(in("/proc"), 0555)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("proc", in("/proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("failed to mount /proc: %s", err)
+	}
+	for _, path := range isolationReadOnlyProc {
+		// Some kernels are built without sysrq.
+		if _, err := os.Stat(in(path)); os.IsNotExist(err) {
+			continue
+		}
+		err := syscall.Mount(in(path), in(path), "", syscall.MS_BIND, "")
+		if err == nil {
+			err = syscall.Mount("", in(path), "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to make %s read-only: %s", path, err)
+		}
+	}
+
+	// sysfs shows the network devices of the namespace it was mounted
+	// in, so a service with its own network namespace needs its own.
+	if iso.Network {
+		err = syscall.Unmount(in("/sys"), syscall.MNT_DETACH)
+		if err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("failed to detach /sys: %s", err)
+		}
+		err = syscall.Mount("sysfs", in("/sys"), "sysfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_RDONLY, "")
+		if err != nil {
+			return fmt.Errorf("failed to mount /sys: %s", err)
+		}
+	}
+
+	// Pivoting the staging directory onto itself stacks the old root
+	// beneath the new one, where we can detach it without needing a
+	// directory to put it in.
+	err = syscall.Chdir(staging)
+	if err != nil {
+		return err
+	}
+	err = syscall.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("failed to pivot root: %s", err)
+	}
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("failed to detach old root: %s", err)
+	}
+	err = syscall.Chdir("/")
+	if err != nil {
+		return err
+	}
+
+	return remountIsolatedReadOnly(writable)
+}
+
+func mountIsolatedTmpfs(dir string, data string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data)
+	if err != nil {
+		return fmt.Errorf("failed to mount tmpfs on %s: %s", dir, err)
+	}
+	return nil
+}
+
+// setupIsolatedDev creates a minimal /dev at the given path, with only
+// the harmless devices bound in from the real /dev.
+func setupIsolatedDev(dev string) error {
+	err := os.MkdirAll(dev, 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("failed to mount tmpfs on /dev: %s", err)
+	}
+
+	for _, name := range isolatedDevices {
+		path := filepath.Join(dev, name)
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		err = syscall.Mount(filepath.Join("/dev", name), path, "", syscall.MS_BIND, "")
+		if err != nil {
+			return fmt.Errorf("failed to bind /dev/%s: %s", name, err)
+		}
+	}
+
+	// A devpts instance of our own, so that the service can't see the
+	// system's ptys.
+	err = os.Mkdir(filepath.Join(dev, "pts"), 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount(
+		"devpts", filepath.Join(dev, "pts"), "devpts",
+		syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mount /dev/pts: %s", err)
+	}
+	err = os.Symlink("pts/ptmx", filepath.Join(dev, "ptmx"))
+	if err != nil {
+		return err
+	}
+
+	err = mountIsolatedTmpfs(filepath.Join(dev, "shm"), "mode=1777")
+	if err != nil {
+		return err
+	}
+
+	for _, link := range devSymlinks {
+		err := os.Symlink(link.Target, filepath.Join(dev, filepath.Base(link.Path)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remountIsolatedReadOnly makes every mount in our namespace read-only
+// except for those at the given mount points and the kernel filesystems.
+// Bind mounts must be remounted one by one, since making a mount
+// read-only doesn't affect the mounts beneath it.
+func remountIsolatedReadOnly(writable map[string]bool) error {
+	mounts, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return err
+	}
+
+	for target, m := range mounts {
+		if writable[target] || m.ReadOnly() || m.FSType == "proc" {
+			continue
+		}
+		err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		if err != nil {
+			return fmt.Errorf("failed to make %s read-only: %s", target, err)
+		}
+	}
+	return nil
+}
+
+// runServiceInit stands in for init within an isolated service's PID
+// namespace. The first process in a PID namespace ignores any signal it
+// has no handler for, and inherits the namespace's orphaned processes,
+// neither of which most services are written to cope with. So rather
+// than becoming the service, we start it as our child, in a second
+// re-execution of defgrid-init that applies its privileges, and then pass
+// on the signals meant for it and reap orphans until it exits. We exit
+// with its status, at which point the kernel kills anything left in the
+// namespace.
+func runServiceInit() error {
+	signals := make(chan os.Signal, len(isolationForwardedSignals))
+	signal.Notify(signals, isolationForwardedSignals...)
+
+	args := append([]string{serviceExecChildArg}, os.Args[1:]...)
+	pid, err := syscall.ForkExec("/proc/self/exe", args, &syscall.ProcAttr{
+		Env:   os.Environ(),
+		Files: []uintptr{0, 1, 2},
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for sig := range signals {
+			syscall.Kill(pid, sig.(syscall.Signal))
+		}
+	}()
+
+	for {
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to wait for service: %s", err)
+		}
+		if wpid != pid {
+			// An orphan, which we needed only to reap.
+			continue
+		}
+
+		switch {
+		case status.Exited():
+			os.Exit(status.ExitStatus())
+		case status.Signaled():
+			// We can't be killed by a signal of our own, so we exit
+			// with the status a shell would report.
+			os.Exit(128 + int(status.Signal()))
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ServicePrivileges restricts what a service's processes may do, beyond
+// what their user id allows. For example, Consul might keep only
+// CAP_NET_BIND_SERVICE so that it can serve DNS on port 53, while Vault
+// keeps CAP_IPC_LOCK and a memlock rlimit so that it can mlock secrets.
+type ServicePrivileges struct {
+	// Capabilities are the Linux capabilities that the service keeps, by
+	// name, such as "CAP_NET_BIND_SERVICE". All others are dropped,
+	// including from the bounding set so they can't be regained. If
+	// Capabilities is omitted, the capabilities are left alone, whereas
+	// an empty list drops them all.
+	Capabilities []string `json:"capabilities"`
+
+	// NoNewPrivs prevents the service from gaining privileges through
+	// setuid programs and file capabilities. It's set automatically when
+	// there's a seccomp profile and CAP_SYS_ADMIN isn't kept, since the
+	// kernel requires it then.
+	NoNewPrivs bool `json:"no_new_privs"`
+
+	// Seccomp, if set, limits which system calls the service may make.
+	Seccomp *SeccompProfile `json:"seccomp"`
+
+	// Rlimits sets resource limits, by their names from setrlimit(2)
+	// without the RLIMIT_ prefix, such as "nofile" and "memlock".
+	Rlimits map[string]ServiceRlimit `json:"rlimits"`
+
+	// OOMScoreAdj, if set, adjusts how likely the service is to be
+	// chosen by the OOM killer, from -1000 (never) to 1000.
+	OOMScoreAdj *int `json:"oom_score_adj"`
+}
+
+// ServiceRlimit is a soft and hard resource limit. -1 means unlimited.
+type ServiceRlimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+// SeccompProfile is a list of system calls that are either the only ones
+// allowed or the ones denied. Denied system calls fail with EPERM.
+type SeccompProfile struct {
+	// Mode is "allowlist" or "denylist".
+	Mode string `json:"mode"`
+
+	// Syscalls are the system call names, such as "ptrace".
+	//
+	// An allowlist also implicitly allows seccompImplicitSyscalls, which
+	// we need in order to start the service's program.
+	Syscalls []string `json:"syscalls"`
+}
+
+// The Linux capabilities, in order of their numbers.
+var capabilityNames = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+var rlimitResources = map[string]int{
+	"cpu":        0,
+	"fsize":      1,
+	"data":       2,
+	"stack":      3,
+	"core":       4,
+	"rss":        5,
+	"nproc":      6,
+	"nofile":     7,
+	"memlock":    8,
+	"as":         9,
+	"locks":      10,
+	"sigpending": 11,
+	"msgqueue":   12,
+	"nice":       13,
+	"rtprio":     14,
+	"rttime":     15,
+}
+
+// The syscalls an allowlist always allows, since we need them to start
+// the service's program once the filter is in place.
+//
+// The filter is installed while the Go runtime is still running on the
+// thread that then calls exec, and the runtime may need to do its usual
+// work there in the meantime: take a preemption signal, grow a stack,
+// wait on a lock, or start another thread, which inherits the filter and
+// may then run the scheduler. syscall.Exec itself also restores the
+// RLIMIT_NOFILE that the runtime raised at startup. So the allowlist
+// must also include what the runtime needs for all of that, which means
+// that a service's allowlist can't take away its ability to create
+// threads or map memory. Syscalls that don't exist on this architecture,
+// like epoll_wait on arm64, are skipped.
+var seccompImplicitSyscalls = []string{
+	"execve", "exit", "exit_group",
+	"rt_sigreturn", "rt_sigaction", "rt_sigprocmask", "sigaltstack", "tgkill", "getpid", "gettid",
+	"futex", "sched_yield", "nanosleep", "clock_gettime", "epoll_pwait", "epoll_wait",
+	"mmap", "munmap", "madvise", "clone",
+	"prlimit64", "setrlimit",
+	"write",
+}
+
+// From linux/capability.h, linux/prctl.h and linux/seccomp.h.
+const (
+	linuxCapabilityVersion3 = 0x20080522
+
+	prCapBSetDrop       = 24
+	prSetNoNewPrivs     = 38
+	prCapAmbient        = 47
+	prCapAmbientRaise   = 2
+	prCapAmbientClear   = 4
+	prSetSeccomp        = 22
+	seccompModeFilter   = 2
+	seccompRetKillProc  = 0x80000000
+	seccompRetErrno     = 0x00050000
+	seccompRetAllow     = 0x7fff0000
+	seccompDataNROffset = 0
+	seccompDataArchOff  = 4
+)
+
+const capLastCapPath = "/proc/sys/kernel/cap_last_cap"
+
+// validate checks the privileges for mistakes before we try to start a
+// service with them, since errors in the re-executed defgrid-init are
+// harder to diagnose.
+func (p *ServicePrivileges) validate() error {
+	_, err := p.capabilitySet()
+	if err != nil {
+		return err
+	}
+
+	for name, limit := range p.Rlimits {
+		if _, ok := rlimitResources[name]; !ok {
+			return fmt.Errorf("unknown rlimit %q", name)
+		}
+		if limit.Soft < -1 || limit.Hard < -1 {
+			return fmt.Errorf("invalid limits for rlimit %q", name)
+		}
+	}
+
+	if p.OOMScoreAdj != nil && (*p.OOMScoreAdj < -1000 || *p.OOMScoreAdj > 1000) {
+		return fmt.Errorf("oom_score_adj must be between -1000 and 1000")
+	}
+
+	if p.Seccomp != nil {
+		_, err := p.Seccomp.filter()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// capabilitySet returns the kept capabilities as a bit set.
+func (p *ServicePrivileges) capabilitySet() (uint64, error) {
+	var set uint64
+	for _, name := range p.Capabilities {
+		found := false
+		for i, capName := range capabilityNames {
+			if strings.EqualFold(name, capName) {
+				set |= 1 << uint(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+	}
+	return set, nil
+}
+
+// apply restricts the current thread, which must then call exec. The
+// OOM score and rlimits are set first, while we still have the
+// capabilities needed to raise them.
+func (p *ServicePrivileges) apply() error {
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+
+	if p.OOMScoreAdj != nil {
+		err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*p.OOMScoreAdj)), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to set oom_score_adj: %s", err)
+		}
+	}
+
+	for name, limit := range p.Rlimits {
+		rlimit := &syscall.Rlimit{
+			Cur: rlimitValue(limit.Soft),
+			Max: rlimitValue(limit.Hard),
+		}
+		err := syscall.Setrlimit(rlimitResources[name], rlimit)
+		if err != nil {
+			return fmt.Errorf("failed to set rlimit %q: %s", name, err)
+		}
+	}
+
+	keepSysAdmin := true
+	if p.Capabilities != nil {
+		keep, _ := p.capabilitySet()
+		err := setCapabilities(keep)
+		if err != nil {
+			return err
+		}
+		const capSysAdmin = 21
+		keepSysAdmin = keep&(1<<capSysAdmin) != 0
+	}
+
+	noNewPrivs := p.NoNewPrivs || (p.Seccomp != nil && !keepSysAdmin)
+	if noNewPrivs {
+		err := prctl(prSetNoNewPrivs, 1, 0)
+		if err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %s", err)
+		}
+	}
+
+	if p.Seccomp != nil {
+		filter, _ := p.Seccomp.filter()
+		prog := syscall.SockFprog{
+			Len:    uint16(len(filter)),
+			Filter: &filter[0],
+		}
+		err := prctl(prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+		if err != nil {
+			return fmt.Errorf("failed to install seccomp filter: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func rlimitValue(v int64) uint64 {
+	if v == -1 {
+		return ^uint64(0) // RLIM_INFINITY
+	}
+	return uint64(v)
+}
+
+// setCapabilities drops all capabilities except those in the given set,
+// from the bounding set as well as the effective, permitted and
+// inheritable sets. The kept capabilities are also made ambient, so that
+// they survive exec even if the service doesn't run as root.
+func setCapabilities(keep uint64) error {
+	lastCap := len(capabilityNames) - 1
+	if data, err := ioutil.ReadFile(capLastCapPath); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			lastCap = n
+		}
+	}
+
+	for c := 0; c <= lastCap; c++ {
+		if keep&(1<<uint(c)) != 0 {
+			continue
+		}
+		err := prctl(prCapBSetDrop, uintptr(c), 0)
+		if err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("failed to drop %s from bounding set: %s", capabilityName(c), err)
+		}
+	}
+
+	header := struct {
+		version uint32
+		pid     int32
+	}{linuxCapabilityVersion3, 0}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	for i := range data {
+		bits := uint32(keep >> (32 * uint(i)))
+		data[i].effective = bits
+		data[i].permitted = bits
+		data[i].inheritable = bits
+	}
+	_, _, errno := syscall.RawSyscall(
+		syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0,
+	)
+	if errno != 0 {
+		return fmt.Errorf("failed to set capabilities: %s", errno)
+	}
+
+	// Ambient capabilities are new in Linux 4.3; without them, kept
+	// capabilities only survive exec for services running as root.
+	err := prctl(prCapAmbient, prCapAmbientClear, 0)
+	if err == syscall.EINVAL {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clear ambient capabilities: %s", err)
+	}
+	for c := 0; c < len(capabilityNames); c++ {
+		if keep&(1<<uint(c)) == 0 {
+			continue
+		}
+		err := prctl(prCapAmbient, prCapAmbientRaise, uintptr(c))
+		if err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("failed to raise ambient %s: %s", capabilityName(c), err)
+		}
+	}
+
+	return nil
+}
+
+func capabilityName(c int) string {
+	if c < len(capabilityNames) {
+		return capabilityNames[c]
+	}
+	return fmt.Sprintf("capability %d", c)
+}
+
+func prctl(option int, arg2 uintptr, arg3 uintptr) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, uintptr(option), arg2, arg3, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// filter compiles the profile into a seccomp BPF program.
+func (s *SeccompProfile) filter() ([]syscall.SockFilter, error) {
+	if seccompSyscalls == nil {
+		return nil, fmt.Errorf("seccomp profiles aren't supported on this architecture")
+	}
+
+	var listedAction, defaultAction uint32
+	names := s.Syscalls
+	switch s.Mode {
+	case "allowlist":
+		listedAction = seccompRetAllow
+		defaultAction = seccompRetErrno | uint32(syscall.EPERM)
+		names = append([]string(nil), names...)
+		for _, name := range seccompImplicitSyscalls {
+			if _, ok := seccompSyscalls[name]; ok {
+				names = append(names, name)
+			}
+		}
+	case "denylist":
+		listedAction = seccompRetErrno | uint32(syscall.EPERM)
+		defaultAction = seccompRetAllow
+	default:
+		return nil, fmt.Errorf("seccomp mode must be \"allowlist\" or \"denylist\", not %q", s.Mode)
+	}
+
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+
+	// A process could get around the filter by making system calls with
+	// another architecture's numbering, so we kill anything that tries.
+	prog := []syscall.SockFilter{
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArchOff),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, seccompAuditArch, 1, 0),
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProc),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNROffset),
+	}
+	if seccompSyscallBits != 0 {
+		prog = append(prog,
+			jump(syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K, seccompSyscallBits, 0, 1),
+			stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProc),
+		)
+	}
+
+	seen := map[uint32]bool{}
+	for _, name := range names {
+		nr, ok := seccompSyscalls[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown system call %q", name)
+		}
+		if seen[nr] {
+			continue
+		}
+		seen[nr] = true
+
+		// Each comparison is followed by its own return so that no jump
+		// is longer than one instruction, since BPF jumps are limited
+		// to 255 instructions.
+		prog = append(prog,
+			jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, 0, 1),
+			stmt(syscall.BPF_RET|syscall.BPF_K, listedAction),
+		)
+	}
+	prog = append(prog, stmt(syscall.BPF_RET|syscall.BPF_K, defaultAction))
+
+	return prog, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runSeccompFilter interprets the instructions that SeccompProfile.filter
+// generates, for a system call with the given architecture and number.
+func runSeccompFilter(t *testing.T, prog []syscall.SockFilter, arch uint32, nr uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Code {
+		case syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS:
+			switch ins.K {
+			case seccompDataNROffset:
+				acc = nr
+			case seccompDataArchOff:
+				acc = arch
+			default:
+				t.Fatalf("load from unexpected offset %d", ins.K)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K:
+			if acc&ins.K != 0 {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case syscall.BPF_RET | syscall.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %#v", ins)
+		}
+	}
+	t.Fatalf("filter ran off the end")
+	return 0
+}
+
+func TestSeccompProfileFilter(t *testing.T) {
+	if seccompSyscalls == nil {
+		t.Skip("seccomp profiles aren't supported on this architecture")
+	}
+
+	denied := seccompRetErrno | uint32(syscall.EPERM)
+	tests := []struct {
+		name    string
+		profile SeccompProfile
+		want    map[string]uint32
+	}{
+		{
+			name:    "allowlist",
+			profile: SeccompProfile{Mode: "allowlist", Syscalls: []string{"read", "openat", "read"}},
+			want: map[string]uint32{
+				"read":    seccompRetAllow,
+				"openat":  seccompRetAllow,
+				"execve":  seccompRetAllow,
+				"futex":   seccompRetAllow,
+				"mkdirat": denied,
+				"ptrace":  denied,
+			},
+		},
+		{
+			name:    "empty allowlist",
+			profile: SeccompProfile{Mode: "allowlist"},
+			want: map[string]uint32{
+				"execve": seccompRetAllow,
+				"read":   denied,
+			},
+		},
+		{
+			name:    "denylist",
+			profile: SeccompProfile{Mode: "denylist", Syscalls: []string{"ptrace", "mkdirat"}},
+			want: map[string]uint32{
+				"ptrace":  denied,
+				"mkdirat": denied,
+				"read":    seccompRetAllow,
+				"execve":  seccompRetAllow,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prog, err := test.profile.filter()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for name, want := range test.want {
+				got := runSeccompFilter(t, prog, seccompAuditArch, seccompSyscalls[name])
+				if got != want {
+					t.Errorf("%s: got action %#x; want %#x", name, got, want)
+				}
+			}
+
+			// Other architectures' system calls are always fatal.
+			got := runSeccompFilter(t, prog, seccompAuditArch+1, seccompSyscalls["read"])
+			if got != seccompRetKillProc {
+				t.Errorf("other architecture: got action %#x; want %#x", got, seccompRetKillProc)
+			}
+			if seccompSyscallBits != 0 {
+				got := runSeccompFilter(t, prog, seccompAuditArch, seccompSyscalls["read"]|seccompSyscallBits)
+				if got != seccompRetKillProc {
+					t.Errorf("x32 system call: got action %#x; want %#x", got, seccompRetKillProc)
+				}
+			}
+		})
+	}
+}
+
+func TestSeccompProfileFilterInvalid(t *testing.T) {
+	if seccompSyscalls == nil {
+		t.Skip("seccomp profiles aren't supported on this architecture")
+	}
+
+	for _, profile := range []SeccompProfile{
+		{Mode: "", Syscalls: []string{"read"}},
+		{Mode: "blocklist", Syscalls: []string{"read"}},
+		{Mode: "denylist", Syscalls: []string{"not_a_syscall"}},
+		{Mode: "allowlist", Syscalls: []string{"arch_specific_syscall"}},
+	} {
+		_, err := profile.filter()
+		if err == nil {
+			t.Errorf("no error for %#v", profile)
+		}
+	}
+}
+
+func TestServicePrivilegesCapabilitySet(t *testing.T) {
+	tests := []struct {
+		caps    []string
+		want    uint64
+		wantErr bool
+	}{
+		{nil, 0, false},
+		{[]string{}, 0, false},
+		{[]string{"CAP_NET_BIND_SERVICE"}, 1 << 10, false},
+		{[]string{"cap_ipc_lock", "CAP_CHOWN"}, 1<<14 | 1<<0, false},
+		{[]string{"CAP_CHECKPOINT_RESTORE"}, 1 << 40, false},
+		{[]string{"CAP_NET_BIND_SERVICE", "CAP_FLY"}, 0, true},
+		{[]string{"NET_BIND_SERVICE"}, 0, true},
+	}
+
+	for _, test := range tests {
+		p := &ServicePrivileges{Capabilities: test.caps}
+		got, err := p.capabilitySet()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: succeeded; want error", test.caps)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.caps, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %#x; want %#x", test.caps, got, test.want)
+		}
+	}
+}
+
+func TestServicePrivilegesValidate(t *testing.T) {
+	adj := func(n int) *int { return &n }
+
+	valid := []*ServicePrivileges{
+		{},
+		{
+			Capabilities: []string{"CAP_IPC_LOCK"},
+			NoNewPrivs:   true,
+			Rlimits: map[string]ServiceRlimit{
+				"memlock": {Soft: -1, Hard: -1},
+				"nofile":  {Soft: 65536, Hard: 65536},
+			},
+			OOMScoreAdj: adj(-500),
+		},
+	}
+	for _, p := range valid {
+		if err := p.validate(); err != nil {
+			t.Errorf("unexpected error for %#v: %s", p, err)
+		}
+	}
+
+	invalid := []*ServicePrivileges{
+		{Capabilities: []string{"CAP_FLY"}},
+		{Rlimits: map[string]ServiceRlimit{"files": {Soft: 1, Hard: 1}}},
+		{Rlimits: map[string]ServiceRlimit{"nofile": {Soft: -2, Hard: 1}}},
+		{OOMScoreAdj: adj(1001)},
+		{OOMScoreAdj: adj(-1001)},
+	}
+	if seccompSyscalls != nil {
+		invalid = append(invalid, &ServicePrivileges{Seccomp: &SeccompProfile{Mode: "allowlist", Syscalls: []string{"nope"}}})
+	}
+	for _, p := range invalid {
+		if err := p.validate(); err == nil {
+			t.Errorf("no error for %#v", p)
+		}
+	}
+}
+
+func TestServicePrivilegesApply(t *testing.T) {
+	requireRoot(t)
+
+	e := &ServiceExec{
+		Privileges: &ServicePrivileges{
+			Capabilities: []string{"CAP_NET_BIND_SERVICE"},
+			Rlimits: map[string]ServiceRlimit{
+				"nofile": {Soft: 1000, Hard: 2000},
+			},
+			OOMScoreAdj: func(n int) *int { return &n }(300),
+		},
+	}
+	if seccompSyscalls != nil {
+		e.Privileges.Seccomp = &SeccompProfile{Mode: "denylist", Syscalls: []string{"mkdir", "mkdirat"}}
+	}
+
+	dir := t.TempDir()
+	cmd, err := e.Command(nil, "sh", "-c", `
+grep -E '^(CapEff|CapBnd|NoNewPrivs)' /proc/self/status
+echo "nofile $(ulimit -Sn) $(ulimit -Hn)"
+echo "oom $(cat /proc/self/oom_score_adj)"
+mkdir `+dir+`/x 2>/dev/null && echo "mkdir allowed"
+true
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("service failed: %s\n%s", err, out)
+	}
+
+	got := string(out)
+	want := []string{
+		"CapEff:\t0000000000000400",
+		"CapBnd:\t0000000000000400",
+		"nofile 1000 2000",
+		"oom 300",
+	}
+	if seccompSyscalls != nil {
+		// Seccomp without CAP_SYS_ADMIN requires no_new_privs.
+		want = append(want, "NoNewPrivs:\t1")
+	}
+	for _, line := range want {
+		if !strings.Contains(got, line) {
+			t.Errorf("output lacks %q\n%s", line, got)
+		}
+	}
+	if seccompSyscalls != nil && strings.Contains(got, "mkdir allowed") {
+		t.Errorf("denied mkdir succeeded")
+	}
+}
+
+// seccompRuntimeTestEnvVar has TestMain run seccompRuntimeTestChild in
+// place of the tests.
+const seccompRuntimeTestEnvVar = "DGI_TEST_SECCOMP_RUNTIME"
+
+// seccompRuntimeTestChild installs an allowlist of nothing but the
+// implicit system calls and then keeps the Go runtime busy, as it may be
+// between installing the filter and calling exec, exiting with status 3
+// if all goes well. If the runtime needs a system call the filter denies
+// then it crashes or hangs instead.
+func seccompRuntimeTestChild() {
+	runtime.LockOSThread()
+
+	p := &ServicePrivileges{
+		NoNewPrivs: true,
+		Seccomp:    &SeccompProfile{Mode: "allowlist"},
+	}
+	err := p.apply()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	done := make(chan []byte)
+	for i := 0; i < 4; i++ {
+		go func() {
+			buf := make([]byte, 8<<20)
+			time.Sleep(10 * time.Millisecond)
+			done <- buf
+		}()
+	}
+	var total int
+	for i := 0; i < 4; i++ {
+		total += len(<-done)
+	}
+	runtime.GC()
+	time.Sleep(50 * time.Millisecond)
+
+	// A system call outside the allowlist fails rather than killing us.
+	if _, err := os.Open("/"); err == nil || total == 0 {
+		os.Exit(1)
+	}
+	os.Exit(3)
+}
+
+func TestSeccompImplicitSyscallsRuntime(t *testing.T) {
+	if seccompSyscalls == nil {
+		t.Skip("seccomp profiles aren't supported on this architecture")
+	}
+
+	cmd := exec.Command("/proc/self/exe", "-test.run=^$")
+	cmd.Env = append(os.Environ(), seccompRuntimeTestEnvVar+"=1")
+	out := &limitedBuffer{Limit: 4096}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		<-exited
+		t.Fatalf("runtime hung under the implicit allowlist\n%s", out)
+	}
+	if code := cmd.ProcessState.ExitCode(); code != 3 {
+		t.Errorf("runtime failed under the implicit allowlist with status %d\n%s", code, out)
+	}
+}
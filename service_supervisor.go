@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServiceDefinition describes a service that defgrid-init starts once
+// boot is complete and then supervises, restarting it whenever it exits.
+// Services are given in the "services" list of a flavor definition.
+type ServiceDefinition struct {
+	// Name identifies the service in log messages, and names its cgroup.
+	Name string `json:"name"`
+
+	// Command is the program to run, with its arguments.
+	Command []string `json:"command"`
+
+	// Icon is the name of the icon that shows the service's status on the
+	// console, such as "consul", or empty for none.
+	Icon string `json:"icon"`
+
+	// Limits are the resource limits for the service's cgroup.
+	Limits *CgroupLimits `json:"limits"`
+
+	// Isolation, if set, runs the service in namespaces of its own.
+	Isolation *ServiceIsolation `json:"isolation"`
+
+	// Privileges, if set, restricts what the service may do.
+	Privileges *ServicePrivileges `json:"privileges"`
+
+	// Checks are the service's health checks, whose combined result is
+	// shown on the console. A service with no checks is passing for as
+	// long as it runs.
+	Checks []*HealthCheck `json:"checks"`
+
+	// RestartAfterCritical is how many seconds the service may stay
+	// critical before it is restarted, defaulting to 120. A new service
+	// is critical until its checks pass, so this also bounds how long it
+	// has to start up.
+	RestartAfterCritical int `json:"restart_after_critical"`
+
+	// Watchdog marks a service that the node is no use without. If it
+	// stays critical for more than twice RestartAfterCritical, so that
+	// restarting it hasn't helped, then the watchdog is no longer
+	// petted and the node is reset. Other services never stop the
+	// watchdog being petted.
+	Watchdog bool `json:"watchdog"`
+}
+
+// The names of the console icons, for service definitions.
+var consoleIconNames = map[string]ConsoleIcon{
+	"consul":     ConsoleIconConsul,
+	"vault":      ConsoleIconVault,
+	"nomad":      ConsoleIconNomad,
+	"bastion":    ConsoleIconBastion,
+	"tunnel":     ConsoleIconTunnel,
+	"prometheus": ConsoleIconPrometheus,
+	"bootstrap":  ConsoleIconBootstrap,
+}
+
+const (
+	// The delay before restarting a service that has exited doubles each
+	// time it exits again soon after starting, up to the maximum.
+	serviceRestartMinDelay = 1 * time.Second
+	serviceRestartMaxDelay = 1 * time.Minute
+
+	// A service that stays up this long is considered to have started
+	// successfully, which resets the restart delay.
+	serviceStableRuntime = 1 * time.Minute
+
+	// How long a service has to exit after SIGTERM before we kill it.
+	serviceStopTimeout = 10 * time.Second
+
+	serviceDefaultRestartAfterCritical = 2 * time.Minute
+)
+
+// validate checks the definition for mistakes, so that they're reported
+// when the flavor is loaded rather than once boot is complete.
+func (d *ServiceDefinition) validate() error {
+	if !cgroupNameRegexp.MatchString(d.Name) || d.Name == "." || d.Name == ".." {
+		return fmt.Errorf("invalid service name %q", d.Name)
+	}
+	if len(d.Command) == 0 {
+		return fmt.Errorf("service %s has no command", d.Name)
+	}
+	if _, ok := consoleIconNames[d.Icon]; d.Icon != "" && !ok {
+		return fmt.Errorf("service %s has unknown icon %q", d.Name, d.Icon)
+	}
+	if d.Isolation != nil {
+		err := d.Isolation.validate()
+		if err != nil {
+			return fmt.Errorf("service %s: %s", d.Name, err)
+		}
+	}
+	if d.Privileges != nil {
+		err := d.Privileges.validate()
+		if err != nil {
+			return fmt.Errorf("service %s: %s", d.Name, err)
+		}
+	}
+	for _, hc := range d.Checks {
+		err := hc.validate()
+		if err != nil {
+			return fmt.Errorf("service %s: %s", d.Name, err)
+		}
+	}
+	if d.RestartAfterCritical < 0 {
+		return fmt.Errorf("service %s has a negative restart_after_critical", d.Name)
+	}
+	return nil
+}
+
+func (d *ServiceDefinition) restartAfterCritical() time.Duration {
+	if d.RestartAfterCritical == 0 {
+		return serviceDefaultRestartAfterCritical
+	}
+	return time.Duration(d.RestartAfterCritical) * time.Second
+}
+
+// ServiceSupervisor runs one service, restarting it whenever it exits,
+// until it is stopped.
+//
+// When it manages cgroups, each service runs in a cgroup of its own, so
+// that its resources can be limited, all of its processes can be killed
+// when it stops, and processes killed for running out of memory can be
+// reported. In the dev flavors the cgroups belong to the host, so we
+// just run the processes.
+type ServiceSupervisor struct {
+	Definition *ServiceDefinition
+	Console    *Console
+
+	icon   ConsoleIcon
+	cgroup *Cgroup
+
+	stop chan struct{}
+	done chan struct{}
+
+	// Must be held while accessing the fields below.
+	mutex   sync.Mutex
+	process *os.Process
+
+	// When the service last became critical, or zero if it isn't. This
+	// spans restarts, so that a service that keeps failing is seen to.
+	criticalSince time.Time
+}
+
+// NewServiceSupervisor prepares to run the given service, creating its
+// cgroup if useCgroups is set.
+func NewServiceSupervisor(def *ServiceDefinition, console *Console, useCgroups bool) (*ServiceSupervisor, error) {
+	err := def.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ServiceSupervisor{
+		Definition: def,
+		Console:    console,
+		icon:       consoleIconNames[def.Icon],
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	if useCgroups {
+		s.cgroup, err = NewServiceCgroup(def.Name, def.Limits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cgroup: %s", err)
+		}
+		// Anything left over from an earlier run would count against the
+		// new one's limits.
+		err = s.cgroup.Kill()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Run runs the service until Stop is called.
+func (s *ServiceSupervisor) Run() {
+	defer close(s.done)
+
+	if s.cgroup != nil {
+		go s.cgroup.WatchOOMKills(s.Console, s.icon, s.stop)
+	}
+
+	delay := serviceRestartMinDelay
+	for {
+		started := time.Now()
+		err := s.runOnce()
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("[ERROR] Service %s failed: %s", s.Definition.Name, err)
+		} else {
+			log.Printf("[ERROR] Service %s exited", s.Definition.Name)
+		}
+		s.showStatus(ServiceCritical)
+		s.noteStatus(ServiceCritical)
+
+		if time.Since(started) >= serviceStableRuntime {
+			delay = serviceRestartMinDelay
+		}
+		log.Printf("Restarting service %s in %s", s.Definition.Name, delay)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > serviceRestartMaxDelay {
+			delay = serviceRestartMaxDelay
+		}
+	}
+}
+
+// runOnce starts the service's process and waits for it to exit, and
+// then kills any other processes it left behind. While the process runs
+// its health checks give its status, and if it stays critical for too
+// long then we stop it so that Run restarts it.
+func (s *ServiceSupervisor) runOnce() error {
+	def := s.Definition
+	monitor, err := NewHealthMonitor(def.Name, s.icon, s.Console, def.Checks)
+	if err != nil {
+		return err
+	}
+	// OnChange may be called from several checks at once, so it only
+	// pokes us, and we ask the monitor for the status.
+	changed := make(chan struct{}, 1)
+	monitor.OnChange = func(status ServiceStatus, output string) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	cmd, err := s.command()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err = s.start(cmd)
+	if err != nil {
+		return err
+	}
+	log.Printf("Started service %s (pid %d)", def.Name, cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	stopChecks := make(chan struct{})
+	checksDone := make(chan struct{})
+	go func() {
+		defer close(checksDone)
+		monitor.Run(stopChecks)
+	}()
+
+	err = s.waitHealthy(cmd.Process, monitor, changed, exited)
+
+	// The checks mustn't overwrite the status that Run shows next.
+	close(stopChecks)
+	<-checksDone
+
+	s.mutex.Lock()
+	s.process = nil
+	s.mutex.Unlock()
+
+	if s.cgroup != nil {
+		killErr := s.cgroup.Kill()
+		if killErr != nil {
+			log.Printf("[ERROR] Failed to kill remaining processes of %s: %s", s.Definition.Name, killErr)
+		}
+	}
+	return err
+}
+
+// waitHealthy waits for the service's process to exit, stopping it if
+// the monitor reports it critical for longer than the definition allows.
+func (s *ServiceSupervisor) waitHealthy(process *os.Process, monitor *HealthMonitor, changed <-chan struct{}, exited <-chan error) error {
+	limit := s.Definition.restartAfterCritical()
+	var deadline <-chan time.Time
+	stopping := false
+	for {
+		if !stopping {
+			deadline = nil
+			status, since := monitor.Status()
+			s.noteStatus(status)
+			if status == ServiceCritical {
+				deadline = time.After(time.Until(since.Add(limit)))
+			}
+		}
+
+		select {
+		case err := <-exited:
+			return err
+		case <-changed:
+		case <-deadline:
+			if stopping {
+				log.Printf("[WARNING] Service %s didn't stop within %s; killing it", s.Definition.Name, serviceStopTimeout)
+				s.kill(process)
+				deadline = nil
+				continue
+			}
+			log.Printf("[ERROR] Service %s has been critical for %s; restarting it", s.Definition.Name, limit)
+			process.Signal(syscall.SIGTERM)
+			stopping = true
+			deadline = time.After(serviceStopTimeout)
+		}
+	}
+}
+
+// kill kills the service's processes, all of them if we have its cgroup.
+func (s *ServiceSupervisor) kill(process *os.Process) {
+	if s.cgroup == nil {
+		process.Kill()
+		return
+	}
+	err := s.cgroup.Kill()
+	if err != nil {
+		log.Printf("[ERROR] Failed to kill service %s: %s", s.Definition.Name, err)
+	}
+}
+
+func (s *ServiceSupervisor) command() (*exec.Cmd, error) {
+	def := s.Definition
+	e := &ServiceExec{
+		Isolation:  def.Isolation,
+		Privileges: def.Privileges,
+	}
+	return e.Command(s.cgroup, def.Command[0], def.Command[1:]...)
+}
+
+func (s *ServiceSupervisor) start(cmd *exec.Cmd) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Stop may have been called while we weren't holding the mutex.
+	select {
+	case <-s.stop:
+		return fmt.Errorf("stopped")
+	default:
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	s.process = cmd.Process
+	return nil
+}
+
+// Stop asks the service to stop with SIGTERM, kills it if it hasn't
+// stopped within serviceStopTimeout, and waits for Run to return.
+func (s *ServiceSupervisor) Stop() {
+	s.mutex.Lock()
+	close(s.stop)
+	process := s.process
+	s.mutex.Unlock()
+
+	if process != nil {
+		log.Printf("Stopping service %s", s.Definition.Name)
+		process.Signal(syscall.SIGTERM)
+		select {
+		case <-s.done:
+		case <-time.After(serviceStopTimeout):
+			log.Printf("[WARNING] Service %s didn't stop within %s; killing it", s.Definition.Name, serviceStopTimeout)
+			if s.cgroup == nil {
+				process.Kill()
+			}
+		}
+	}
+
+	if s.cgroup != nil {
+		err := s.cgroup.Kill()
+		if err != nil {
+			log.Printf("[ERROR] Failed to kill service %s: %s", s.Definition.Name, err)
+		}
+	}
+	<-s.done
+
+	if s.cgroup != nil {
+		err := s.cgroup.Remove()
+		if err != nil {
+			log.Printf("[WARNING] Failed to remove cgroup of %s: %s", s.Definition.Name, err)
+		}
+	}
+}
+
+// noteStatus records the service's latest status, for Health.
+func (s *ServiceSupervisor) noteStatus(status ServiceStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case status != ServiceCritical:
+		s.criticalSince = time.Time{}
+	case s.criticalSince.IsZero():
+		s.criticalSince = time.Now()
+	}
+}
+
+// Health returns an error if the service is one that the watchdog relies
+// on and it has been critical for too long, or nil otherwise.
+func (s *ServiceSupervisor) Health() error {
+	if !s.Definition.Watchdog {
+		return nil
+	}
+	s.mutex.Lock()
+	since := s.criticalSince
+	s.mutex.Unlock()
+
+	limit := 2 * s.Definition.restartAfterCritical()
+	if !since.IsZero() && time.Since(since) > limit {
+		return fmt.Errorf("service %s has been critical for more than %s", s.Definition.Name, limit)
+	}
+	return nil
+}
+
+func (s *ServiceSupervisor) showStatus(status ServiceStatus) {
+	if s.Console == nil || s.icon == ConsoleIconNone {
+		return
+	}
+	s.Console.SetServiceStatus(s.icon, status)
+}
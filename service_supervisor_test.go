@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceDefinitionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		def     ServiceDefinition
+		wantErr string
+	}{
+		{
+			name: "valid",
+			def:  ServiceDefinition{Name: "consul", Command: []string{"consul", "agent"}, Icon: "consul"},
+		},
+		{
+			name: "no icon",
+			def:  ServiceDefinition{Name: "node-exporter", Command: []string{"node_exporter"}},
+		},
+		{
+			name:    "no name",
+			def:     ServiceDefinition{Command: []string{"true"}},
+			wantErr: "invalid service name",
+		},
+		{
+			name:    "path in name",
+			def:     ServiceDefinition{Name: "../consul", Command: []string{"true"}},
+			wantErr: "invalid service name",
+		},
+		{
+			name:    "no command",
+			def:     ServiceDefinition{Name: "consul"},
+			wantErr: "has no command",
+		},
+		{
+			name:    "bad check",
+			def:     ServiceDefinition{Name: "consul", Command: []string{"true"}, Checks: []*HealthCheck{{Name: "api"}}},
+			wantErr: "exactly one of",
+		},
+		{
+			name:    "unknown icon",
+			def:     ServiceDefinition{Name: "consul", Command: []string{"true"}, Icon: "kafka"},
+			wantErr: "unknown icon",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.def.validate()
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Errorf("succeeded; want error containing %q", test.wantErr)
+			case err != nil && !strings.Contains(err.Error(), test.wantErr):
+				t.Errorf("wrong error %q; want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestServiceSupervisorRestarts(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	s, err := NewServiceSupervisor(&ServiceDefinition{
+		Name:    "flaky",
+		Command: []string{"sh", "-c", "echo run >> " + runs + "; exit 1"},
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	go s.Run()
+	// The first restart is after serviceRestartMinDelay.
+	time.Sleep(serviceRestartMinDelay + 500*time.Millisecond)
+	s.Stop()
+
+	data, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "run"); got != 2 {
+		t.Errorf("service ran %d times; want 2", got)
+	}
+}
+
+func TestServiceSupervisorStop(t *testing.T) {
+	s, err := NewServiceSupervisor(&ServiceDefinition{
+		Name:    "sleepy",
+		Command: []string{"sleep", "100"},
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	go s.Run()
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(serviceStopTimeout / 2):
+		t.Fatalf("service didn't stop on SIGTERM")
+	}
+}
+
+func TestServiceSupervisorRestartsCritical(t *testing.T) {
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	healthy := filepath.Join(dir, "healthy")
+
+	// The service only becomes healthy on its second run, and traps
+	// SIGTERM to show that it was asked to stop.
+	script := `
+trap 'echo term >> ` + runs + `; exit 0' TERM
+test -e ` + runs + ` && touch ` + healthy + `
+echo run >> ` + runs + `
+while true; do sleep 0.1; done
+`
+	s, err := NewServiceSupervisor(&ServiceDefinition{
+		Name:    "unhealthy",
+		Command: []string{"sh", "-c", script},
+		Checks: []*HealthCheck{
+			{Name: "file", Exec: []string{"sh", "-c", "test -e " + healthy + " || exit 2"}, Interval: 1},
+		},
+		RestartAfterCritical: 2,
+	}, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	go s.Run()
+	// The first run is stopped after RestartAfterCritical, and restarted
+	// after serviceRestartMinDelay. The second passes its check within the
+	// limit, and is left alone.
+	time.Sleep(2*time.Second + serviceRestartMinDelay + 3*time.Second)
+	s.Stop()
+
+	data, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "run\nterm\nrun\nterm\n"; got != want {
+		t.Errorf("wrong runs %q; want %q", got, want)
+	}
+}
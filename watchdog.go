@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Watchdog drives a watchdog device, such as /dev/watchdog, which resets
+// the system unless it is petted regularly. We pet it from the main event
+// loop only while the system is healthy, so that if init wedges or the
+// system is stuck in a fatal error state then the hardware (or the
+// hypervisor) will reset it.
+//
+// The device may also be a regular file or a pipe, in which case setting
+// the timeout is skipped, which is handy for testing.
+type Watchdog struct {
+	Path string
+
+	// Timeout is how long the device waits for a pet before resetting the
+	// system. The device may round this to a value it supports.
+	Timeout time.Duration
+
+	file *os.File
+}
+
+// The default watchdog timeout if the flavor doesn't give one.
+const watchdogDefaultTimeout = 60 * time.Second
+
+// From linux/watchdog.h.
+const (
+	wdiocSetTimeout = 0xc0045706
+	watchdogMagic   = 'V'
+)
+
+// OpenWatchdog opens and arms the watchdog device at the given path.
+func OpenWatchdog(path string, timeout time.Duration) (*Watchdog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watchdog{
+		Path:    path,
+		Timeout: timeout,
+		file:    file,
+	}
+
+	secs := int32(timeout / time.Second)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, file.Fd(), wdiocSetTimeout, uintptr(unsafe.Pointer(&secs)),
+	)
+	switch errno {
+	case 0:
+		// The driver tells us the timeout it actually chose.
+		w.Timeout = time.Duration(secs) * time.Second
+	case syscall.ENOTTY:
+		// Not a real watchdog device, so there's no timeout to set.
+	default:
+		log.Printf("[WARNING] Can't set timeout of watchdog %s: %s", path, errno)
+	}
+
+	return w, nil
+}
+
+// PetInterval is how often the watchdog should be petted, which leaves
+// plenty of slack before the timeout.
+func (w *Watchdog) PetInterval() time.Duration {
+	interval := w.Timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// Pet postpones the reset for another Timeout.
+func (w *Watchdog) Pet() error {
+	_, err := w.file.Write([]byte{'.'})
+	return err
+}
+
+// Close disarms and closes the watchdog, for use during an orderly
+// shutdown. Drivers that allow disarming require the "magic close", which
+// is writing a 'V' just before closing the device.
+func (w *Watchdog) Close() error {
+	_, err := w.file.Write([]byte{watchdogMagic})
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("magic close failed: %s", err)
+	}
+	return w.file.Close()
+}
+
+// systemHealth returns an error describing why the system shouldn't be
+// considered healthy, or nil if it is. The watchdog isn't petted while the
+// system is unhealthy.
+//
+// A service that is merely critical doesn't count, since it may be
+// starting up or about to be restarted by its supervisor, which is
+// better than resetting the whole node. Only services marked for the
+// watchdog count, once they've been critical for too long.
+func systemHealth(console *Console, services []*ServiceSupervisor) error {
+	if err := console.FatalErrorState(); err != nil {
+		return fmt.Errorf("fatal error: %s", err)
+	}
+	for _, service := range services {
+		if err := service.Health(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
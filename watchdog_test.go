@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchdogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchdog")
+	err := os.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A regular file rejects the timeout ioctl with ENOTTY, which
+	// OpenWatchdog must tolerate, leaving the timeout as requested.
+	w, err := OpenWatchdog(path, 40*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := w.Timeout, 40*time.Second; got != want {
+		t.Errorf("wrong timeout %s; want %s", got, want)
+	}
+	if got, want := w.PetInterval(), 10*time.Second; got != want {
+		t.Errorf("wrong pet interval %s; want %s", got, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = w.Pet()
+		if err != nil {
+			t.Fatalf("pet failed: %s", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("close failed: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "..V"; string(got) != want {
+		t.Errorf("wrong writes %q; want %q", got, want)
+	}
+}
+
+func TestWatchdogPipe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchdog")
+	err := syscall.Mkfifo(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the write end of a FIFO blocks until there's a reader.
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	w, err := OpenWatchdog(path, 60*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = w.Pet()
+	if err != nil {
+		t.Fatalf("pet failed: %s", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("close failed: %s", err)
+	}
+
+	buf := make([]byte, 8)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), ".V"; got != want {
+		t.Errorf("wrong writes %q; want %q", got, want)
+	}
+}
+
+func TestWatchdogCloseFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchdog")
+	err := syscall.Mkfifo(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := OpenWatchdog(path, 60*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// With the reader gone the magic close can't be written, which
+	// must be reported since the device is then left armed.
+	r.Close()
+	err = w.Close()
+	if err == nil {
+		t.Fatalf("close succeeded; want error")
+	}
+}
+
+func TestOpenWatchdogMissing(t *testing.T) {
+	_, err := OpenWatchdog(filepath.Join(t.TempDir(), "watchdog"), time.Minute)
+	if err == nil {
+		t.Fatalf("succeeded; want error")
+	}
+}
+
+func TestSystemHealth(t *testing.T) {
+	console := &Console{}
+	if err := systemHealth(console, nil); err != nil {
+		t.Errorf("unexpected error with no services: %s", err)
+	}
+
+	newSupervisor := func(name string, watchdog bool) *ServiceSupervisor {
+		s, err := NewServiceSupervisor(&ServiceDefinition{
+			Name:                 name,
+			Command:              []string{"true"},
+			RestartAfterCritical: 60,
+			Watchdog:             watchdog,
+		}, nil, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return s
+	}
+	essential := newSupervisor("essential", true)
+	other := newSupervisor("other", false)
+	services := []*ServiceSupervisor{essential, other}
+
+	// A service that's starting up, or that has just exited, is critical
+	// until it passes its checks again.
+	essential.noteStatus(ServiceCritical)
+	other.noteStatus(ServiceCritical)
+	if err := systemHealth(console, services); err != nil {
+		t.Errorf("unexpected error with a service starting up: %s", err)
+	}
+
+	// Still critical once restarting it should have helped.
+	essential.criticalSince = time.Now().Add(-3 * time.Minute)
+	if err := systemHealth(console, services); err == nil {
+		t.Errorf("no error with a critical service")
+	}
+
+	essential.noteStatus(ServiceWarning)
+	other.criticalSince = time.Now().Add(-time.Hour)
+	if err := systemHealth(console, services); err != nil {
+		t.Errorf("unexpected error with only an inessential service critical: %s", err)
+	}
+
+	console.FatalError(fmt.Errorf("oops"))
+	if err := systemHealth(console, services); err == nil {
+		t.Errorf("no error with a fatal error")
+	}
+}